@@ -13,13 +13,11 @@ require (
 	github.com/launix-de/NonLockingReadMap v1.0.4
 	github.com/launix-de/go-mysqlstack v0.0.0-20230126065738-28daf61fbef8
 	github.com/launix-de/go-packrat/v2 v2.1.11
-	github.com/lrita/numa v1.0.2
 	github.com/wasilibs/go-re2 v1.5.1
 )
 
 require (
 	github.com/gopherjs/gopherjs v1.17.2 // indirect
-	github.com/intel-go/cpuid v0.0.0-20220614022739-219e067757cb // indirect
 	github.com/magefile/mage v1.15.0 // indirect
 	github.com/shopspring/decimal v1.4.0 // indirect
 	github.com/tetratelabs/wazero v1.7.0 // indirect
@@ -53,6 +53,13 @@ Copyright (C) 2023, 2024  Carl-Philip Hänsch
 )))
 
 (define sql_int (parser (define x (regex "-?[0-9]+")) (simplify x)))
+(define sql_interval (parser '((define n sql_int) (define unit (or
+	(parser (atom "SECOND" true) 1)
+	(parser (atom "MINUTE" true) 60)
+	(parser (atom "HOUR" true) 3600)
+	(parser (atom "DAY" true) 86400)
+	(parser (atom "WEEK" true) 604800)
+))) (* n unit))) /* interval in seconds */
 (define sql_number (parser (define x (regex "-?[0-9]+\.?[0-9]*(?:e-?[0-9]+)?" true)) (simplify x)))
 
 (define sql_string (parser (or
@@ -150,6 +157,8 @@ Copyright (C) 2023, 2024  Carl-Philip Hänsch
 		(parser '((atom "MAX" true) "(" (define s sql_expression) ")") '('aggregate s 'max nil))
 
 		(parser '((atom "DATABASE" true) "(" ")") schema)
+		(parser '((atom "LAST_INSERT_ID" true) "(" ")") '('coalesce '('session "$last_insert_id") 0))
+		(parser '((atom "LAST_INSERT_ID" true) "(" (define p sql_expression) ")") '('session "$last_insert_id" p))
 		(parser '((atom "PASSWORD" true) "(" (define p sql_expression) ")") '('password p))
 		(parser '((atom "UNIX_TIMESTAMP" true) "(" ")") '('now))
 		(parser '((atom "UNIX_TIMESTAMP" true) "(" (define p sql_expression) ")") '('parse_date p))
@@ -174,6 +183,7 @@ Copyright (C) 2023, 2024  Carl-Philip Hänsch
 		(parser (atom "FALSE" true) false)
 		(parser '((atom "@" true) (define var sql_identifier_unquoted)) '('session var))
 		(parser '((atom "@@" true) (define var sql_identifier_unquoted)) '('globalvars var))
+		(parser '((atom "?" true) (define i sql_int)) '('params i)) /* placeholder of a prepared statement */
 		sql_number
 		sql_string
 		sql_column
@@ -208,6 +218,12 @@ Copyright (C) 2023, 2024  Carl-Philip Hänsch
 	(define order nil)
 	(define limit nil)
 	(define offset nil)
+	/* index key part: a column or a functional key part (expr) over columns */
+	(define sql_index_key (parser (or
+		(parser '("(" (define expr sql_expression) ")") '((quote quote) (replace_stupid expr)))
+		sql_identifier
+	)))
+
 	(define sql_select (parser '(
 		(atom "SELECT" true)
 		(define cols (+ (or
@@ -281,19 +297,20 @@ Copyright (C) 2023, 2024  Carl-Philip Hänsch
 			(cons sym args) /* function call */ (cons sym (map args replace_find_column))
 			expr
 		)))
-		(set cols (map_assoc (merge cols) (lambda (col expr) (replace_find_column expr))))
-		(set condition (replace_find_column (coalesce condition true)))
-		(set filtercols (extract_columns_for_tblvar tbl condition))
-		(set scancols (merge_unique (extract_assoc cols (lambda (col expr) (extract_columns_for_tblvar tbl expr)))))
+		/* parser variables cannot be overwritten with set, so the resolved expressions get new names */
+		(define changes (map_assoc (merge cols) (lambda (col expr) (replace_find_column expr))))
+		(define filtercondition (replace_find_column (coalesce condition true)))
+		(set filtercols (extract_columns_for_tblvar tbl filtercondition))
+		(set scancols (merge_unique (extract_assoc changes (lambda (col expr) (extract_columns_for_tblvar tbl expr)))))
 		'((quote scan)
 			schema
 			tbl
 			(cons list filtercols)
-			'((quote lambda) (map filtercols (lambda(col) (symbol (concat tbl "." col)))) (replace_columns_from_expr condition))
+			'((quote lambda) (map filtercols (lambda(col) (symbol (concat tbl "." col)))) (replace_columns_from_expr filtercondition))
 			(cons list (cons "$update" scancols))
 			'((quote lambda)
 				(cons (quote $update) (map scancols (lambda (col) (symbol (concat tbl "." col)))))
-				'((quote if) '((quote $update) (cons (quote list) (map_assoc cols (lambda (col expr) (replace_columns_from_expr expr))))) 1 0)
+				'((quote if) '((quote $update) (cons (quote list) (map_assoc changes (lambda (col expr) (replace_columns_from_expr expr))))) 1 0)
 			)
 			(quote +)
 			0
@@ -315,15 +332,17 @@ Copyright (C) 2023, 2024  Carl-Philip Hänsch
 			(cons sym args) /* function call */ (cons sym (map args replace_find_column))
 			expr
 		)))
-		(set condition (replace_find_column (coalesce condition true)))
-		(set filtercols (extract_columns_for_tblvar tbl condition))
+		(define filtercondition (replace_find_column (coalesce condition true)))
+		(set filtercols (extract_columns_for_tblvar tbl filtercondition))
 		'((quote scan)
 			schema
 			tbl
 			(cons list filtercols)
-			'((quote lambda) (map filtercols (lambda(col) (symbol (concat tbl "." col)))) (replace_columns_from_expr condition))
+			'((quote lambda) (map filtercols (lambda(col) (symbol (concat tbl "." col)))) (replace_columns_from_expr filtercondition))
 			'(list "$update")
-			'((quote lambda) '((quote $update)) '((quote $update)))
+			'((quote lambda) '((quote $update)) '((quote if) '((quote $update)) 1 0))
+			(quote +)
+			0
 		)
 	)))
 
@@ -355,7 +374,7 @@ Copyright (C) 2023, 2024  Carl-Philip Hänsch
 		(set updaterows (if (nil? updaterows) nil (merge updaterows)))
 		(set updatecols (if (nil? updaterows) '() (cons "$update" (merge_unique (extract_assoc updaterows (lambda (k v) (extract_stupid v)))))))
 		(define coldesc (coalesce coldesc (map (show schema tbl) (lambda (col) (col "name")))))
-		'('insert schema tbl (cons list coldesc) (cons list (map datasets (lambda (dataset) (cons list dataset)))) (cons list updatecols) (if ignoreexists '('lambda () true) (if (nil? updaterows) nil '('lambda (map updatecols (lambda (c) (symbol c))) '('$update (cons 'list (map_assoc updaterows (lambda (k v) (replace_stupid v)))))))))
+		'('insert schema tbl (cons list coldesc) (cons list (map datasets (lambda (dataset) (cons list dataset)))) (cons list updatecols) (if ignoreexists '('lambda () true) (if (nil? updaterows) nil '('lambda (map updatecols (lambda (c) (symbol c))) '('$update (cons 'list (map_assoc updaterows (lambda (k v) (replace_stupid v)))))))) false '('lambda '('id) '('session "$last_insert_id" 'id)))
 	)))
 
 	(define sql_create_table (parser '(
@@ -369,7 +388,8 @@ Copyright (C) 2023, 2024  Carl-Philip Hänsch
 			(parser '((atom "UNIQUE" true) (atom "KEY" true) (define id sql_identifier) "(" (define cols (+ sql_identifier ",")) ")" (? (atom "USING" true) (atom "BTREE" true))) '((quote list) "unique" id (cons (quote list) cols)))
 			(parser '((atom "CONSTRAINT" true) (define id (? sql_identifier)) (atom "FOREIGN" true) (atom "KEY" true) "(" (define cols1 (+ sql_identifier ",")) ")" (atom "REFERENCES" true) (define tbl2 sql_identifier) "(" (define cols2 (+ sql_identifier ",")) ")" (? (atom "ON" true) (atom "DELETE" true) (or (atom "RESTRICT" true) (atom "CASCADE" true) (atom "SET NULL" true))) (? (atom "ON" true) (atom "UPDATE" true) (or (atom "RESTRICT" true) (atom "CASCADE" true) (atom "SET NULL" true)))) '((quote list) "foreign" id (cons (quote list) cols1) tbl2 (cons (quote list) cols2)))
 			(parser '((atom "FOREIGN" true) (atom "KEY" true) (define id (? sql_identifier)) "(" (define cols1 (+ sql_identifier ",")) ")" (atom "REFERENCES" true) (define tbl2 sql_identifier) "(" (define cols2 (+ sql_identifier ",")) ")" (? (atom "ON" true) (atom "DELETE" true) (or (atom "RESTRICT" true) (atom "CASCADE" true) (atom "SET NULL" true))) (? (atom "ON" true) (atom "UPDATE" true) (or (atom "RESTRICT" true) (atom "CASCADE" true) (atom "SET NULL" true)))) '((quote list) "foreign" id (cons (quote list) cols1) tbl2 (cons (quote list) cols2)))
-			(parser '((atom "KEY" true) sql_identifier "(" (+ sql_identifier ",") ")" (? (atom "USING" true) (atom "BTREE" true))) '((quote list))) /* ignore index definitions */
+			(parser '((or (atom "KEY" true) (atom "INDEX" true)) (define id sql_identifier) "(" (define cols (+ sql_index_key ",")) ")" (? (atom "USING" true) (atom "BTREE" true))) '((quote list) "index" id (cons (quote list) cols)))
+			(parser '((? (atom "CONSTRAINT" true) (define id (? sql_identifier))) (atom "CHECK" true) "(" (define expr sql_expression) ")") '((quote list) "check" (coalesce id "") (cons (quote list) (extract_stupid expr)) '((quote quote) (replace_stupid expr))))
 			(parser '(
 				(define col sql_identifier)
 				(define type sql_identifier)
@@ -378,7 +398,19 @@ Copyright (C) 2023, 2024  Carl-Philip Hänsch
 					(parser '("(" (define a sql_int) ")") '((quote list) a))
 					(parser empty '((quote list)))
 				))
-				(define typeparams (regex "[^,)]*")) /* TODO: rest */
+				(? (atom "GENERATED" true) (atom "ALWAYS" true)) (atom "AS" true) "(" (define expr sql_expression) ")"
+				(define mode (? (or (parser (atom "STORED" true) "STORED") (parser (atom "PERSISTENT" true) "STORED") (parser (atom "VIRTUAL" true) "VIRTUAL"))))
+				(define typeparams (regex "(?:'(?:\\\\.|''|[^'\\\\])*'|\\((?:[^()']|'[^']*')*\\)|[^,()'])*")) /* NOT NULL, DEFAULT, AUTO_INCREMENT and the rest; parsed by storage */
+			) '((quote list) "column" col type dimensions typeparams (cons (quote list) (extract_stupid expr)) '((quote quote) (replace_stupid expr)) (coalesce mode "VIRTUAL")))
+			(parser '(
+				(define col sql_identifier)
+				(define type sql_identifier)
+				(define dimensions (or
+					(parser '("(" (define a sql_int) "," (define b sql_int) ")") '((quote list) a b))
+					(parser '("(" (define a sql_int) ")") '((quote list) a))
+					(parser empty '((quote list)))
+				))
+				(define typeparams (regex "(?:'(?:\\\\.|''|[^'\\\\])*'|\\((?:[^()']|'[^']*')*\\)|[^,()'])*")) /* NOT NULL, DEFAULT, AUTO_INCREMENT and the rest; parsed by storage */
 			) '((quote list) "column" col type dimensions typeparams))
 		) ","))
 		")"
@@ -392,6 +424,8 @@ Copyright (C) 2023, 2024  Carl-Philip Hänsch
 			(parser '((atom "DEFAULT" true) (atom "CHARSET" false) "=" sql_identifier) '())
 			(parser '((atom "COLLATE" true) "=" (define collation (regex "[a-zA-Z0-9_]+"))) '("collation" collation))
 			(parser '((atom "AUTO_INCREMENT" true) "=" (define collation (regex "[0-9]+"))) '("auto_increment" collation))
+			(parser '((atom "PARTITION" true) (atom "BY" true) (atom "RANGE" true) "(" (define col sql_identifier) ")" (atom "INTERVAL" true) (define interval sql_interval) (atom "RETENTION" true) (define retention sql_interval)) '("partition_time" '((quote list) col interval retention)))
+			(parser '((atom "PARTITION" true) (atom "BY" true) (atom "RANGE" true) "(" (define col sql_identifier) ")" (atom "INTERVAL" true) (define interval sql_interval)) '("partition_time" '((quote list) col interval 0)))
 		)))
 	) '((quote createtable) schema id (cons (quote list) cols) (cons (quote list) (merge options)) ifnotexists)))
 
@@ -404,7 +438,20 @@ Copyright (C) 2023, 2024  Carl-Philip Hänsch
 			(parser '((atom "ADD" true) (atom "PRIMARY" true) (atom "KEY" true) "(" (define cols (+ sql_identifier ",")) ")") '((quote list) "unique" "PRIMARY" (cons (quote list) cols)))
 			(parser '((atom "ADD" true) (atom "UNIQUE" true) (atom "KEY" true) (define id sql_identifier) "(" (define cols (+ sql_identifier ",")) ")" (? (atom "USING" true) (atom "BTREE" true))) '((quote list) "unique" id (cons (quote list) cols)))
 			(parser '((atom "ADD" true) (atom "FOREIGN" true) (atom "KEY" true) (define id (? sql_identifier)) "(" (define cols1 (+ sql_identifier ",")) ")" (atom "REFERENCES" true) (define tbl2 sql_identifier) "(" (define cols2 (+ sql_identifier ",")) ")" (? (atom "ON" true) (atom "DELETE" true) (or (atom "RESTRICT" true) (atom "CASCADE" true) (atom "SET NULL" true))) (? (atom "ON" true) (atom "UPDATE" true) (or (atom "RESTRICT" true) (atom "CASCADE" true) (atom "SET NULL" true)))) '((quote list) "foreign" id (cons (quote list) cols1) tbl2 (cons (quote list) cols2))) */
-			(parser '((atom "ADD" true) (atom "KEY" true) sql_identifier "(" (+ sql_identifier ",") ")" (? (atom "USING" true) (atom "BTREE" true))) nil) /* ignore index definitions */
+			(parser '((atom "ADD" true) (or (atom "KEY" true) (atom "INDEX" true)) (define iid sql_identifier) "(" (define cols (+ sql_index_key ",")) ")" (? (atom "USING" true) (atom "BTREE" true))) (lambda (id) '((quote createindex) schema id iid (cons (quote list) cols))))
+			(parser '((atom "ADD" true) (? (atom "CONSTRAINT" true) (define cid (? sql_identifier))) (atom "CHECK" true) "(" (define expr sql_expression) ")") (lambda (id) '((quote altertable) schema id "check" '((quote list) (coalesce cid "") (cons (quote list) (extract_stupid expr)) '((quote quote) (replace_stupid expr))))))
+			(parser '((atom "ADD" true) (?(atom "COLUMN" true))
+				(define col sql_identifier)
+				(define type sql_identifier)
+				(define dimensions (or
+					(parser '("(" (define a sql_int) "," (define b sql_int) ")") '((quote list) a b))
+					(parser '("(" (define a sql_int) ")") '((quote list) a))
+					(parser empty '((quote list)))
+				))
+				(? (atom "GENERATED" true) (atom "ALWAYS" true)) (atom "AS" true) "(" (define expr sql_expression) ")"
+				(define mode (? (or (parser (atom "STORED" true) "STORED") (parser (atom "PERSISTENT" true) "STORED") (parser (atom "VIRTUAL" true) "VIRTUAL"))))
+				(define typeparams (regex "(?:'(?:\\\\.|''|[^'\\\\])*'|\\((?:[^()']|'[^']*')*\\)|[^,()'])*")) /* NOT NULL, DEFAULT, AUTO_INCREMENT and the rest; parsed by storage */
+			) (lambda (id) '((quote begin) '((quote createcolumn) schema id col type dimensions typeparams) '((quote altertable) schema id "generated" '((quote list) col (cons (quote list) (extract_stupid expr)) '((quote quote) (replace_stupid expr)) (coalesce mode "VIRTUAL"))))))
 			(parser '((atom "ADD" true) (?(atom "COLUMN" true))
 				(define col sql_identifier)
 				(define type sql_identifier)
@@ -413,9 +460,35 @@ Copyright (C) 2023, 2024  Carl-Philip Hänsch
 					(parser '("(" (define a sql_int) ")") '((quote list) a))
 					(parser empty '((quote list)))
 				))
-				(define typeparams (regex "[^,)]*")) /* TODO: rest */
+				(define typeparams (regex "(?:'(?:\\\\.|''|[^'\\\\])*'|\\((?:[^()']|'[^']*')*\\)|[^,()'])*")) /* NOT NULL, DEFAULT, AUTO_INCREMENT and the rest; parsed by storage */
 			) (lambda (id) '((quote createcolumn) schema id col type dimensions typeparams)))
+			(parser '((atom "DROP" true) (or (atom "CHECK" true) (atom "CONSTRAINT" true)) (define cid sql_identifier)) (lambda (id) '((quote altertable) schema id "dropcheck" cid)))
+			(parser '((atom "DROP" true) (or (atom "INDEX" true) (atom "KEY" true)) (define iid sql_identifier)) (lambda (id) '((quote dropindex) schema id iid)))
 			(parser '((atom "DROP" true) (? (atom "COLUMN" true)) (define col sql_identifier)) (lambda (id) '((quote altertable) schema id "drop" col)))
+			(parser '((atom "MODIFY" true) (? (atom "COLUMN" true))
+				(define col sql_identifier)
+				(define type sql_identifier)
+				(define dimensions (or
+					(parser '("(" (define a sql_int) "," (define b sql_int) ")") '((quote list) a b))
+					(parser '("(" (define a sql_int) ")") '((quote list) a))
+					(parser empty '((quote list)))
+				))
+				(define typeparams (regex "(?:'(?:\\\\.|''|[^'\\\\])*'|\\((?:[^()']|'[^']*')*\\)|[^,()'])*"))
+			) (lambda (id) '((quote altercolumn) schema id col col type dimensions typeparams)))
+			(parser '((atom "CHANGE" true) (? (atom "COLUMN" true))
+				(define col sql_identifier)
+				(define newcol sql_identifier)
+				(define type sql_identifier)
+				(define dimensions (or
+					(parser '("(" (define a sql_int) "," (define b sql_int) ")") '((quote list) a b))
+					(parser '("(" (define a sql_int) ")") '((quote list) a))
+					(parser empty '((quote list)))
+				))
+				(define typeparams (regex "(?:'(?:\\\\.|''|[^'\\\\])*'|\\((?:[^()']|'[^']*')*\\)|[^,()'])*"))
+			) (lambda (id) '((quote altercolumn) schema id col newcol type dimensions typeparams)))
+			(parser '((atom "RENAME" true) (atom "COLUMN" true) (define col sql_identifier) (atom "TO" true) (define newcol sql_identifier)) (lambda (id) '((quote altercolumn) schema id col newcol)))
+			(parser '((atom "RENAME" true) (? (or (atom "TO" true) (atom "AS" true))) (define newschema sql_identifier) (atom "." true) (define newid sql_identifier)) (lambda (id) '((quote renametable) schema id newschema newid)))
+			(parser '((atom "RENAME" true) (? (or (atom "TO" true) (atom "AS" true))) (define newid sql_identifier)) (lambda (id) '((quote renametable) schema id schema newid)))
 			(parser '((atom "ENGINE" true) "=" (atom "MEMORY" true)) (lambda (id) '((quote altertable) schema id "engine" "memory")))
 			(parser '((atom "ENGINE" true) "=" (atom "SLOPPY" true)) (lambda (id) '((quote altertable) schema id "engine" "sloppy")))
 			(parser '((atom "ENGINE" true) "=" (atom "LOGGING" true)) (lambda (id) '((quote altertable) schema id "engine" "logging")))
@@ -424,6 +497,8 @@ Copyright (C) 2023, 2024  Carl-Philip Hänsch
 			(parser '((atom "ENGINE" true) "=" (atom "InnoDB" true)) (lambda (id) '((quote altertable) schema id "engine" "safe")))
 			(parser '((atom "COLLATE" true) "=" (define collation (regex "[a-zA-Z0-9_]+"))) (lambda (id) '((quote altertable) schema id "collation" collation)))
 			(parser '((atom "AUTO_INCREMENT" true) "=" (define ai (regex "[0-9]+"))) (lambda (id) '((quote altertable) schema id "auto_increment" ai)))
+			(parser '((atom "PARTITION" true) (atom "BY" true) (atom "RANGE" true) "(" (define col sql_identifier) ")" (atom "INTERVAL" true) (define interval sql_interval) (atom "RETENTION" true) (define retention sql_interval)) (lambda (id) '((quote partitionbytime) schema id col interval retention)))
+			(parser '((atom "PARTITION" true) (atom "BY" true) (atom "RANGE" true) "(" (define col sql_identifier) ")" (atom "INTERVAL" true) (define interval sql_interval)) (lambda (id) '((quote partitionbytime) schema id col interval 0)))
 		) ","))
 	) (cons '!begin (map alters (lambda (alter) (alter id))))))
 
@@ -436,7 +511,9 @@ Copyright (C) 2023, 2024  Carl-Philip Hänsch
 		sql_update
 		sql_delete
 
-		(parser '((atom "CREATE" true) (atom "DATABASE" true) (define id sql_identifier)) '((quote createdatabase) id))
+		(parser '((atom "CREATE" true) (atom "DATABASE" true) (define id sql_identifier)) (if (strlike id ".%") (error "database names starting with . are reserved") '((quote createdatabase) id)))
+		(parser '((atom "CREATE" true) (atom "INDEX" true) (define ifnotexists (? (atom "IF" true) (atom "NOT" true) (atom "EXISTS" true))) (define iid sql_identifier) (atom "ON" true) (define id sql_identifier) "(" (define cols (+ sql_index_key ",")) ")" (? (atom "USING" true) (atom "BTREE" true))) '((quote createindex) schema id iid (cons (quote list) cols) (if ifnotexists true false)))
+		(parser '((atom "DROP" true) (atom "INDEX" true) (define ifexists (? (atom "IF" true) (atom "EXISTS" true))) (define iid sql_identifier) (atom "ON" true) (define id sql_identifier)) '((quote dropindex) schema id iid (if ifexists true false)))
 		(parser '((atom "CREATE" true) (atom "USER" true) (define username sql_identifier)
 			(? '((atom "IDENTIFIED" true) (atom "BY" true) (define password sql_expression))))
 			'('insert "system" "user" '('list "username" "password") '('list '('list username '('password password)))))
@@ -447,19 +524,45 @@ Copyright (C) 2023, 2024  Carl-Philip Hänsch
 		(parser '((atom "SHOW" true) (atom "DATABASES" true)) '((quote map) '((quote show)) '((quote lambda) '((quote schema)) '((quote resultrow) '((quote list) "Database" (quote schema))))))
 		(parser '((atom "SHOW" true) (atom "TABLES" true) (? (atom "FROM" true) (define schema sql_identifier))) '((quote map) '((quote show) schema) '((quote lambda) '((quote tbl)) '((quote resultrow) '((quote list) "Table" (quote tbl))))))
 		(parser '((atom "SHOW" true) (atom "TABLE" true) (atom "STATUS" true) (? (atom "FROM" true) (define schema sql_identifier) (? (atom "LIKE" true) (define likepattern sql_expression)))) '((quote map) '((quote show) schema) '((quote lambda) '((quote tbl)) '('if '('strlike 'tbl '('coalesce 'likepattern "%")) '((quote resultrow) '('list "name" 'tbl "rows" "1")))))) /* TODO: engine version row_format avg_row_length data_length max_data_length index_length data_free auto_increment create_time update_time check_time collation checksum create_options comment max_index_length temporary */
+		(parser '((atom "SHOW" true) (or (atom "INDEXES" true) (atom "INDEX" true) (atom "KEYS" true)) (or (atom "FROM" true) (atom "IN" true)) (define id sql_identifier) (? (or (atom "FROM" true) (atom "IN" true)) (define schema sql_identifier))) '((quote map) '((quote showindex) schema id) '((quote lambda) '((quote line)) '((quote resultrow) (quote line)))))
+		(parser '((atom "SHOW" true) (atom "CREATE" true) (atom "TABLE" true) (define target (or (parser '((define schema1 sql_identifier) (atom "." true) (define id1 sql_identifier)) '(schema1 id1)) (parser (define id1 sql_identifier) '(schema id1))))) '((quote resultrow) '((quote list) "Table" (car (cdr target)) "Create Table" '((quote showcreate) (car target) (car (cdr target))))))
 		(parser '((atom "DESCRIBE" true) (define id sql_identifier)) '((quote map) '((quote show) schema id) '((quote lambda) '((quote line)) '((quote resultrow) (quote line)))))
 
 		(parser '((atom "SHOW" true) (atom "VARIABLES" true)) '((quote map_assoc) '((quote list) "version" "0.9") '((quote lambda) '((quote key) (quote value)) '((quote resultrow) '((quote list) "Variable_name" (quote key) "Value" (quote value))))))
 		(parser '((atom "SET" true) (atom "NAMES" true) (define charset sql_expression)) (quote true)) /* ignore */
 
 
+		(parser '((atom "RENAME" true) (atom "TABLE" true) (define renames (+ (parser '(
+			(define from (or (parser '((define schema1 sql_identifier) (atom "." true) (define id1 sql_identifier)) '(schema1 id1)) (parser (define id1 sql_identifier) '(schema id1))))
+			(atom "TO" true)
+			(define to (or (parser '((define schema2 sql_identifier) (atom "." true) (define id2 sql_identifier)) '(schema2 id2)) (parser (define id2 sql_identifier) '(schema id2))))
+		) '((quote renametable) (car from) (car (cdr from)) (car to) (car (cdr to)))) ","))) (cons '!begin renames))
 		(parser '((atom "DROP" true) (atom "DATABASE" true) (define id sql_identifier)) '((quote dropdatabase) id))
 		(parser '((atom "DROP" true) (atom "TABLE" true) (define if_exists (? (atom "IF" true) (atom "EXISTS" true))) (define schema sql_identifier) (atom "." true) (define id sql_identifier)) '((quote droptable) schema id (if if_exists true false)))
 		(parser '((atom "DROP" true) (atom "TABLE" true) (define if_exists (? (atom "IF" true) (atom "EXISTS" true))) (define id sql_identifier)) '((quote droptable) schema id (if if_exists true false)))
 		(parser '((atom "SET" true) (? (atom "SESSION" true)) (define vars (* (parser '((? "@") (define key sql_identifier) "=" (define value sql_expression)) '((quote session) key value)) ","))) (cons '!begin vars))
 
+		(parser '((atom "LOAD" true) (atom "DATA" true) (? (or (atom "LOW_PRIORITY" true) (atom "CONCURRENT" true))) (? (atom "LOCAL" true)) (atom "INFILE" true) (define file sql_string)
+			(atom "INTO" true) (atom "TABLE" true) (define target (or (parser '((define schema1 sql_identifier) (atom "." true) (define id1 sql_identifier)) '(schema1 id1)) (parser (define id1 sql_identifier) '(schema id1))))
+			(? (atom "CHARACTER" true) (atom "SET" true) sql_identifier)
+			(? (or (atom "FIELDS" true) (atom "COLUMNS" true)) (define fieldopts (+ (or
+				(parser '((atom "TERMINATED" true) (atom "BY" true) (define x sql_string)) '("delimiter" x))
+				(parser '((? (atom "OPTIONALLY" true)) (atom "ENCLOSED" true) (atom "BY" true) (define x sql_string)) '("quote" x))
+				(parser '((atom "ESCAPED" true) (atom "BY" true) (define x sql_string)) '("escape" x))
+			))))
+			(? (atom "LINES" true) (? (atom "STARTING" true) (atom "BY" true) (define linestart sql_string)) (? (atom "TERMINATED" true) (atom "BY" true) (define lineterm sql_string)))
+			(? (atom "IGNORE" true) (define ignore sql_int) (or (atom "LINES" true) (atom "ROWS" true)))
+			(? "(" (define cols (+ (or sql_identifier (parser '("@" (define v sql_identifier)) (concat "@" v))) ",")) ")")
+		) '((quote loaddata) (car target) (car (cdr target)) file (cons (quote list) (merge
+			(merge (coalesce fieldopts '()))
+			(if (nil? linestart) '() (list "linestart" linestart))
+			(if (nil? lineterm) '() (list "lineterminator" lineterm))
+			(if (nil? ignore) '() (list "ignore" ignore))
+			(if (nil? cols) '() (list "columns" (cons (quote list) cols)))
+		))))
 		(parser '((atom "LOCK" true) (or (atom "TABLES" true) (atom "TABLE" true)) (+ (or sql_identifier '(sql_identifier (atom "AS" true) sql_identifier)) ",") (? (atom "READ" true)) (? (atom "LOCAL" true)) (? (atom "LOW_PRIORITY" true)) (? (atom "WRITE" true))) "ignore")
 		(parser '((atom "UNLOCK" true) (or (atom "TABLES" true) (atom "TABLE" true))) "ignore")
+		(parser '((atom "ALTER" true) (atom "TABLE" true) (? sql_identifier (atom "." true)) sql_identifier (or (atom "DISABLE" true) (atom "ENABLE" true)) (atom "KEYS" true)) "ignore") /* mysqldump; indexes are maintained anyway */
 		"" /* comment only command */
 		))) 
 	((parser (define command p) command "^(?:/\\*.*?\\*/|--[^\r\n]*[\r\n]|--[^\r\n]*$|[\r\n\t ]+)+") s)
@@ -468,7 +571,7 @@ Copyright (C) 2023, 2024  Carl-Philip Hänsch
 (define parse_sql_multi (lambda (schema s delimiter) (begin
 	/* TODO: DELIMITER commands, version-specific meta commands usw */
 	/* this implements a SQL preprocessor that separates multiple commands into an array and resolves SQL version macros */
-	/* TODO: work on big file streams: detect incomplete SQL queries and return them as rest, so the caller can append more lines and reparse */
+	/* big files are streamed with loadSQL instead */
 
 	/*(define parse_sql (lambda (schema s) '("SQL:" s)))*/
 	(define tailrecursiveparser (lambda (pre scan delimiter) (match scan
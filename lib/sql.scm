@@ -35,23 +35,40 @@ Copyright (C) 2023  Carl-Philip Hänsch
 /* http hook for handling SQL */
 (define http_handler (begin
 	(set old_handler http_handler)
-	(define handle_query (lambda (req res schema query) (begin
+	(define authorized (lambda (req) (begin
 		/* check for password */
 		(set pw (scan "system" "user" '("username") (lambda (username) (equal? username (req "username"))) '("password") (lambda (password) password) (lambda (a b) b) nil))
-		(if (and pw (equal? pw (password (req "password")))) (begin
-			((res "header") "Content-Type" "text/plain")
+		(and pw (equal? pw (password (req "password"))))
+	)))
+	(define unauthorized (lambda (res) (begin
+		((res "header") "Content-Type" "text/plain")
+		((res "header") "WWW-Authenticate" "Basic realm=\"authorization required\"")
+		((res "status") 401)
+		((res "print") "Unauthorized")
+	)))
+	(define handle_query (lambda (req res schema query) (begin
+		(if (authorized req) (begin
+			/* Apache Arrow IPC stream instead of JSON lines if the client asks for it */
+			(define arrow (strlike (coalesce ((req "header") "Accept") "") "%application/vnd.apache.arrow.stream%"))
+			((res "header") "Content-Type" (if arrow "application/vnd.apache.arrow.stream" "text/plain"))
 			((res "status") 200)
 			(print "SQL query: " query)
 			(define formula (parse_sql schema query))
-			(define resultrow (res "jsonl"))
+			(define resultrow (if arrow ((res "arrow")) (res "jsonl")))
 			(define session (context "session"))
 			(eval formula)
-		) (begin
-			((res "header") "Content-Type" "text/plain")
-			((res "header") "WWW-Authenticate" "Basic realm=\"authorization required\"")
-			((res "status") 401)
-			((res "print") "Unauthorized")
-		))
+		) (unauthorized res))
+	)))
+	(define handle_load (lambda (req res schema table) (begin
+		(if (authorized req) (begin
+			/* URL parameters are the loader options; flags like header=false become booleans */
+			(define options (map_assoc (req "query") (lambda (key value) (if (has? '("header" "createcolumns" "flatten") key) (not (has? '("false" "0" "") value)) value))))
+			(define format (if (strlike (coalesce ((req "header") "Content-Type") "") "%json%") "jsonl" "csv"))
+			(define result (loadStream schema table ((req "bodystream")) format options))
+			((res "header") "Content-Type" "application/json")
+			((res "status") 200)
+			((res "jsonl") result)
+		) (unauthorized res))
 	)))
 	old_handler old_handler /* workaround for optimizer bug */
 	(lambda (req res) (begin
@@ -65,6 +82,11 @@ Copyright (C) 2023  Carl-Philip Hänsch
 				(set query (urldecode query_un))
 				(handle_query req res schema query)
 			)
+			(regex "^/load/([^/]+)/([^/]+)$" url schema table) (if (equal? (req "method") "POST") (handle_load req res schema table) (begin
+				((res "header") "Allow" "POST")
+				((res "status") 405)
+				((res "print") "Method Not Allowed")
+			))
 			/* default */
 			(old_handler req res))
 	))
@@ -81,6 +103,14 @@ Copyright (C) 2023  Carl-Philip Hänsch
 			(define resultrow resultrow_sql)
 			(eval (source "SQL Query" 1 1 formula))
 		))
+		(lambda (schema sql) (begin /* prepare: parse once, execute with bound params */
+			(print "prepared query: " sql)
+			(define formula (parse_sql schema sql))
+			(lambda (resultrow_sql session params) (begin
+				(define resultrow resultrow_sql)
+				(eval (source "SQL Query" 1 1 formula))
+			))
+		))
 	)
 	(print "MySQL server listening on port 3307 (connect with `mysql -P 3307 -u root -p` using password 'admin')")
 )) print)
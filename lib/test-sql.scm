@@ -0,0 +1,114 @@
+/*
+Copyright (C) 2024  Carl-Philip Hänsch
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+/* SQL tests; they are not run on startup since they write to the data folder. Run them with
+   memcp -data <scratch folder> -c '(import "lib/test-sql.scm")'
+   They use the database .unittest: names starting with . can't be created over SQL, so no user data is touched. */
+
+(print "performing SQL tests ...")
+
+(teststat "count" 0)
+(teststat "success" 0)
+(if (has? (show) ".unittest") (dropdatabase ".unittest"))
+(createdatabase ".unittest")
+(define session (newsession))
+(define resultrow (lambda (row) (teststat "rows" (append (teststat "rows") row))))
+(define sql (lambda (query) (begin
+	(teststat "rows" '())
+	(eval (parse_sql ".unittest" query))
+	(teststat "rows")
+)))
+(define sqlfails (lambda (query) (try (lambda () (begin (sql query) false)) (lambda (e) true))))
+
+/* unique keys */
+(sql "CREATE TABLE uniq (id INT, email TEXT, PRIMARY KEY(id), UNIQUE KEY em (email))")
+(sql "INSERT INTO uniq (id, email) VALUES (1, 'a@example.com')")
+(assert (sqlfails "INSERT INTO uniq (id, email) VALUES (2, 'a@example.com')") true "duplicate unique key must be rejected")
+(assert (sqlfails "INSERT INTO uniq (id, email) VALUES (1, 'b@example.com')") true "duplicate primary key must be rejected")
+(assert (sql "SELECT COUNT(*) AS n FROM uniq") '('("n" 1)) "rejected rows must not be inserted")
+(assert (sqlfails "CREATE DATABASE `.reserved`") true "database names starting with . are reserved")
+
+/* type conversion */
+(sql "CREATE TABLE types (i INT, big BIGINT, d DATE)")
+(sql "INSERT INTO types (i, big, d) VALUES ('42', 9007199254740992, '2024-01-05')")
+(assert (sql "SELECT i, big, d FROM types") '('("i" 42 "big" 9007199254740992 "d" "2024-01-05")) "INT and DATE conversion")
+(assert (sql "SELECT COUNT(*) AS n FROM types WHERE d = '2024-01-05'") '('("n" 1)) "DATE compares with its string")
+(assert (sqlfails "INSERT INTO types (big) VALUES ('9007199254740993')") true "BIGINT that can't be stored exactly must be rejected")
+(assert (sqlfails "INSERT INTO types (big) VALUES (9007199254740993)") true "unquoted BIGINT that can't be stored exactly must be rejected")
+(assert (sqlfails "INSERT INTO types (d) VALUES ('2024-02-30')") true "impossible dates must be rejected")
+(sql "INSERT INTO types (i, d) VALUES (1, '20240115')")
+(assert (sql "SELECT d FROM types WHERE i = 1") '('("d" "2024-01-15")) "YYYYMMDD dates are parsed")
+
+/* expression indexes */
+(sql "CREATE TABLE exprindex (email TEXT)")
+(sql "CREATE INDEX le ON exprindex ((LOWER(email)))")
+(assert (sql "SHOW INDEX FROM exprindex") '('("Table" "exprindex" "Non_unique" 1 "Key_name" "le" "Seq_in_index" 1 "Column_name" nil "Index_type" "BTREE" "Comment" "built in 1 of 1 shards" "Expression" "LOWER(`email`)")) "SHOW INDEX puts expressions into the Expression column")
+
+/* GROUP BY over a GENERATED column */
+(sql "CREATE TABLE gen (a INT, b INT GENERATED ALWAYS AS (a * 2) VIRTUAL)")
+(sql "INSERT INTO gen (a) VALUES (1), (1), (2)")
+(assert (sql "SELECT b, COUNT(*) AS n FROM gen GROUP BY b ORDER BY b") '('("b" 2 "n" 2) '("b" 4 "n" 1)) "GROUP BY over a generated column")
+(assert (sqlfails "INSERT INTO gen (a, b) VALUES (3, 7)") true "explicit values for generated columns must be rejected")
+
+/* the CSV loader skips only the rows that fail (the import error below is expected) */
+(sql "CREATE TABLE csvimport (id INT, name TEXT, PRIMARY KEY(id))")
+(loadCSV ".unittest" "csvimport" (replace __FILE__ "test-sql.scm" "test-import.csv") ",")
+(assert (sql "SELECT id FROM csvimport ORDER BY id") '('("id" 1) '("id" 2) '("id" 3)) "CSV import skips the duplicate row")
+
+/* the JSON loader skips only the lines that fail (the import errors below are expected) */
+(sql "CREATE TABLE jsonimport (id INT, v TEXT, PRIMARY KEY(id))")
+(loadJSON ".unittest" (replace __FILE__ "test-sql.scm" "test-import.jsonl"))
+(assert (sql "SELECT id, v FROM jsonimport ORDER BY id") '('("id" 1 "v" "a") '("id" 2 "v" "b") '("id" 3 "v" "c")) "JSON import skips the bad lines")
+
+/* the SQLite loader skips only the rows that fail (the import errors below are expected) */
+(sql "CREATE TABLE sqliteimport (id INT, n BIGINT, u TEXT, PRIMARY KEY(id), UNIQUE KEY uu (u))")
+(loadSQLite ".unittest" (replace __FILE__ "test-sql.scm" "test-import.sqlite"))
+(assert (sql "SELECT id FROM sqliteimport ORDER BY id") '('("id" 1) '("id" 3)) "SQLite import skips the inexact BIGINT and the duplicate row")
+
+/* LAST_INSERT_ID */
+(sql "CREATE TABLE autoinc (id INT AUTO_INCREMENT, u TEXT, PRIMARY KEY(id), UNIQUE KEY uu (u))")
+(sql "INSERT INTO autoinc (u) VALUES ('x')")
+(assert (sql "SELECT LAST_INSERT_ID() AS id") '('("id" 1)) "LAST_INSERT_ID after INSERT")
+(sql "INSERT INTO autoinc (u) VALUES ('y'), ('z')")
+(assert (sql "SELECT LAST_INSERT_ID() AS id") '('("id" 2)) "LAST_INSERT_ID is the first id of a multi-row INSERT")
+(sqlfails "INSERT INTO autoinc (u) VALUES ('x')")
+(assert (sql "SELECT LAST_INSERT_ID() AS id") '('("id" 2)) "a rejected INSERT does not change LAST_INSERT_ID")
+
+/* renaming a table drops its GROUP BY caches, so a new table of the old name has no phantom groups */
+(sql "CREATE TABLE grouped (g INT)")
+(sql "INSERT INTO grouped VALUES (1), (2)")
+(sql "SELECT g, COUNT(*) AS n FROM grouped GROUP BY g")
+(sql "ALTER TABLE grouped RENAME TO grouped2")
+(sql "CREATE TABLE grouped (g INT)")
+(sql "INSERT INTO grouped VALUES (3)")
+(assert (sql "SELECT g, COUNT(*) AS n FROM grouped GROUP BY g") '('("g" 3 "n" 1)) "GROUP BY after RENAME TABLE only sees the new table")
+(assert (sql "SELECT g, COUNT(*) AS n FROM grouped2 GROUP BY g ORDER BY g") '('("g" 1 "n" 1) '("g" 2 "n" 1)) "GROUP BY on the renamed table")
+
+/* AUTO_INCREMENT counter */
+(sql "CREATE TABLE autoinc2 (id INT AUTO_INCREMENT, PRIMARY KEY(id))")
+(sql "INSERT INTO autoinc2 VALUES (NULL), (NULL)")
+(assert (strlike (car (cdr (cdr (cdr (car (sql "SHOW CREATE TABLE autoinc2"))))))  "%AUTO_INCREMENT=3 %") true "SHOW CREATE TABLE reports the next id, not the reserved range")
+(sql "INSERT INTO autoinc2 VALUES (10)")
+(sql "INSERT INTO autoinc2 VALUES (NULL)")
+(assert (sql "SELECT MAX(id) AS id FROM autoinc2") '('("id" 11)) "generated ids continue behind an explicit id")
+
+(dropdatabase ".unittest")
+
+(print "finished SQL tests")
+(print "SQL test result: " (teststat "success") "/" (teststat "count"))
+(if (< (teststat "success") (teststat "count")) (print "---- !!! some SQL test cases have failed !!! ----") (print "all SQL tests succeeded."))
+(print "")
@@ -259,12 +259,13 @@ func setupIO(wd string) {
 	})
 	scm.Declare(&IOEnv, &scm.Declaration{
 		"mysql", "Imports a file .scm file into current namespace",
-		4, 4,
+		4, 5,
 		[]scm.DeclarationParameter{
 			scm.DeclarationParameter{"port", "number", "port number for MySQL server"},
 			scm.DeclarationParameter{"getPassword", "func", "lambda(username string) string|nil has to return the password for a user or nil to deny login"},
 			scm.DeclarationParameter{"schemacallback", "func", "lambda(username schema) bool handler check whether user is allowed to schem (string) - you should check access rights here"},
 			scm.DeclarationParameter{"handler", "func", "lambda(schema sql resultrow session) handler to process sql query (string) in schema (string). resultrow is a lambda(list)"},
+			scm.DeclarationParameter{"preparecallback", "func", "(optional) lambda(schema sql) for prepared statements: parses sql (placeholders are numbered ?1, ?2, ...) once per session and returns a lambda(resultrow session params) that executes it; (params i) returns the i-th bound value"},
 		}, "bool",
 		scm.MySQLServe,
 	})
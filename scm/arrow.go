@@ -0,0 +1,446 @@
+/*
+Copyright (C) 2024  Carl-Philip Hänsch
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package scm
+
+import "io"
+import "sync"
+import "math"
+import "strconv"
+import "encoding/binary"
+
+/*
+
+Apache Arrow IPC streaming format:
+ - ArrowWriter collects resultrow calls (assoc lists) and writes them as record batches
+ - the stream is: schema message, record batch messages, end-of-stream marker
+ - a message is 0xFFFFFFFF, the length of the flatbuffer metadata (padded to 8 bytes), the metadata and the body
+ - the column types are inferred from the first batch: only numbers give Float64, only bools give Bool,
+   everything else gives Utf8; later values are converted to that type
+ - the schema is held back while a column has only NULLs (up to arrowMaxSchemaRows rows), so leading NULLs
+   don't decide the type; a column that stays NULL becomes Utf8
+ - a later value that doesn't fit the type of its column (e.g. a string in a Float64 column) fails the
+   stream with a panic instead of being sent as null; the end-of-stream marker is not written then
+ - columns are named by the keys of the rows before the schema; keys that only appear later are dropped
+ - the flatbuffers are built by fbBuilder, a minimal back-to-front builder like the one of the flatbuffers library
+
+*/
+
+const arrowBatchSize = 65536
+const arrowMaxSchemaRows = 16 * arrowBatchSize // rows that are buffered at most to find the type of NULL columns
+
+const (
+	arrowFloat64 = iota
+	arrowUtf8
+	arrowBool
+)
+
+type ArrowWriter struct {
+	w io.Writer
+	mu sync.Mutex
+	names []string
+	colmap map[string]int
+	types []int // nil until the schema is written
+	rows [][]Scmer
+}
+
+func NewArrowWriter(w io.Writer) *ArrowWriter {
+	return &ArrowWriter{w, sync.Mutex{}, nil, make(map[string]int), nil, nil}
+}
+
+// adds a row in assoc list form (key value key value ...)
+func (a *ArrowWriter) Row(dict []Scmer) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	row := make([]Scmer, len(a.names))
+	for i := 0; i + 1 < len(dict); i += 2 {
+		key := String(dict[i])
+		col, ok := a.colmap[key]
+		if !ok {
+			if a.types != nil {
+				continue // schema is already written
+			}
+			col = len(a.names)
+			a.colmap[key] = col
+			a.names = append(a.names, key)
+		}
+		for len(row) <= col {
+			row = append(row, nil)
+		}
+		row[col] = dict[i+1]
+	}
+	a.rows = append(a.rows, row)
+	if len(a.rows) % arrowBatchSize == 0 {
+		a.flush(false)
+	}
+}
+
+// writes the pending rows and the end-of-stream marker
+func (a *ArrowWriter) Close() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.rows) > 0 || a.types == nil {
+		a.flush(true)
+	}
+	a.w.Write([]byte{0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0})
+}
+
+// writes the pending rows; final is set when no more rows follow
+func (a *ArrowWriter) flush(final bool) {
+	if a.types == nil {
+		types := make([]int, len(a.names))
+		untyped := false
+		for col := range a.names {
+			var ok bool
+			types[col], ok = a.inferType(col)
+			untyped = untyped || !ok
+		}
+		if untyped && !final && len(a.rows) < arrowMaxSchemaRows {
+			return // wait for the first value of the NULL columns
+		}
+		a.types = types
+		a.writeMessage(1, a.schema(), nil)
+	}
+	if len(a.rows) == 0 {
+		return
+	}
+	header, body := a.recordBatch()
+	a.writeMessage(3, header, body)
+	a.rows = a.rows[:0]
+}
+
+// returns the type of a column and false if the column has only NULLs so far
+func (a *ArrowWriter) inferType(col int) (int, bool) {
+	numbers, bools, others := 0, 0, 0
+	for _, row := range a.rows {
+		if col >= len(row) {
+			continue
+		}
+		switch row[col].(type) {
+			case nil:
+			case float64, int, int64:
+				numbers++
+			case bool:
+				bools++
+			default:
+				others++
+		}
+	}
+	if others == 0 && bools == 0 && numbers > 0 {
+		return arrowFloat64, true
+	}
+	if others == 0 && numbers == 0 && bools > 0 {
+		return arrowBool, true
+	}
+	return arrowUtf8, numbers + bools + others > 0
+}
+
+func (a *ArrowWriter) typeMismatch(col int, v Scmer) {
+	panic("arrow stream: value " + String(v) + " of column " + a.names[col] + " does not fit the column type that was inferred from the first rows")
+}
+
+// builds the Message table with the given header (1 = Schema, 3 = RecordBatch) and writes it with its body
+func (a *ArrowWriter) writeMessage(headerType byte, header func(*fbBuilder) uint32, body []byte) {
+	b := new(fbBuilder)
+	h := header(b)
+	b.startTable(4)
+	b.addInt64(3, int64(len(body))) // bodyLength
+	b.addOffset(2, h) // header
+	b.addInt16(0, 4) // version V5
+	b.addUint8(1, headerType)
+	metadata := b.finish(b.endTable())
+	padding := (8 - (len(metadata) + 8) % 8) % 8
+	prefix := make([]byte, 8)
+	binary.LittleEndian.PutUint32(prefix, 0xffffffff)
+	binary.LittleEndian.PutUint32(prefix[4:], uint32(len(metadata) + padding))
+	a.w.Write(prefix)
+	a.w.Write(metadata)
+	a.w.Write(make([]byte, padding))
+	a.w.Write(body)
+}
+
+func (a *ArrowWriter) schema() func(*fbBuilder) uint32 {
+	return func (b *fbBuilder) uint32 {
+		fields := make([]uint32, len(a.names))
+		for col, name := range a.names {
+			nameOffset := b.createString(name)
+			if a.types[col] == arrowFloat64 {
+				b.startTable(1)
+				b.addInt16(0, 2) // precision DOUBLE
+			} else {
+				b.startTable(0)
+			}
+			typeOffset := b.endTable()
+			b.startVector(4, 0, 4)
+			children := b.endVector(0)
+			b.startTable(6)
+			b.addOffset(5, children)
+			b.addOffset(3, typeOffset)
+			b.addOffset(0, nameOffset)
+			b.addUint8(2, [...]byte{3, 5, 6}[a.types[col]]) // FloatingPoint, Utf8, Bool
+			b.addBool(1, true) // nullable
+			fields[col] = b.endTable()
+		}
+		b.startVector(4, len(fields), 4)
+		for i := len(fields) - 1; i >= 0; i-- {
+			b.prependUOffset(fields[i])
+		}
+		fieldsOffset := b.endVector(len(fields))
+		b.startTable(2)
+		b.addOffset(1, fieldsOffset)
+		return b.endTable() // endianness Little is the default
+	}
+}
+
+// converts the pending rows into the buffers of a record batch
+func (a *ArrowWriter) recordBatch() (func(*fbBuilder) uint32, []byte) {
+	n := len(a.rows)
+	var body []byte
+	var buffers [][2]int64
+	addBuffer := func (data []byte) {
+		buffers = append(buffers, [2]int64{int64(len(body)), int64(len(data))})
+		body = append(body, data...)
+		for len(body) % 8 != 0 {
+			body = append(body, 0)
+		}
+	}
+	nodes := make([][2]int64, len(a.names))
+	for col, typ := range a.types {
+		validity := make([]byte, (n + 7) / 8)
+		nulls := 0
+		var values []byte
+		var offsets []byte
+		var data []byte
+		switch typ {
+			case arrowFloat64:
+				values = make([]byte, 8 * n)
+			case arrowBool:
+				values = make([]byte, (n + 7) / 8)
+			case arrowUtf8:
+				offsets = make([]byte, 4 * (n + 1))
+		}
+		for i, row := range a.rows {
+			var v Scmer
+			if col < len(row) {
+				v = row[col]
+			}
+			valid := v != nil
+			switch typ {
+				case arrowFloat64:
+					var f float64
+					switch x := v.(type) {
+						case float64:
+							f = x
+						case int:
+							f = float64(x)
+						case int64:
+							f = float64(x)
+						case bool:
+							f = float64(ToInt(x))
+						case nil:
+						default:
+							var err error
+							f, err = strconv.ParseFloat(String(x), 64)
+							if err != nil {
+								a.typeMismatch(col, v)
+							}
+					}
+					binary.LittleEndian.PutUint64(values[8*i:], math.Float64bits(f))
+				case arrowBool:
+					switch x := v.(type) {
+						case bool:
+							if x {
+								values[i / 8] |= 1 << (i % 8)
+							}
+						case nil:
+						default:
+							a.typeMismatch(col, v)
+					}
+				case arrowUtf8:
+					if valid {
+						switch x := v.(type) {
+							case string:
+								data = append(data, x...)
+							case LazyString:
+								data = append(data, x.GetValue()...)
+							default:
+								data = append(data, String(x)...)
+						}
+					}
+					binary.LittleEndian.PutUint32(offsets[4*(i+1):], uint32(len(data)))
+			}
+			if valid {
+				validity[i / 8] |= 1 << (i % 8)
+			} else {
+				nulls++
+			}
+		}
+		nodes[col] = [2]int64{int64(n), int64(nulls)}
+		addBuffer(validity)
+		if typ == arrowUtf8 {
+			addBuffer(offsets)
+			addBuffer(data)
+		} else {
+			addBuffer(values)
+		}
+	}
+	return func (b *fbBuilder) uint32 {
+		b.startVector(16, len(buffers), 8)
+		for i := len(buffers) - 1; i >= 0; i-- {
+			b.prependStruct(buffers[i][0], buffers[i][1])
+		}
+		buffersOffset := b.endVector(len(buffers))
+		b.startVector(16, len(nodes), 8)
+		for i := len(nodes) - 1; i >= 0; i-- {
+			b.prependStruct(nodes[i][0], nodes[i][1])
+		}
+		nodesOffset := b.endVector(len(nodes))
+		b.startTable(3)
+		b.addInt64(0, int64(n)) // length
+		b.addOffset(1, nodesOffset)
+		b.addOffset(2, buffersOffset)
+		return b.endTable()
+	}, body
+}
+
+// minimal flatbuffers builder: the buffer grows to the front, offsets count from the end of the buffer
+type fbBuilder struct {
+	buf []byte
+	minalign int
+	vtable []uint32 // positions of the fields of the current table
+	objectEnd uint32
+}
+
+func (b *fbBuilder) offset() uint32 {
+	return uint32(len(b.buf))
+}
+
+func (b *fbBuilder) prepend(data ...byte) {
+	b.buf = append(append(make([]byte, 0, len(data) + len(b.buf)), data...), b.buf...)
+}
+
+// pads so that after writing additional bytes, the buffer is aligned to size
+func (b *fbBuilder) prep(size, additional int) {
+	if size > b.minalign {
+		b.minalign = size
+	}
+	padding := (size - (len(b.buf) + additional) % size) % size
+	b.prepend(make([]byte, padding)...)
+}
+
+func (b *fbBuilder) putUint16(v uint16) {
+	b.prep(2, 0)
+	b.prepend(byte(v), byte(v >> 8))
+}
+
+func (b *fbBuilder) putUint32(v uint32) {
+	b.prep(4, 0)
+	b.prepend(binary.LittleEndian.AppendUint32(nil, v)...)
+}
+
+func (b *fbBuilder) putUint64(v uint64) {
+	b.prep(8, 0)
+	b.prepend(binary.LittleEndian.AppendUint64(nil, v)...)
+}
+
+func (b *fbBuilder) prependUOffset(off uint32) {
+	b.prep(4, 0)
+	b.putUint32(b.offset() - off + 4)
+}
+
+// struct of two longs (FieldNode, Buffer)
+func (b *fbBuilder) prependStruct(first, second int64) {
+	b.prep(8, 16)
+	b.putUint64(uint64(second))
+	b.putUint64(uint64(first))
+}
+
+func (b *fbBuilder) createString(s string) uint32 {
+	b.prep(4, len(s) + 1)
+	b.prepend(0)
+	b.prepend([]byte(s)...)
+	b.putUint32(uint32(len(s)))
+	return b.offset()
+}
+
+func (b *fbBuilder) startVector(elemSize, count, alignment int) {
+	b.prep(4, elemSize * count)
+	b.prep(alignment, elemSize * count)
+}
+
+func (b *fbBuilder) endVector(count int) uint32 {
+	b.putUint32(uint32(count))
+	return b.offset()
+}
+
+func (b *fbBuilder) startTable(fields int) {
+	b.vtable = make([]uint32, fields)
+	b.objectEnd = b.offset()
+}
+
+func (b *fbBuilder) addUint8(slot int, v byte) {
+	b.prepend(v)
+	b.vtable[slot] = b.offset()
+}
+
+func (b *fbBuilder) addBool(slot int, v bool) {
+	if v {
+		b.addUint8(slot, 1)
+	} else {
+		b.addUint8(slot, 0)
+	}
+}
+
+func (b *fbBuilder) addInt16(slot int, v int16) {
+	b.putUint16(uint16(v))
+	b.vtable[slot] = b.offset()
+}
+
+func (b *fbBuilder) addInt64(slot int, v int64) {
+	b.putUint64(uint64(v))
+	b.vtable[slot] = b.offset()
+}
+
+func (b *fbBuilder) addOffset(slot int, off uint32) {
+	b.prependUOffset(off)
+	b.vtable[slot] = b.offset()
+}
+
+// writes the vtable in front of the table and returns the table's offset
+func (b *fbBuilder) endTable() uint32 {
+	b.putUint32(0) // placeholder for the vtable offset
+	object := b.offset()
+	for i := len(b.vtable) - 1; i >= 0; i-- {
+		if b.vtable[i] == 0 {
+			b.putUint16(0)
+		} else {
+			b.putUint16(uint16(object - b.vtable[i]))
+		}
+	}
+	b.putUint16(uint16(object - b.objectEnd))
+	b.putUint16(uint16(2 * (len(b.vtable) + 2)))
+	vtable := b.offset()
+	binary.LittleEndian.PutUint32(b.buf[len(b.buf) - int(object):], vtable - object)
+	b.vtable = nil
+	return object
+}
+
+// writes the root offset and returns the finished buffer
+func (b *fbBuilder) finish(root uint32) []byte {
+	b.prep(b.minalign, 4)
+	b.prependUOffset(root)
+	return b.buf
+}
@@ -17,20 +17,46 @@ Copyright (C) 2024  Carl-Philip Hänsch
 package scm
 
 import "time"
+import "strings"
+
+var allowed_formats = []string{
+	"2006-01-02 15:04:05.000000",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+	"06-01-02 15:04:05.000000",
+	"06-01-02 15:04:05",
+	"06-01-02 15:04",
+	"06-01-02",
+	"20060102150405",
+	"20060102",
+}
+
+// parses a date string into a unix timestamp
+func ParseDate(s string) (float64, bool) {
+	for _, format := range allowed_formats { // try through all formats
+		if t, err := time.Parse(format, s); err == nil {
+			return float64(t.Unix()), true
+		}
+	}
+	return 0, false
+}
+
+// reports whether a string is written like a date but names a day or time that does not exist (e.g. 2024-02-30)
+func DateOutOfRange(s string) bool {
+	for _, format := range allowed_formats {
+		if _, err := time.Parse(format, s); err != nil {
+			if perr, ok := err.(*time.ParseError); ok && strings.HasSuffix(perr.Message, "out of range") {
+				return true
+			}
+		}
+	}
+	return false
+}
 
 func init_date() {
 	// string functions
 	DeclareTitle("Date")
-	allowed_formats := []string{
-		"2006-01-02 15:04:05.000000",
-		"2006-01-02 15:04:05",
-		"2006-01-02 15:04",
-		"2006-01-02",
-		"06-01-02 15:04:05.000000",
-		"06-01-02 15:04:05",
-		"06-01-02 15:04",
-		"06-01-02",
-	}
 
 
 	Declare(&Globalenv, &Declaration{
@@ -49,10 +75,8 @@ func init_date() {
 			DeclarationParameter{"value", "string", "values to parse"},
 		}, "number",
 		func(a ...Scmer) Scmer {
-			for _, format := range allowed_formats { // try through all formats
-				if t, err := time.Parse(format, String(a[0])); err != nil {
-					return float64(t.Unix())
-				}
+			if t, ok := ParseDate(String(a[0])); ok {
+				return t
 			}
 			return nil
 		},
@@ -20,8 +20,10 @@ package scm
 import "fmt"
 import "sync"
 import "errors"
+import "strings"
 import "runtime"
 import "runtime/debug"
+import "sync/atomic"
 import "github.com/launix-de/go-mysqlstack/driver"
 import "github.com/launix-de/go-mysqlstack/xlog"
 import "github.com/launix-de/go-mysqlstack/sqlparser/depends/sqltypes"
@@ -29,7 +31,7 @@ import querypb "github.com/launix-de/go-mysqlstack/sqlparser/depends/query"
 
 // build this function into your SCM environment to offer http server capabilities
 func MySQLServe(a ...Scmer) Scmer {
-	// params: port, authcallback, schemacallback, querycallback
+	// params: port, authcallback, schemacallback, querycallback, [preparecallback]
 	port := String(a[0])
 
 	log := xlog.NewStdLog(xlog.Level(xlog.INFO))
@@ -38,6 +40,9 @@ func MySQLServe(a ...Scmer) Scmer {
 	handler.authcallback = a[1]
 	handler.schemacallback = a[2]
 	handler.querycallback = a[3]
+	if len(a) > 4 {
+		handler.preparecallback = a[4]
+	}
 
 	mysql, err := driver.NewListener(log, fmt.Sprintf(":%v", port), &handler)
 	if err != nil {
@@ -60,11 +65,176 @@ type MySQLWrapper struct {
 	authcallback Scmer
 	schemacallback Scmer
 	querycallback Scmer
+	preparecallback Scmer
 }
 
 /* session storage -> map from session id to SCM session object */
 var mysqlsessions sync.Map
 
+/*
+
+prepared statements:
+ - go-mysqlstack answers COM_STMT_PREPARE itself and calls ComQuery with the bind variables v1..vN on
+   COM_STMT_EXECUTE; the rows are sent in the binary protocol
+ - the ? placeholders are numbered (?1, ?2, ...) and the statement is passed to preparecallback once per
+   session; it returns a lambda(resultrow session params) that executes the parsed statement
+ - the lambdas are cached per session by schema and statement text; (params i) returns the i-th bound value
+ - the storage counts SchemaVersion up on every schema change; the cache of a session is dropped when
+   the version has changed, so no plan outlives the tables and columns it was parsed against
+
+*/
+type mysqlStatements struct {
+	mu sync.Mutex
+	version uint64 // SchemaVersion the plans were prepared for
+	plans map[string]Scmer
+}
+
+// counted up by the storage whenever a schema changes; invalidates the prepared statements
+var SchemaVersion atomic.Uint64
+
+/* prepared statement cache -> map from session id to *mysqlStatements */
+var mysqlprepared sync.Map
+
+// the cache is cleared when a session prepares more distinct statements than this
+const mysqlMaxPrepared = 1024
+
+// numbers the ? placeholders outside of strings, quoted identifiers and comments: ?1, ?2, ...
+func numberPlaceholders(query string) string {
+	var b strings.Builder
+	n := 0
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+			case c == '\'' || c == '"' || c == '`':
+				j := i + 1
+				for j < len(query) && query[j] != c {
+					if query[j] == '\\' && c != '`' {
+						j++
+					}
+					j++
+				}
+				if j >= len(query) {
+					j = len(query) - 1
+				}
+				b.WriteString(query[i:j+1])
+				i = j
+			case c == '#' || c == '-' && strings.HasPrefix(query[i:], "-- "):
+				j := strings.IndexByte(query[i:], '\n')
+				if j < 0 {
+					j = len(query) - i - 1
+				}
+				b.WriteString(query[i:i+j+1])
+				i += j
+			case c == '/' && strings.HasPrefix(query[i:], "/*"):
+				j := strings.Index(query[i+2:], "*/")
+				if j < 0 {
+					j = len(query) - i - 4
+				}
+				b.WriteString(query[i:i+j+4])
+				i += j + 3
+			case c == '?':
+				n++
+				fmt.Fprintf(&b, "?%d", n)
+			default:
+				b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// converts a bound parameter of COM_STMT_EXECUTE
+func mysqlParam(bv *querypb.BindVariable) Scmer {
+	v := sqltypes.MakeTrusted(bv.Type, bv.Value)
+	if v.IsNull() {
+		return nil
+	}
+	if v.IsIntegral() {
+		return Simplify(string(bv.Value)) // integers beyond 2^53 keep their digits like SQL literals, so typed columns can reject them
+	}
+	if v.IsFloat() || bv.Type == querypb.Type_DECIMAL {
+		if f, err := v.ParseFloat64(); err == nil {
+			return f
+		}
+	}
+	return string(bv.Value)
+}
+
+// returns the cached executor of a prepared statement or prepares it
+func (m *MySQLWrapper) prepared(session *driver.Session, query string) Scmer {
+	cache, _ := mysqlprepared.LoadOrStore(session.ID(), &mysqlStatements{plans: make(map[string]Scmer)})
+	statements := cache.(*mysqlStatements)
+	key := session.Schema() + "\x00" + query
+	version := SchemaVersion.Load()
+	statements.mu.Lock()
+	if statements.version != version {
+		statements.plans = make(map[string]Scmer) // DDL happened: prepare everything again
+		statements.version = version
+	}
+	plan, ok := statements.plans[key]
+	statements.mu.Unlock()
+	if !ok {
+		plan = Apply(m.preparecallback, session.Schema(), numberPlaceholders(query))
+		statements.mu.Lock()
+		if len(statements.plans) >= mysqlMaxPrepared {
+			statements.plans = make(map[string]Scmer)
+		}
+		if statements.version == version && SchemaVersion.Load() == version { // don't cache a plan that raced with DDL
+			statements.plans[key] = plan
+		}
+		statements.mu.Unlock()
+	}
+	return plan
+}
+
+// the binary protocol encodes each value by the type of its column: type the columns by all rows, fill short rows and convert values
+func conformBinaryResult(result *sqltypes.Result) {
+	for i, f := range result.Fields {
+		typ := querypb.Type_NULL_TYPE
+		for _, row := range result.Rows {
+			if i >= len(row) || row[i].IsNull() {
+				continue
+			}
+			vtyp := row[i].Type()
+			if vtyp == querypb.Type_INT32 {
+				vtyp = querypb.Type_INT64 // booleans
+			}
+			if typ == querypb.Type_NULL_TYPE || typ == vtyp {
+				typ = vtyp
+			} else if (typ == querypb.Type_INT64 || typ == querypb.Type_FLOAT64) && (vtyp == querypb.Type_INT64 || vtyp == querypb.Type_FLOAT64) {
+				typ = querypb.Type_FLOAT64
+			} else {
+				typ = querypb.Type_VARCHAR // mixed numbers and strings are sent as text
+			}
+		}
+		if typ == querypb.Type_NULL_TYPE {
+			typ = querypb.Type_VARCHAR // only NULLs
+		}
+		f.Type = typ
+	}
+	for r, row := range result.Rows {
+		for len(row) < len(result.Fields) {
+			row = append(row, sqltypes.NULL)
+		}
+		for i, v := range row {
+			typ := result.Fields[i].Type
+			if v.IsNull() || v.Type() == typ {
+				continue
+			}
+			switch typ {
+				case querypb.Type_FLOAT64:
+					f, _ := v.ParseFloat64() // the column only holds numbers
+					row[i] = sqltypes.NewFloat64(f)
+				case querypb.Type_INT64:
+					n, _ := v.ParseInt64()
+					row[i] = sqltypes.NewInt64(n)
+				default:
+					row[i] = sqltypes.MakeTrusted(typ, v.Raw())
+			}
+		}
+		result.Rows[r] = row
+	}
+}
+
 func (m *MySQLWrapper) ServerVersion() string {
 	return "MemCP"
 }
@@ -84,6 +254,7 @@ func (m *MySQLWrapper) SessionDec(session *driver.Session) {
 func (m *MySQLWrapper) SessionClosed(session *driver.Session) {
 	m.log.Info("Closed Session " + session.User() + " from " + session.Addr())
 	mysqlsessions.Delete(session.ID())
+	mysqlprepared.Delete(session.ID())
 }
 func (m *MySQLWrapper) SessionCheck(session *driver.Session) error {
 	// we could reject clients here when server load is too full
@@ -143,6 +314,15 @@ func (m *MySQLWrapper) ComQuery(session *driver.Session, query string, bindVaria
 		})
 		return nil
 	}
+	binary := bindVariables != nil && m.preparecallback != nil
+	if binary {
+		// COM_STMT_EXECUTE: rows go out in the binary protocol; they are sent at once, so the column types are known from all rows
+		send := callback
+		callback = func (result *sqltypes.Result) error {
+			conformBinaryResult(result)
+			return send(result)
+		}
+	}
 	colmap := make(map[string]int)
 	// TODO: sqltypes.RStateNone for INSERTs
 	var result sqltypes.Result
@@ -151,6 +331,17 @@ func (m *MySQLWrapper) ComQuery(session *driver.Session, query string, bindVaria
 	result.Rows = make([][]sqltypes.Value, 0, 1024)
 	// load scm session object
 	scmSession, _ := mysqlsessions.Load(session.ID())
+	var insertId Scmer // the id that INSERT or LAST_INSERT_ID(expr) of this statement wrote to the session
+	if sess, ok := scmSession.(func(...Scmer) Scmer); ok {
+		scmSession = func (a ...Scmer) Scmer {
+			if len(a) == 2 && String(a[0]) == "$last_insert_id" {
+				resultlock.Lock()
+				insertId = a[1]
+				resultlock.Unlock()
+			}
+			return sess(a...)
+		}
+	}
 	// result from scheme
 	rowcount := func () Scmer {
 		defer func () {
@@ -159,7 +350,7 @@ func (m *MySQLWrapper) ComQuery(session *driver.Session, query string, bindVaria
 				debug.PrintStack()
 			}
 		}()
-		return Apply(m.querycallback, session.Schema(), query, func (a... Scmer) Scmer {
+		resultrow := func (a... Scmer) Scmer {
 			// function resultrow(item)
 			item := a[0].([]Scmer)
 			resultlock.Lock()
@@ -186,7 +377,7 @@ func (m *MySQLWrapper) ComQuery(session *driver.Session, query string, bindVaria
 					newitem = append(newitem, val)
 				}
 			}
-			if len(result.Rows) == cap(result.Rows) {
+			if len(result.Rows) == cap(result.Rows) && !binary {
 				// flush
 				callback(&result)
 				if result.State == sqltypes.RStateFields {
@@ -197,17 +388,35 @@ func (m *MySQLWrapper) ComQuery(session *driver.Session, query string, bindVaria
 			}
 			result.Rows = append(result.Rows, newitem)
 			return true
-		},
-		scmSession)
+		}
+		if binary {
+			// prepared statement: bind v1..vN
+			params := make([]Scmer, len(bindVariables))
+			for i := range params {
+				if bv, ok := bindVariables[fmt.Sprintf("v%d", i+1)]; ok {
+					params[i] = mysqlParam(bv)
+				}
+			}
+			return Apply(m.prepared(session, query), resultrow, scmSession, func (a ...Scmer) Scmer {
+				i := ToInt(a[0])
+				if i < 1 || i > len(params) {
+					panic(fmt.Sprintf("parameter ?%d is not bound", i))
+				}
+				return params[i-1]
+			})
+		}
+		return Apply(m.querycallback, session.Schema(), query, resultrow, scmSession)
 	}()
 	if myerr != nil {
 		return myerr
 	}
-	// TODO: also set result.InsertID (maybe as a callback as 4th parameter to m.querycallback?)
 	switch rowcount_ := rowcount.(type) {
 		case float64:
 			result.RowsAffected = uint64(rowcount_)
 	}
+	if insertId != nil {
+		result.InsertID = uint64(ToInt(insertId))
+	}
 	// flush the rest
 	if result.State == sqltypes.RStateFields {
 		result.State = sqltypes.RStateNone // full send
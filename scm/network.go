@@ -104,8 +104,16 @@ func (s *HttpServer) ServeHTTP(res http.ResponseWriter, req *http.Request) {
 			req.Body.Close()
 			return b.String()
 		},
+		"bodystream", func(a ...Scmer) Scmer {
+			// body as io.Reader for streaming uploads; an upload may take longer than the server's timeouts
+			rc := http.NewResponseController(res)
+			rc.SetReadDeadline(time.Time{})
+			rc.SetWriteDeadline(time.Time{})
+			return req.Body
+		},
 	}
 	var res_lock sync.Mutex
+	var arrow *ArrowWriter // Arrow IPC stream; finished after the handler returns
 	res_scm := []Scmer {
 		"res", res,
 		"header", func (a ...Scmer) Scmer {
@@ -162,6 +170,18 @@ func (s *HttpServer) ServeHTTP(res http.ResponseWriter, req *http.Request) {
 			res_lock.Unlock();
 			return "ok"
 		},
+		"arrow", func (a ...Scmer) Scmer {
+			// returns a resultrow function that writes an Arrow IPC stream (set the Content-Type before)
+			res_lock.Lock()
+			if arrow == nil {
+				arrow = NewArrowWriter(res)
+			}
+			res_lock.Unlock();
+			return func (a ...Scmer) Scmer {
+				arrow.Row(a[0].([]Scmer))
+				return "ok"
+			}
+		},
 		"websocket", func (a ...Scmer) Scmer {
 			// upgrade to a websocket
 			var upgrader = websocket.Upgrader{
@@ -208,5 +228,8 @@ func (s *HttpServer) ServeHTTP(res http.ResponseWriter, req *http.Request) {
 			}
 		}()
 		Apply(s.callback, req_scm, res_scm)
+		if arrow != nil {
+			arrow.Close()
+		}
 	})
 }
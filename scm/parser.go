@@ -37,6 +37,9 @@ func (source_info SourceInfo) String() string {
 
 func Simplify(s string) Scmer {
 	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		if i, err := strconv.ParseInt(s, 10, 64); err == nil && int64(f) != i {
+			return s // integer beyond 2^53: keep the digits, so typed columns can reject it instead of storing a neighbour
+		}
 		return f
 	}
 	return s
@@ -47,6 +50,21 @@ func Read(source, s string) (expression Scmer) {
 	return readFrom(&tokens)
 }
 
+// removes the source information that Read attaches to lists
+func StripSourceInfo(v Scmer) Scmer {
+	switch x := v.(type) {
+		case SourceInfo:
+			return StripSourceInfo(x.value)
+		case []Scmer:
+			result := make([]Scmer, len(x))
+			for i, y := range x {
+				result[i] = StripSourceInfo(y)
+			}
+			return result
+	}
+	return v
+}
+
 func EvalAll(source, s string, en *Env) (expression Scmer) {
 	tokens := tokenize(source, s)
 	for len(tokens) > 0 {
@@ -109,6 +109,43 @@ func NewContext(ctx context.Context, fn func()) {
 	}, fn)
 }
 
+// captures the goroutine-local values (session, context) so fn can be run by a different goroutine
+func WrapContext(fn func()) func() {
+	if mgr == nil {
+		return fn
+	}
+	values := gls.Values{}
+	if session, ok := mgr.GetValue("session"); ok {
+		values["session"] = session
+	}
+	if ctx, ok := mgr.GetValue("context"); ok {
+		values["context"] = ctx
+	}
+	if len(values) == 0 {
+		return fn
+	}
+	return func() {
+		mgr.SetValues(values, fn)
+	}
+}
+
+// runs fn with an additional goroutine-local value, e.g. to mark worker goroutines
+func WithGoroutineValue(key string, value interface{}, fn func()) {
+	if mgr == nil {
+		// prone to race conditions, to the first call should be called in the initialization
+		mgr = gls.NewContextManager()
+	}
+	mgr.SetValues(gls.Values{key: value}, fn)
+}
+
+// reads a value set by WithGoroutineValue (or the session and context)
+func GoroutineValue(key string) (interface{}, bool) {
+	if mgr == nil {
+		return nil, false
+	}
+	return mgr.GetValue(key)
+}
+
 func GetContext() context.Context {
 	if mgr == nil {
 		// prone to race conditions, to the first call should be called in the initialization
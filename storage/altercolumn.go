@@ -0,0 +1,325 @@
+/*
+Copyright (C) 2024  Carl-Philip Hänsch
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package storage
+
+import "os"
+import "fmt"
+import "strings"
+import "encoding/json"
+import "github.com/launix-de/memcp/scm"
+
+/*
+
+alter column:
+ - MODIFY/CHANGE redefine a column: name, type and options; RENAME only changes the name
+ - all shards are locked while the column is changed, so no write sees half of the change
+ - a shard that is rebuilt in the background (next) or sealed (redirect) would hand over the unchanged
+   column to its successor, so the ALTER is refused until the rebuild has finished
+ - values are converted in two passes: first check that every live value fits the new type
+   (so a failing conversion leaves the table untouched), then recompress the main storage,
+   convert the delta storage and write column files and logfiles with the new names
+
+*/
+
+// redefines a column; typ == "" only renames the column and keeps type and options
+func (t *table) AlterColumn(name string, newname string, typ string, typdimensions []int, options string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.schema.schemalock.Lock()
+	defer t.schema.schemalock.Unlock()
+
+	colidx := -1
+	for i, c := range t.Columns {
+		if c.Name == name {
+			colidx = i
+		}
+		if c.Name == newname && newname != name {
+			panic("column " + t.Name + "." + newname + " already exists")
+		}
+	}
+	if colidx < 0 {
+		panic("column " + t.Name + "." + name + " does not exist")
+	}
+	oldc := t.Columns[colidx]
+	newc := oldc
+	newc.Name = newname
+	position := "" // FIRST or the column after which the column is placed
+	if typ != "" {
+		newc = column{Name: newname, Typ: typ, Typdimensions: typdimensions, Computor: oldc.Computor, ComputorCols: oldc.ComputorCols, ComputorSource: oldc.ComputorSource, Generated: oldc.Generated, PartitioningScore: oldc.PartitioningScore}
+		newc.parseOptions(options)
+		// MySQL positions: FIRST | AFTER col
+		tokens := tokenizeColumnOptions(newc.Extrainfo)
+		rest := make([]string, 0, len(tokens))
+		for i := 0; i < len(tokens); i++ {
+			if strings.EqualFold(tokens[i], "FIRST") {
+				position = "FIRST"
+			} else if strings.EqualFold(tokens[i], "AFTER") && i + 1 < len(tokens) {
+				position = strings.Trim(tokens[i+1], "`")
+				i++
+			} else {
+				rest = append(rest, tokens[i])
+			}
+		}
+		newc.Extrainfo = strings.Join(rest, " ")
+	}
+	var conv func(scm.Scmer) scm.Scmer
+	if typ != "" && oldc.Computor == nil {
+		conv = t.converter(&newc)
+	}
+	convert := func(v scm.Scmer) scm.Scmer {
+		if v != nil && conv != nil {
+			v = conv(v)
+		}
+		if v == nil && newc.NotNull && !newc.AutoIncrement && oldc.Computor == nil {
+			v = newc.defaultValue()
+			if v == nil {
+				panic("Invalid use of NULL value in column '" + name + "' of table " + t.Name)
+			}
+		}
+		return v
+	}
+
+	shardlist := t.Shards
+	if shardlist == nil {
+		shardlist = t.PShards
+	}
+	for _, s := range shardlist {
+		s.mu.Lock() // block all writes until the column is changed everywhere
+		defer s.mu.Unlock()
+	}
+	if typ != "" || newname != name {
+		for _, s := range shardlist {
+			if s.next != nil || s.redirect != nil {
+				// the successor shard is built from the old column and would bring the old type back
+				panic("table " + t.Name + " is being rebuilt in the background; retry the ALTER later")
+			}
+		}
+	}
+
+	// pass 1: check that all live values can be converted
+	if typ != "" {
+		for _, s := range shardlist {
+			reader := s.ColumnReader(name)
+			for idx := uint(0); idx < s.main_count + uint(len(s.inserts)); idx++ {
+				if !s.deletions.Get(idx) {
+					convert(reader(idx))
+				}
+			}
+		}
+	}
+
+	// pass 2: change all shards
+	for _, s := range shardlist {
+		s.alterColumn(name, newname, typ != "", convert)
+	}
+
+	// change the schema
+	t.Columns[colidx] = newc
+	if position != "" {
+		cols := append(append([]column{}, t.Columns[:colidx]...), t.Columns[colidx+1:]...)
+		target := 0
+		if position != "FIRST" {
+			target = -1
+			for i, c := range cols {
+				if c.Name == position {
+					target = i + 1
+				}
+			}
+			if target < 0 {
+				panic("column " + t.Name + "." + position + " does not exist")
+			}
+		}
+		t.Columns = append(cols[:target], append([]column{newc}, cols[target:]...)...)
+	}
+	if newname != name {
+		t.renameColumnReferences(name, newname)
+	}
+	t.schema.save()
+	fmt.Println("altered column", t.Name + "." + name, "to", newname, newc.Typ)
+	return true
+}
+
+// replaces the column name in keys, partitioning schema and dictionaries
+func (t *table) renameColumnReferences(name string, newname string) {
+	renameIn := func(cols []string) {
+		for i, c := range cols {
+			if c == name {
+				cols[i] = newname
+			}
+		}
+	}
+	for _, u := range t.Unique {
+		renameIn(u.Cols)
+	}
+	for i := range t.Columns {
+		renameIn(t.Columns[i].ComputorCols)
+	}
+	for _, index := range t.Indexes {
+		for i, key := range index.Cols {
+			index.Cols[i] = renameKeyColumn(key, name, newname)
+		}
+	}
+	for _, t2 := range t.schema.Tables.GetAll() {
+		for _, f := range t2.Foreign { // foreign keys are stored in both tables
+			if f.Tbl1 == t.Name {
+				renameIn(f.Cols1)
+			}
+			if f.Tbl2 == t.Name {
+				renameIn(f.Cols2)
+			}
+		}
+	}
+	for i := range t.PDimensions {
+		if t.PDimensions[i].Column == name {
+			t.PDimensions[i].Column = newname
+		}
+	}
+	for _, d := range t.Dictionaries {
+		if d.Column == name {
+			d.Column = newname
+		}
+	}
+	for i, c := range t.Checks {
+		t.Checks[i] = c.renameColumn(name, newname)
+	}
+}
+
+// renames and converts a column of this shard; this happens inside s.mu.Lock()
+func (s *storageShard) alterColumn(name string, newname string, converted bool, convert func(scm.Scmer) scm.Scmer) {
+	col, ok := s.columns[name]
+	if !ok {
+		return
+	}
+	if converted {
+		// recompress the main storage with the converted values
+		values := make([]scm.Scmer, s.main_count)
+		for idx := range values {
+			if !s.deletions.Get(uint(idx)) {
+				values[idx] = convert(col.GetValue(uint(idx)))
+			}
+		}
+		var newcol ColumnStorage = new(StorageSCMER)
+		for {
+			newcol.prepare()
+			for i, v := range values {
+				newcol.scan(uint(i), v)
+			}
+			newcol2 := newcol.proposeCompression(s.main_count)
+			if newcol2 == nil {
+				break // we found the optimal storage format
+			} else {
+				newcol = s.t.useGlobalDictionary(name, newcol2)
+			}
+		}
+		newcol.init(s.main_count)
+		for i, v := range values {
+			newcol.build(uint(i), v)
+		}
+		newcol.finish()
+		col = newcol
+
+		// convert the delta storage into new rows (snapshots of a sealed shard may still read the old ones)
+		if dcol, ok := s.deltaColumns[name]; ok {
+			inserts := make([][]scm.Scmer, len(s.inserts))
+			for i, row := range s.inserts {
+				if dcol < len(row) && !s.deletions.Get(s.main_count + uint(i)) {
+					row = append([]scm.Scmer{}, row...)
+					row[dcol] = convert(row[dcol])
+				}
+				inserts[i] = row
+			}
+			s.inserts = inserts
+		}
+	}
+	delete(s.columns, name)
+	s.columns[newname] = col
+	if dcol, ok := s.deltaColumns[name]; ok {
+		delete(s.deltaColumns, name)
+		s.deltaColumns[newname] = dcol
+	}
+
+	// indexes and unique hashmaps are rebuilt on demand
+	indexes := make([]*StorageIndex, 0, len(s.Indexes))
+	for _, index := range s.Indexes {
+		uses := false
+		for _, c := range index.Cols {
+			if keyUsesColumn(c, name) {
+				uses = true
+			}
+		}
+		if !uses {
+			indexes = append(indexes, index)
+		}
+	}
+	s.Indexes = indexes
+	s.hashmaps = make(map[string]*uniqueHashmap)
+
+	if s.t.PersistencyMode == Memory {
+		return
+	}
+	oldfile := s.t.schema.path + s.uuid.String() + "-" + ProcessColumnName(name)
+	newfile := s.t.schema.path + s.uuid.String() + "-" + ProcessColumnName(newname)
+	if converted {
+		f, err := os.Create(newfile)
+		if err != nil {
+			panic(err)
+		}
+		col.Serialize(f) // col takes ownership of f, so they will defer f.Close() at the right time
+		f.Close()
+		if newfile != oldfile {
+			os.Remove(oldfile)
+		}
+	} else {
+		os.Rename(oldfile, newfile) // shards without main storage have no file
+	}
+	if s.logfile != nil {
+		s.rewriteLog()
+	}
+}
+
+// writes the delta storage into a fresh logfile (after the column names or values have changed); this happens inside s.mu.Lock()
+func (s *storageShard) rewriteLog() {
+	cols := make([]string, len(s.deltaColumns))
+	for col, i := range s.deltaColumns {
+		cols[i] = col
+	}
+	f, err := os.Create(s.t.schema.path + s.uuid.String() + ".log.new")
+	if err != nil {
+		panic(err)
+	}
+	var b strings.Builder
+	colsjson, _ := json.Marshal(cols)
+	for _, row := range s.inserts {
+		values := make([]scm.Scmer, len(cols))
+		copy(values, row)
+		b.WriteString("insert ")
+		b.Write(colsjson)
+		tmp, _ := json.Marshal([][]scm.Scmer{values})
+		b.Write(tmp)
+		b.WriteString("\n")
+	}
+	for idx := uint(0); idx < s.main_count + uint(len(s.inserts)); idx++ {
+		if s.deletions.Get(idx) {
+			b.WriteString(fmt.Sprintf("delete %d\n", idx))
+		}
+	}
+	f.WriteString(b.String())
+	f.Sync()
+	s.logfile.Close()
+	os.Rename(s.t.schema.path + s.uuid.String() + ".log.new", s.t.schema.path + s.uuid.String() + ".log")
+	s.logfile = f // the handle follows the renamed file
+}
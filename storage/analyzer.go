@@ -88,46 +88,51 @@ func extractBoundaries(conditionCols []string, condition scm.Scmer) boundaries {
 		}
 		return nil, false
 	}
+	// a column or an expression over columns like (toLower email)
+	extractColumn := func(v scm.Scmer) (string, bool) {
+		switch v1 := v.(type) {
+			case scm.Symbol:
+				col, ok := symbolmapping[v1]
+				return col, ok
+			case []scm.Scmer:
+				return expressionKey(v1, func(sym scm.Symbol) (string, bool) {
+					col, ok := symbolmapping[sym]
+					return col, ok
+				})
+		}
+		return "", false
+	}
 	var traverseCondition func(scm.Scmer)
 	traverseCondition = func (node scm.Scmer) {
 		switch v := node.(type) {
 			case []scm.Scmer:
 				if v[0] == scm.Symbol("equal?") || v[0] == scm.Symbol("equal??") {
 					// equi
-					switch v1 := v[1].(type) {
-						case scm.Symbol:
-							if col, ok := symbolmapping[v1]; ok { // left is a column
-								if v2, ok := extractConstant(v[2]); ok { // right is a constant
-									// ?equal var const
-									cols = addConstraint(cols, columnboundaries{col, v2, true, v2, true})
-								}
-							}
-						// TODO: equals constant vs. column
+					if col, ok := extractColumn(v[1]); ok { // left is a column or an indexable expression
+						if v2, ok := extractConstant(v[2]); ok { // right is a constant
+							// ?equal var const
+							cols = addConstraint(cols, columnboundaries{col, v2, true, v2, true})
+						}
 					}
+					// TODO: equals constant vs. column
 				} else if v[0] == scm.Symbol("<") || v[0] == scm.Symbol("<=") {
 					// compare
-					switch v1 := v[1].(type) {
-						case scm.Symbol:
-							if col, ok := symbolmapping[v1]; ok { // left is a column
-								if v2, ok := extractConstant(v[2]); ok { // right is a constant
-									// ?equal var const
-									cols = addConstraint(cols, columnboundaries{col, nil, false, v2, v[0] == scm.Symbol("<=")})
-								}
-							}
-						// TODO: constant vs. column
+					if col, ok := extractColumn(v[1]); ok { // left is a column or an indexable expression
+						if v2, ok := extractConstant(v[2]); ok { // right is a constant
+							// ?equal var const
+							cols = addConstraint(cols, columnboundaries{col, nil, false, v2, v[0] == scm.Symbol("<=")})
+						}
 					}
+					// TODO: constant vs. column
 				} else if v[0] == scm.Symbol(">") || v[0] == scm.Symbol(">=") {
 					// compare
-					switch v1 := v[1].(type) {
-						case scm.Symbol:
-							if col, ok := symbolmapping[v1]; ok { // left is a column
-								if v2, ok := extractConstant(v[2]); ok { // right is a constant
-									// ?equal var const
-									cols = addConstraint(cols, columnboundaries{col, v2, v[0] == scm.Symbol(">="), nil, false})
-								}
-							}
-						// TODO: constant vs. column
+					if col, ok := extractColumn(v[1]); ok { // left is a column or an indexable expression
+						if v2, ok := extractConstant(v[2]); ok { // right is a constant
+							// ?equal var const
+							cols = addConstraint(cols, columnboundaries{col, v2, v[0] == scm.Symbol(">="), nil, false})
+						}
 					}
+					// TODO: constant vs. column
 				} else if v[0] == scm.Symbol("and") {
 					// AND -> recursive traverse
 					for i := 1; i < len(v); i++ {
@@ -0,0 +1,161 @@
+/*
+Copyright (C) 2024  Carl-Philip Hänsch
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package storage
+
+import "fmt"
+import "sync"
+import "github.com/launix-de/memcp/scm"
+
+/*
+
+check constraints:
+ - CHECK (expr) is compiled from SQL into scm code in which every column is a symbol of its name
+ - the code is stored as the source of a lambda over Cols in the schema and compiled on first use;
+   the lambda keeps its parameter names when a column is renamed
+ - a row violates the constraint if the expression is false; NULL (unknown) passes like in MySQL
+ - checks run on insert and on update before any change is applied
+
+*/
+
+type checkConstraint struct {
+	Id string
+	Cols []string // columns that are passed into the expression
+	Expr string // scm source of a lambda that takes the values of Cols
+	once sync.Once
+	fn scm.Scmer
+}
+
+func (c *checkConstraint) compile() scm.Scmer {
+	c.once.Do(func () {
+		c.fn = scm.Eval(scm.Read("check", c.Expr), &scm.Globalenv)
+	})
+	return c.fn
+}
+
+// adds a check constraint; code is the condition with column symbols; existing rows must pass the check
+func (t *table) AddCheck(id string, cols []string, code scm.Scmer) {
+	t.schema.schemalock.Lock()
+	defer t.schema.schemalock.Unlock()
+	if id == "" {
+		id = fmt.Sprintf("%s_chk_%d", t.Name, len(t.Checks) + 1) // MySQL's naming scheme
+	}
+	for _, c := range t.Checks {
+		if c.Id == id {
+			panic("Check constraint " + id + " already exists in table " + t.Name)
+		}
+	}
+	params := make([]scm.Scmer, len(cols))
+	for i, col := range cols {
+		params[i] = scm.Symbol(col)
+	}
+	check := &checkConstraint{id, cols, scm.SerializeToString([]scm.Scmer{scm.Symbol("lambda"), params, code}, &scm.Globalenv), sync.Once{}, nil}
+
+	// validate the existing data
+	shardlist := t.Shards
+	if shardlist == nil {
+		shardlist = t.PShards
+	}
+	for _, s := range shardlist {
+		s.mu.RLock()
+		readers := make([]func(uint) scm.Scmer, len(cols))
+		for i, col := range cols {
+			readers[i] = s.ColumnReader(col)
+		}
+		args := make([]scm.Scmer, len(cols))
+		for idx := uint(0); idx < s.main_count + uint(len(s.inserts)); idx++ {
+			if !s.deletions.Get(idx) {
+				for i, reader := range readers {
+					args[i] = reader(idx)
+				}
+				if !check.passes(args) {
+					s.mu.RUnlock()
+					panic("Check constraint violated in table " + t.Name + ": " + id)
+				}
+			}
+		}
+		s.mu.RUnlock()
+	}
+
+	t.Checks = append(t.Checks, check)
+	t.schema.save()
+}
+
+func (t *table) DropCheck(id string) bool {
+	t.schema.schemalock.Lock()
+	defer t.schema.schemalock.Unlock()
+	for i, c := range t.Checks {
+		if c.Id == id {
+			t.Checks = append(t.Checks[:i:i], t.Checks[i+1:]...)
+			t.schema.save()
+			return true
+		}
+	}
+	panic("Check constraint " + id + " does not exist in table " + t.Name)
+}
+
+func (c *checkConstraint) passes(args []scm.Scmer) bool {
+	result := scm.Apply(c.compile(), args...)
+	return result == nil || scm.ToBool(result)
+}
+
+// checks all rows against the check constraints and panics on the first violation
+func (t *table) checkConstraints(columns []string, values [][]scm.Scmer) {
+	for _, c := range t.Checks {
+		colidx := make([]int, len(c.Cols))
+		for i, col := range c.Cols {
+			colidx[i] = -1
+			for j, col2 := range columns {
+				if col == col2 {
+					colidx[i] = j
+				}
+			}
+		}
+		args := make([]scm.Scmer, len(c.Cols))
+		for _, row := range values {
+			for i, j := range colidx {
+				if j >= 0 && j < len(row) {
+					args[i] = row[j]
+				} else {
+					args[i] = nil
+				}
+			}
+			if !c.passes(args) {
+				panic("Check constraint violated in table " + t.Name + ": " + c.Id)
+			}
+		}
+	}
+}
+
+func stringList(v scm.Scmer) []string {
+	list := v.([]scm.Scmer)
+	result := make([]string, len(list))
+	for i, s := range list {
+		result[i] = scm.String(s)
+	}
+	return result
+}
+
+// returns the constraint with a renamed column; the expression is a lambda over Cols, so only Cols changes
+func (c *checkConstraint) renameColumn(name string, newname string) *checkConstraint {
+	cols := append([]string{}, c.Cols...)
+	for i, col := range cols {
+		if col == name {
+			cols[i] = newname
+		}
+	}
+	return &checkConstraint{c.Id, cols, c.Expr, sync.Once{}, nil}
+}
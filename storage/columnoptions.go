@@ -0,0 +1,467 @@
+/*
+Copyright (C) 2024  Carl-Philip Hänsch
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package storage
+
+import "strconv"
+import "strings"
+import "sync"
+import "sync/atomic"
+import "github.com/launix-de/memcp/scm"
+
+/*
+
+column options:
+ - NOT NULL, DEFAULT and AUTO_INCREMENT are parsed from the option string of a column
+   (e.g. "NOT NULL DEFAULT 'x' COMMENT 'y'"); everything else stays in Extrainfo
+ - DEFAULT is either a constant or an expression that is evaluated once per insert
+ - auto_increment: each shard reserves a range of autoIncrementBlock ids from t.autoinc_reserved,
+   so parallel inserts only meet at one atomic add; partitioned tables use one range for all shards
+   because ids are generated before the target shard is known
+ - t.Auto_increment is the highest id handed out or inserted + 1 (persisted, SHOW CREATE TABLE);
+   every range continues behind the highest explicit id, so no shard hands out an id that was inserted
+
+*/
+
+const autoIncrementBlock = 64 // ids that a shard reserves at once; unused ids of a range are lost on restart
+
+// SQL default expressions and their scheme equivalent
+var defaultExpressions = map[string]string{
+	"CURRENT_TIMESTAMP": "(now)",
+	"NOW": "(now)",
+	"LOCALTIME": "(now)",
+	"LOCALTIMESTAMP": "(now)",
+	"UNIX_TIMESTAMP": "(now)",
+	"CURRENT_DATE": "(* 86400 (floor (/ (now) 86400)))",
+	"CURDATE": "(* 86400 (floor (/ (now) 86400)))",
+}
+
+// splits an option string into words, 'quoted strings' and words with (parentheses)
+func tokenizeColumnOptions(s string) (result []string) {
+	i := 0
+	for i < len(s) {
+		c := s[i]
+		if c == ' ' || c == '\t' || c == '\r' || c == '\n' {
+			i++
+			continue
+		}
+		j := i
+		if c == '\'' || c == '"' {
+			j++
+			for j < len(s) {
+				if s[j] == '\\' {
+					j += 2
+					continue
+				}
+				if s[j] == c {
+					if j + 1 < len(s) && s[j+1] == c {
+						j += 2 // '' escape
+						continue
+					}
+					break
+				}
+				j++
+			}
+			j++
+		} else {
+			depth := 0
+			for j < len(s) && (depth > 0 || (s[j] != ' ' && s[j] != '\t' && s[j] != '\r' && s[j] != '\n')) {
+				if s[j] == '(' {
+					depth++
+				} else if s[j] == ')' {
+					depth--
+				}
+				j++
+			}
+		}
+		if j > len(s) {
+			j = len(s)
+		}
+		result = append(result, s[i:j])
+		i = j
+	}
+	return
+}
+
+func unquoteColumnOption(s string) string {
+	q := s[0]
+	s = s[1:]
+	if len(s) > 0 && s[len(s)-1] == q {
+		s = s[:len(s)-1]
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i + 1 < len(s) {
+			i++
+			switch s[i] {
+				case 'n':
+					b.WriteByte('\n')
+				case 't':
+					b.WriteByte('\t')
+				case 'r':
+					b.WriteByte('\r')
+				case '0':
+					b.WriteByte(0)
+				default:
+					b.WriteByte(s[i])
+			}
+		} else if s[i] == q && i + 1 < len(s) && s[i+1] == q {
+			b.WriteByte(q)
+			i++
+		} else {
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String()
+}
+
+// parses NOT NULL, DEFAULT and AUTO_INCREMENT out of the option string; the rest is kept in Extrainfo
+func (c *column) parseOptions(options string) {
+	tokens := tokenizeColumnOptions(options)
+	rest := make([]string, 0, len(tokens))
+	for i := 0; i < len(tokens); i++ {
+		switch strings.ToUpper(tokens[i]) {
+			case "NOT":
+				if i + 1 < len(tokens) && strings.EqualFold(tokens[i+1], "NULL") {
+					c.NotNull = true
+					i++
+				} else {
+					rest = append(rest, tokens[i])
+				}
+			case "NULL":
+				c.NotNull = false
+			case "AUTO_INCREMENT", "AUTOINCREMENT":
+				c.AutoIncrement = true
+			case "DEFAULT":
+				if i + 1 >= len(tokens) {
+					panic("missing value after DEFAULT for column " + c.Name)
+				}
+				i++
+				c.setDefault(tokens[i])
+			default:
+				rest = append(rest, tokens[i])
+		}
+	}
+	c.Extrainfo = strings.Join(rest, " ")
+}
+
+// moves NOT NULL, DEFAULT and AUTO_INCREMENT of schemas that were written before these options were modelled out of Extrainfo
+func (t *table) migrateColumnOptions() {
+	for i := range t.Columns {
+		if t.Columns[i].Extrainfo != "" {
+			t.Columns[i].parseOptions(t.Columns[i].Extrainfo)
+		}
+	}
+}
+
+// sets the default value from its SQL representation
+func (c *column) setDefault(v string) {
+	c.Default, c.DefaultExpr = nil, ""
+	if v[0] == '\'' || v[0] == '"' {
+		c.Default = unquoteColumnOption(v)
+		return
+	}
+	name, _, _ := strings.Cut(strings.ToUpper(v), "(") // CURRENT_TIMESTAMP(3) and NOW() are expressions
+	if expr, ok := defaultExpressions[name]; ok {
+		c.DefaultExpr = expr
+		return
+	}
+	switch name {
+		case "NULL":
+			return
+		case "TRUE":
+			c.Default = float64(1)
+			return
+		case "FALSE":
+			c.Default = float64(0)
+			return
+	}
+	if f, err := strconv.ParseFloat(v, 64); err == nil {
+		c.Default = f
+		return
+	}
+	panic("unsupported DEFAULT value for column " + c.Name + ": " + v)
+}
+
+// returns the column options in SQL notation
+func (c *column) OptionString() string {
+	var b strings.Builder
+	if c.NotNull {
+		b.WriteString("NOT NULL")
+	}
+	if c.DefaultExpr == defaultExpressions["CURRENT_TIMESTAMP"] {
+		b.WriteString(" DEFAULT CURRENT_TIMESTAMP")
+	} else if c.DefaultExpr == defaultExpressions["CURRENT_DATE"] {
+		b.WriteString(" DEFAULT CURRENT_DATE")
+	} else if c.Default != nil {
+		switch v := c.Default.(type) {
+			case string:
+				b.WriteString(" DEFAULT '" + strings.ReplaceAll(strings.ReplaceAll(v, "\\", "\\\\"), "'", "''") + "'")
+			default:
+				b.WriteString(" DEFAULT " + scm.String(v))
+		}
+	}
+	if c.AutoIncrement {
+		b.WriteString(" AUTO_INCREMENT")
+	}
+	if c.Extrainfo != "" {
+		b.WriteString(" " + c.Extrainfo)
+	}
+	return strings.TrimSpace(b.String())
+}
+
+// computes the default value of a column for one insert
+func (c *column) defaultValue() scm.Scmer {
+	if c.DefaultExpr != "" {
+		return scm.Eval(scm.Read("default", c.DefaultExpr), &scm.Globalenv)
+	}
+	return c.Default
+}
+
+// index of the auto_increment column or -1
+func (t *table) autoIncrementColumn() int {
+	for i, c := range t.Columns {
+		if c.AutoIncrement {
+			return i
+		}
+	}
+	return -1
+}
+
+// continues the auto_increment counter behind the highest id in storage (the counter is only persisted with the schema)
+func (t *table) initAutoIncrement() {
+	t.autoincOnce.Do(func() {
+		col := t.autoIncrementColumn()
+		if col < 0 {
+			return
+		}
+		shardlist := t.Shards
+		if shardlist == nil {
+			shardlist = t.PShards
+		}
+		var max uint64
+		for _, s := range shardlist {
+			reader := s.ColumnReader(t.Columns[col].Name)
+			s.mu.RLock()
+			for idx := uint(0); idx < s.main_count + uint(len(s.inserts)); idx++ { // deleted ids are never reused
+				if v := reader(idx); v != nil && scm.ToInt(v) > 0 && uint64(scm.ToInt(v)) > max {
+					max = uint64(scm.ToInt(v))
+				}
+			}
+			s.mu.RUnlock()
+		}
+		t.bumpAutoIncrement(max)
+		t.bumpAutoIncrement(0) // ids start at 1
+		bumpCounter(&t.autoinc_reserved, atomic.LoadUint64(&t.Auto_increment) - 1) // ranges start behind everything handed out before
+	})
+}
+
+// an auto_increment range reserved by a shard (or by a partitioned table for all of its shards)
+type autoIncrementRange struct {
+	mu sync.Mutex
+	next, end uint64
+}
+
+// reserves n consecutive ids from the table and returns the first one
+func (t *table) reserveAutoIncrement(n uint64) uint64 {
+	t.initAutoIncrement()
+	return atomic.AddUint64(&t.autoinc_reserved, n) - n
+}
+
+// moves a counter behind id; returns false if it already was
+func bumpCounter(counter *uint64, id uint64) bool {
+	for {
+		next := atomic.LoadUint64(counter)
+		if next > id {
+			return false
+		}
+		if atomic.CompareAndSwapUint64(counter, next, id + 1) {
+			return true
+		}
+	}
+}
+
+// makes sure the reported counter is behind an id that was handed out or inserted
+func (t *table) bumpAutoIncrement(id uint64) {
+	bumpCounter(&t.Auto_increment, id)
+}
+
+// an explicit id was inserted: no range may hand it out again
+func (t *table) explicitAutoIncrement(id uint64) {
+	t.initAutoIncrement()
+	t.bumpAutoIncrement(id)
+	bumpCounter(&t.autoinc_floor, id) // reserved ranges continue behind it (see alloc)
+	bumpCounter(&t.autoinc_reserved, id) // new ranges start behind it
+}
+
+// hands out n ids from the range; a new range is reserved from the table when the old one runs out
+func (r *autoIncrementRange) alloc(t *table, n int) []uint64 {
+	result := make([]uint64, n)
+	t.initAutoIncrement() // reads the shards, so do it before we lock
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := range result {
+		if floor := atomic.LoadUint64(&t.autoinc_floor); r.next < floor {
+			r.next = min(floor, r.end) // an explicit id was inserted: MySQL continues behind it
+		}
+		if r.next >= r.end {
+			block := uint64(autoIncrementBlock)
+			if rest := uint64(n - i); rest > block {
+				block = rest // bulk inserts get one contiguous range
+			}
+			r.next = t.reserveAutoIncrement(block)
+			r.end = r.next + block
+		}
+		result[i] = r.next
+		r.next++
+	}
+	if n > 0 {
+		t.bumpAutoIncrement(result[n-1]) // ids are ascending
+	}
+	return result
+}
+
+// AUTO_INCREMENT values that completeRows generated; LAST_INSERT_ID() only reports those of rows that were actually inserted
+type generatedIds struct {
+	col int // index of the AUTO_INCREMENT column in the completed rows
+	ids map[uint64]bool
+}
+
+// returns the first generated id in rows (0 if there is none)
+func (g generatedIds) first(rows [][]scm.Scmer) uint64 {
+	if len(g.ids) == 0 {
+		return 0
+	}
+	for _, row := range rows {
+		if id, ok := row[g.col].(float64); ok && g.ids[uint64(id)] {
+			return uint64(id)
+		}
+	}
+	return 0
+}
+
+// fills in DEFAULT and AUTO_INCREMENT values, converts the values to the column types and checks NOT NULL; shard hands out the ids (nil = take them from the table)
+func (t *table) completeRows(columns []string, values [][]scm.Scmer, shard *storageShard) (newcolumns []string, newvalues [][]scm.Scmer, generated generatedIds) {
+	colidx := make([]int, len(t.Columns)) // table column -> index in columns or -1
+	converters := make([]func(scm.Scmer) scm.Scmer, len(t.Columns))
+	needed := false
+	for i, c := range t.Columns {
+		colidx[i] = -1
+		for j, col := range columns {
+			if col == c.Name {
+				colidx[i] = j
+			}
+		}
+		if c.Computor != nil {
+			continue
+		}
+		converters[i] = t.converter(&t.Columns[i])
+		if c.NotNull || c.AutoIncrement || (colidx[i] < 0 && (c.Default != nil || c.DefaultExpr != "")) || (colidx[i] >= 0 && converters[i] != nil) {
+			needed = true
+		}
+	}
+	if !needed {
+		return columns, values, generated // fast path: table without column options and types
+	}
+
+	// add missing columns
+	newcolumns = columns
+	for i, c := range t.Columns {
+		if colidx[i] < 0 && c.Computor == nil && (c.NotNull || c.AutoIncrement || c.Default != nil || c.DefaultExpr != "") {
+			if !c.AutoIncrement && c.NotNull && c.Default == nil && c.DefaultExpr == "" {
+				panic("Field '" + c.Name + "' of table " + t.Name + " doesn't have a default value")
+			}
+			if len(newcolumns) == len(columns) {
+				newcolumns = append([]string{}, columns...)
+			}
+			colidx[i] = len(newcolumns)
+			newcolumns = append(newcolumns, c.Name)
+		}
+	}
+	defaults := make([]scm.Scmer, len(t.Columns)) // evaluated once per insert
+	for i, c := range t.Columns {
+		if colidx[i] >= len(columns) {
+			defaults[i] = c.defaultValue()
+		}
+	}
+	newvalues = make([][]scm.Scmer, len(values))
+	var ids []uint64 // ids that still have to be handed out
+	var idrows []int
+	for r, row := range values {
+		newrow := make([]scm.Scmer, len(newcolumns))
+		copy(newrow, row)
+		for i, c := range t.Columns {
+			if colidx[i] < 0 || c.Computor != nil {
+				continue
+			}
+			v := newrow[colidx[i]]
+			if colidx[i] >= len(columns) {
+				v = defaults[i] // column was not given
+			}
+			if v != nil && converters[i] != nil {
+				v = converters[i](v)
+			}
+			if c.AutoIncrement {
+				if v == nil || scm.ToInt(v) == 0 {
+					idrows = append(idrows, r) // MySQL semantics: NULL and 0 generate a new id
+				} else if scm.ToInt(v) > 0 {
+					t.explicitAutoIncrement(uint64(scm.ToInt(v)))
+				}
+			} else if v == nil && c.NotNull {
+				panic("Column '" + c.Name + "' of table " + t.Name + " cannot be null")
+			}
+			newrow[colidx[i]] = v
+		}
+		newvalues[r] = newrow
+	}
+	if len(idrows) > 0 {
+		if shard != nil {
+			ids = shard.autoinc.alloc(t, len(idrows))
+		} else {
+			ids = t.autoinc.alloc(t, len(idrows))
+		}
+		generated.col = colidx[t.autoIncrementColumn()]
+		generated.ids = make(map[uint64]bool, len(ids))
+		for i, r := range idrows {
+			newvalues[r][generated.col] = float64(ids[i])
+			generated.ids[ids[i]] = true
+		}
+	}
+	return newcolumns, newvalues, generated
+}
+
+// converts and checks the changes of an UPDATE ('(col value col value ...)) according to the column types and options
+func (t *table) checkUpdate(changes []scm.Scmer) []scm.Scmer {
+	changes = append([]scm.Scmer{}, changes...)
+	for j := 0; j < len(changes); j += 2 {
+		for i, c := range t.Columns {
+			if c.Name == scm.String(changes[j]) {
+				if c.Generated != "" {
+					panic("The value specified for generated column '" + c.Name + "' in table '" + t.Name + "' is not allowed")
+				}
+				if conv := t.converter(&t.Columns[i]); conv != nil && changes[j+1] != nil && c.Computor == nil {
+					changes[j+1] = conv(changes[j+1])
+				}
+				if c.AutoIncrement && changes[j+1] != nil && scm.ToInt(changes[j+1]) > 0 {
+					t.explicitAutoIncrement(uint64(scm.ToInt(changes[j+1])))
+				} else if c.NotNull && changes[j+1] == nil {
+					panic("Column '" + c.Name + "' of table " + t.Name + " cannot be null")
+				}
+			}
+		}
+	}
+	return changes
+}
@@ -25,6 +25,10 @@ func (t *table) ComputeColumn(name string, inputCols []string, computor scm.Scme
 		if c.Name == name {
 			// found the column
 			t.Columns[i].Computor = computor // set formula so delta storages and rebuild algo know how to recompute
+			t.Columns[i].ComputorCols = inputCols
+			if c.Generated == "VIRTUAL" {
+				t.computedReads.Store(name, true) // survive at least one rebuild
+			}
 			done := make(chan error, 6)
 			shardlist := t.Shards
 			if shardlist == nil {
@@ -67,8 +71,6 @@ func (s *storageShard) ComputeColumn(name string, inputCols []string, computor s
 		return false // can't compute in shards with delta storage
 	}
 
-	fn := scm.OptimizeProcToSerialFunction(computor)
-
 	cols := make([]ColumnStorage, len(inputCols))
 	s.mu.Lock()
 	for i, col := range inputCols {
@@ -79,21 +81,29 @@ func (s *storageShard) ComputeColumn(name string, inputCols []string, computor s
 		}
 	}
 	s.mu.Unlock()
-	colvalues := make([]scm.Scmer, len(cols))
-
-	vals := make([]scm.Scmer, s.main_count) // build the stretchy value array
-	for i := uint(0); i < s.main_count; i++ {
-		for j, col := range cols {
-			colvalues[j] = col.GetValue(i) // read values from main storage into lambda params
-		}
-		vals[i] = fn(colvalues...) // execute computor kernel
-	}
+	vals := computeValues(cols, s.main_count, computor)
 
 	s.mu.Lock() // don't defer because we unlock inbetween
 	store := new(StorageSCMER)
 	store.values = vals
 	s.columns[name] = store
+	s.virtualizeColumns()
 	s.mu.Unlock()
 	// TODO: decide whether to rebuild optimized store
 	return true
 }
+
+// runs the computor over the first count items of the input columns
+func computeValues(cols []ColumnStorage, count uint, computor scm.Scmer) []scm.Scmer {
+	fn := scm.OptimizeProcToSerialFunction(computor)
+	colvalues := make([]scm.Scmer, len(cols))
+
+	vals := make([]scm.Scmer, count) // build the stretchy value array
+	for i := uint(0); i < count; i++ {
+		for j, col := range cols {
+			colvalues[j] = col.GetValue(i) // read values from main storage into lambda params
+		}
+		vals[i] = fn(colvalues...) // execute computor kernel
+	}
+	return vals
+}
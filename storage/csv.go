@@ -16,26 +16,202 @@ Copyright (C) 2023  Carl-Philip Hänsch
 */
 package storage
 
+import "io"
 import "os"
+import "fmt"
+import "sort"
+import "sync"
 import "bufio"
+import "runtime"
+import "strconv"
 import "strings"
 import "github.com/launix-de/memcp/scm"
 
-func LoadCSV(schema, table, filename, delimiter string) {
-	f, _ := os.Open(filename)
-	defer f.Close()
-	scanner := bufio.NewScanner(f)
-	scanner.Split(bufio.ScanLines)
+/*
 
-	lines := make(chan string, 512)
+CSV import (RFC 4180):
+ - fields may be quoted with "; quoted fields can contain the delimiter, line breaks and "" for a quote
+ - the first record is the header; its names are mapped onto the table's columns (case insensitive).
+   Unknown names are an error unless createcolumns is set, then the columns are created with a type
+   inferred from the first batch of records (INT, DOUBLE, VARCHAR(255) or TEXT)
+ - an unquoted field equal to the NULL marker (default \N) is NULL
+ - the reader only finds the record boundaries (quote state machine over the lines);
+   worker goroutines split the fields, convert the values and insert batches in parallel
+ - records with a wrong number of fields, broken quoting or values that don't fit the column type
+   are skipped and reported with their line number
 
-	go func () {
-		for scanner.Scan() {
-			lines <- scanner.Text()
+*/
+
+type CSVOptions struct {
+	Delimiter string
+	Header bool // first record names the columns
+	CreateColumns bool // create columns for unknown header names
+	NullMarker string // unquoted field value that is read as NULL ("" = empty fields are NULL)
+	Quote byte // 0 = fields are not quoted
+	Escape byte // 0 = no escape character; otherwise it escapes the next character like \t in MySQL's format
+	IgnoreLines int // records to skip at the beginning
+	Columns []string // column of each field if there is no header; @name skips the field
+}
+
+func DefaultCSVOptions() CSVOptions {
+	return CSVOptions{";", true, false, "\\N", '"', 0, 0, nil}
+}
+
+// reads an options list of loadCSV and LOAD DATA
+func ParseCSVOptions(list []scm.Scmer, options *CSVOptions) {
+	char := func (v scm.Scmer) byte {
+		if s := scm.String(v); s != "" {
+			return s[0]
+		}
+		return 0
+	}
+	for i := 0; i + 1 < len(list); i += 2 {
+		switch scm.String(list[i]) {
+			case "delimiter":
+				options.Delimiter = scm.String(list[i+1])
+			case "header":
+				options.Header = scm.ToBool(list[i+1])
+			case "createcolumns":
+				options.CreateColumns = scm.ToBool(list[i+1])
+			case "null":
+				options.NullMarker = scm.String(list[i+1])
+			case "quote":
+				options.Quote = char(list[i+1])
+			case "escape":
+				options.Escape = char(list[i+1])
+			case "ignore":
+				options.IgnoreLines = scm.ToInt(list[i+1])
+			case "columns":
+				options.Columns = nil
+				for _, col := range list[i+1].([]scm.Scmer) {
+					options.Columns = append(options.Columns, scm.String(col))
+				}
+			case "linestart":
+				if scm.String(list[i+1]) != "" {
+					panic("LINES STARTING BY is not supported")
+				}
+			case "lineterminator":
+				if lt := scm.String(list[i+1]); lt != "\n" && lt != "\r\n" {
+					panic("only \\n and \\r\\n are supported as line terminator")
+				}
+			default:
+				panic("unknown option: " + scm.String(list[i]))
+		}
+	}
+}
+
+// raw record and the line number where it starts
+type csvRecord struct {
+	line int
+	text string
+}
+
+// a record of an import file that was skipped
+type ImportError struct {
+	Line int
+	Message string
+}
+
+func (e ImportError) String() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Message)
+}
+
+// prints the skipped records of an import (at most 100) and a summary; what names the counted items
+func PrintImportErrors(filename string, count int, what string, errors []ImportError) {
+	for i, e := range errors {
+		if i == 100 {
+			fmt.Println(filename + ": ...")
+			break
+		}
+		fmt.Println(filename + ":", e.String())
+	}
+	if len(errors) > 0 {
+		fmt.Println(filename + ":", count, what, "imported,", len(errors), "skipped")
+	}
+}
+
+// stream of an upload; a read error (e.g. a dropped connection) ends the stream instead of failing the import, so the rows read so far are still reported
+type uploadReader struct {
+	r io.Reader
+	err error
+}
+
+func (u *uploadReader) Read(p []byte) (int, error) {
+	n, err := u.r.Read(p)
+	if err != nil && err != io.EOF {
+		u.err = err
+		err = io.EOF
+	}
+	return n, err
+}
+
+// inserts rows that were read from the given lines; rows that can't be inserted are reported with their line and skipped. Returns the number of inserted rows.
+func (t *table) importRows(cols []string, rows [][]scm.Scmer, lines []int) (count int, errors []ImportError) {
+	// unique collisions are reported by the collision handler, so the rows before and after the collision still get inserted
+	newCols := make([]string, len(cols))
+	for i, col := range cols {
+		newCols[i] = "NEW." + col
+	}
+	reported := make([]bool, len(rows))
+	onCollision := func (a ...scm.Scmer) scm.Scmer {
+		// find the first unreported row with these values
+		for i, row := range rows {
+			if reported[i] {
+				continue
+			}
+			match := true
+			for j, v := range a {
+				if v != row[j] && !(v != nil && row[j] != nil && scm.ToBool(scm.Equal(v, row[j]))) {
+					match = false
+					break
+				}
+			}
+			if match {
+				reported[i] = true
+				errors = append(errors, ImportError{lines[i], "Unique key constraint violated in table " + t.Name})
+				break
+			}
 		}
-		close(lines)
+		return nil
+	}
+	func () {
+		defer func () {
+			if r := recover(); r != nil {
+				// the batch failed before it was inserted (e.g. NOT NULL or CHECK): retry row by row, so only the bad lines are skipped
+				count = 0
+				errors = nil
+				if len(rows) == 1 {
+					errors = append(errors, ImportError{lines[0], fmt.Sprint(r)})
+					return
+				}
+				for i, row := range rows {
+					n, errs := t.importRows(cols, [][]scm.Scmer{row}, lines[i:i+1])
+					count += n
+					errors = append(errors, errs...)
+				}
+			}
+		}()
+		count = t.Insert(cols, rows, newCols, onCollision, false)
 	}()
+	return
+}
+
+const csvBatchSize = 4096
+
+// LoadCSV imports a CSV file into an existing table; returns the number of imported rows and the skipped records
+func LoadCSV(schema, table, filename string, options CSVOptions) (int, []ImportError) {
+	f, err := os.Open(filename)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+	return ReadCSV(schema, table, f, options)
+}
 
+func ReadCSV(schema, table string, r io.Reader, options CSVOptions) (int, []ImportError) {
+	if options.Delimiter == "" {
+		panic("CSV delimiter must not be empty")
+	}
 	db := GetDatabase(schema)
 	if db == nil {
 		panic("database " + schema + " does not exist")
@@ -44,31 +220,439 @@ func LoadCSV(schema, table, filename, delimiter string) {
 	if t == nil {
 		panic("table " + table + " does not exist")
 	}
-	cols := make([]string, len(t.Columns))
-	for i, col := range t.Columns {
-		cols[i] = col.Name
+
+	batches := make(chan []csvRecord, 4)
+	stop := make(chan struct{}) // stops the reader when the import fails
+	defer close(stop)
+	var readErr interface{}
+	go func () {
+		defer func () {
+			readErr = recover() // I/O errors are reported after the import
+			close(batches)
+		}()
+		splitCSVRecords(bufio.NewReaderSize(r, 1024 * 1024), options, func (batch []csvRecord) bool {
+			select {
+				case batches <- batch:
+					return true
+				case <-stop:
+					return false
+			}
+		})
+	}()
+
+	var errors []ImportError
+	var errmu sync.Mutex
+	reportError := func (line int, msg string) {
+		errmu.Lock()
+		errors = append(errors, ImportError{line, msg})
+		errmu.Unlock()
+	}
+
+	first := <-batches
+	for skip := options.IgnoreLines; skip > 0 && first != nil; {
+		if len(first) > skip {
+			first = first[skip:]
+			break
+		}
+		skip -= len(first)
+		first = <-batches // nil at the end of the file
+	}
+
+	// map the header onto the columns; cols has "" for skipped fields
+	var cols []string
+	if options.Header {
+		if len(first) == 0 {
+			return 0, nil // empty file
+		}
+		headerOptions := options
+		headerOptions.NullMarker = ""
+		names, msg := parseCSVRecord(strings.TrimPrefix(first[0].text, "\uFEFF"), headerOptions)
+		if msg != "" {
+			panic(ImportError{first[0].line, msg}.String())
+		}
+		first = first[1:]
+		cols = t.csvColumns(names, options, first)
+	} else if options.Columns != nil {
+		names := make([]scm.Scmer, len(options.Columns))
+		for i, col := range options.Columns {
+			names[i] = col
+		}
+		cols = t.csvColumns(names, options, first)
+	} else {
+		cols = t.exportColumns()
+	}
+	insertCols := make([]string, 0, len(cols))
+	for _, col := range cols {
+		if col != "" {
+			insertCols = append(insertCols, col)
+		}
 	}
-	buffer := make([][]scm.Scmer, 0, 4096)
-	for s := range(lines) {
+
+	// converters of the target columns; untyped columns get numbers where the text is a number
+	t.schema.schemalock.Lock()
+	converters := make([]func(scm.Scmer) scm.Scmer, len(cols))
+	notnull := make([]bool, len(cols))
+	for i, col := range cols {
+		for j, c := range t.Columns {
+			if c.Name == col {
+				converters[i] = t.converter(&t.Columns[j])
+				notnull[i] = c.NotNull && !c.AutoIncrement && c.Default == nil && c.DefaultExpr == ""
+			}
+		}
+		if converters[i] == nil {
+			converters[i] = func (v scm.Scmer) scm.Scmer {
+				if s, ok := v.(string); ok {
+					return scm.Simplify(s)
+				}
+				return v
+			}
+		}
+	}
+	t.schema.schemalock.Unlock()
+
+	// converts one record; returns nil and an error message for bad records
+	convert := func (rec csvRecord) (row []scm.Scmer, msg string) {
+		fields, msg := parseCSVRecord(rec.text, options)
+		if msg != "" {
+			return nil, msg
+		}
+		if len(fields) != len(cols) {
+			return nil, fmt.Sprintf("expected %d fields, found %d", len(cols), len(fields))
+		}
+		defer func () {
+			if r := recover(); r != nil {
+				row, msg = nil, fmt.Sprint(r) // strict type errors
+			}
+		}()
+		row = make([]scm.Scmer, 0, len(insertCols))
+		for i, v := range fields {
+			if cols[i] == "" {
+				continue // @variable
+			}
+			if v == nil {
+				if notnull[i] {
+					return nil, "Column '" + cols[i] + "' cannot be null"
+				}
+			} else {
+				v = converters[i](v)
+			}
+			row = append(row, v)
+		}
+		return row, ""
+	}
+
+	// parse, convert and insert in parallel
+	var done sync.WaitGroup
+	var countmu sync.Mutex
+	count := 0
+	work := make(chan []csvRecord, 4)
+	workers := runtime.NumCPU()
+	done.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func () {
+			defer done.Done()
+			for batch := range work {
+				rows := make([][]scm.Scmer, 0, len(batch))
+				lines := make([]int, 0, len(batch))
+				for _, rec := range batch {
+					row, msg := convert(rec)
+					if msg != "" {
+						reportError(rec.line, msg)
+					} else {
+						rows = append(rows, row)
+						lines = append(lines, rec.line)
+					}
+				}
+				if len(rows) == 0 {
+					continue
+				}
+				inserted, errs := t.importRows(insertCols, rows, lines)
+				for _, e := range errs {
+					reportError(e.Line, e.Message)
+				}
+				countmu.Lock()
+				count += inserted
+				countmu.Unlock()
+			}
+		}()
+	}
+	work <- first
+	for batch := range batches {
+		work <- batch
+	}
+	close(work)
+	done.Wait()
+	if readErr != nil {
+		panic(readErr)
+	}
+	sort.Slice(errors, func (i, j int) bool {
+		return errors[i].Line < errors[j].Line
+	})
+	return count, errors
+}
+
+// maps header names onto the table's columns and creates the missing ones if allowed; sample is used for type inference
+func (t *table) csvColumns(names []scm.Scmer, options CSVOptions, sample []csvRecord) []string {
+	cols := make([]string, len(names))
+	var missing []int
+	for i, name := range names {
+		s := ""
+		if name != nil {
+			s = strings.TrimSpace(scm.String(name))
+		}
 		if s == "" {
-			// ignore
-		} else {
-			arr := strings.Split(s, delimiter)
-			x := make([]scm.Scmer, len(t.Columns))
-			for i, _ := range t.Columns {
-				if i < len(arr) {
-					x[i] = scm.Simplify(arr[i])
+			panic(fmt.Sprintf("CSV header: column %d has no name", i + 1))
+		}
+		if strings.HasPrefix(s, "@") {
+			continue // user variable: the field is read but not stored
+		}
+		for j := 0; j < i; j++ {
+			if strings.EqualFold(cols[j], s) {
+				panic("CSV header: duplicate column " + s)
+			}
+		}
+		cols[i] = s
+		found := false
+		for _, c := range t.Columns {
+			if c.Name == s {
+				found = true
+			}
+		}
+		if !found {
+			for _, c := range t.Columns {
+				if strings.EqualFold(c.Name, s) {
+					cols[i] = c.Name
+					found = true
+				}
+			}
+		}
+		if !found {
+			if !options.CreateColumns {
+				panic("CSV header: column " + s + " does not exist in table " + t.Name)
+			}
+			missing = append(missing, i)
+		}
+	}
+	if len(missing) > 0 {
+		// infer the types of the new columns from the first records
+		values := make([][]scm.Scmer, 0, len(sample))
+		for _, rec := range sample {
+			fields, msg := parseCSVRecord(rec.text, options)
+			if msg == "" && len(fields) == len(cols) {
+				values = append(values, fields)
+			}
+		}
+		for _, i := range missing {
+			typ, dims := inferCSVType(values, i)
+			t.CreateColumn(cols[i], typ, dims, "")
+		}
+	}
+	return cols
+}
+
+// smallest type that fits all sample values of a column
+func inferCSVType(values [][]scm.Scmer, i int) (string, []int) {
+	isInt, isNumber, maxlen := true, true, 0
+	for _, row := range values {
+		s, ok := row[i].(string)
+		if !ok || s == "" {
+			continue // NULL and empty fields fit every type
+		}
+		if _, err := strconv.ParseInt(s, 10, 32); err != nil {
+			isInt = false
+		}
+		if _, err := strconv.ParseFloat(s, 64); err != nil {
+			isNumber = false
+		}
+		if len(s) > maxlen {
+			maxlen = len(s)
+		}
+	}
+	if maxlen == 0 {
+		return "TEXT", []int{} // no values to decide
+	} else if isInt {
+		return "INT", []int{}
+	} else if isNumber {
+		return "DOUBLE", []int{}
+	} else if maxlen <= 255 {
+		return "VARCHAR", []int{255}
+	}
+	return "TEXT", []int{}
+}
+
+// reads the input and cuts it into records; a line break inside a quoted field or after the escape character continues the record
+func splitCSVRecords(r *bufio.Reader, options CSVOptions, emit func([]csvRecord) bool) {
+	batch := make([]csvRecord, 0, csvBatchSize)
+	lineno := 0
+	var record strings.Builder
+	start := 0
+	inQuote, open := false, false
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil && err != io.EOF {
+			panic(err)
+		}
+		if line == "" && err == io.EOF {
+			break
+		}
+		lineno++
+		if !open {
+			start = lineno
+		}
+		inQuote, open = scanCSVLine(line, options, inQuote)
+		record.WriteString(line)
+		if !open || err == io.EOF {
+			text := strings.TrimRight(record.String(), "\r\n")
+			record.Reset()
+			if text != "" || open {
+				batch = append(batch, csvRecord{start, text})
+			}
+			inQuote, open = false, false
+			if len(batch) >= csvBatchSize {
+				if !emit(batch) {
+					return
 				}
+				batch = make([]csvRecord, 0, csvBatchSize)
 			}
-			buffer = append(buffer, x)
-			if len(buffer) >= 4096 {
-				t.Insert(cols, buffer, nil, nil, false)
-				buffer = buffer[:0]
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	emit(batch) // the first batch is always sent so the header can be read
+}
+
+// follows the quotes of a line; returns whether the line ends inside a quoted field and whether the record continues
+func scanCSVLine(line string, options CSVOptions, inQuote bool) (bool, bool) {
+	fieldStart := !inQuote
+	for i := 0; i < len(line); {
+		c := line[i]
+		if options.Escape != 0 && c == options.Escape {
+			if strings.HasPrefix(line[i+1:], "\n") || strings.HasPrefix(line[i+1:], "\r\n") {
+				return inQuote, true // escaped line break
+			}
+			fieldStart = false
+			i += 2
+		} else if inQuote {
+			if c == options.Quote {
+				if i + 1 < len(line) && line[i+1] == options.Quote {
+					i += 2 // escaped quote
+					continue
+				}
+				inQuote = false
 			}
+			i++
+		} else if fieldStart && options.Quote != 0 && c == options.Quote {
+			inQuote = true
+			fieldStart = false
+			i++
+		} else if strings.HasPrefix(line[i:], options.Delimiter) {
+			fieldStart = true
+			i += len(options.Delimiter)
+		} else {
+			fieldStart = false
+			i++
 		}
 	}
-	if len(buffer) > 0 {
-		t.Insert(cols, buffer, nil, nil, false)
+	return inQuote, inQuote
+}
+
+// character that an escape sequence stands for (MySQL's ESCAPED BY)
+func csvUnescape(c byte) byte {
+	switch c {
+		case '0':
+			return 0
+		case 'b':
+			return '\b'
+		case 'n':
+			return '\n'
+		case 'r':
+			return '\r'
+		case 't':
+			return '\t'
+		case 'Z':
+			return 26
+	}
+	return c
+}
+
+// resolves the backslash escapes of a string from the SQL parser (FIELDS TERMINATED BY '\t')
+func unescapeSQLString(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i + 1 < len(s) {
+			i++
+			b.WriteByte(csvUnescape(s[i]))
+		} else {
+			b.WriteByte(s[i])
+		}
 	}
+	return b.String()
 }
 
+// splits a record into its fields; unquoted fields equal to the NULL marker are nil
+func parseCSVRecord(text string, options CSVOptions) ([]scm.Scmer, string) {
+	fields := make([]scm.Scmer, 0, 16)
+	for {
+		var b strings.Builder
+		quoted := false
+		i := 0
+		if options.Quote != 0 && len(text) > 0 && text[0] == options.Quote {
+			quoted = true
+			closed := false
+			for i = 1; i < len(text); {
+				c := text[i]
+				if options.Escape != 0 && c == options.Escape && i + 1 < len(text) {
+					b.WriteByte(csvUnescape(text[i+1]))
+					i += 2
+				} else if c == options.Quote {
+					i++
+					if i < len(text) && text[i] == options.Quote {
+						b.WriteByte(c) // doubled quote
+						i++
+						continue
+					}
+					closed = true
+					break
+				} else {
+					b.WriteByte(c)
+					i++
+				}
+			}
+			if !closed {
+				return nil, "unterminated quoted field"
+			}
+			if i < len(text) && !strings.HasPrefix(text[i:], options.Delimiter) {
+				return nil, "unexpected text after quoted field"
+			}
+		} else if options.Escape == 0 {
+			i = strings.Index(text, options.Delimiter)
+			if i < 0 {
+				i = len(text)
+			}
+			b.WriteString(text[:i])
+		} else {
+			for i < len(text) && !strings.HasPrefix(text[i:], options.Delimiter) {
+				if text[i] == options.Escape && i + 1 < len(text) {
+					b.WriteByte(csvUnescape(text[i+1]))
+					i += 2
+				} else {
+					b.WriteByte(text[i])
+					i++
+				}
+			}
+		}
+		if !quoted && text[:i] == options.NullMarker {
+			fields = append(fields, nil)
+		} else {
+			fields = append(fields, b.String())
+		}
+		if i >= len(text) {
+			return fields, ""
+		}
+		text = text[i+len(options.Delimiter):]
+	}
+}
@@ -20,6 +20,7 @@ import "os"
 import "fmt"
 import "sync"
 import "time"
+import "strings"
 import "encoding/json"
 import "github.com/launix-de/memcp/scm"
 import "github.com/launix-de/NonLockingReadMap"
@@ -72,6 +73,16 @@ func LoadDatabases() {
 	}
 	InitSettings()
 
+	// finish a table move that was interrupted
+	if jsonbytes, err := os.ReadFile(Basepath + "/move.json"); err == nil {
+		var j moveJournal
+		if json.Unmarshal(jsonbytes, &j) == nil {
+			fmt.Println("finishing the move of table files from database " + j.From + " to " + j.To)
+			j.redo()
+		}
+		os.Remove(Basepath + "/move.json")
+	}
+
 	// load dbs
 	var done sync.WaitGroup
 	entries, _ := os.ReadDir(Basepath)
@@ -92,6 +103,12 @@ func LoadDatabases() {
 				// restore back references of the tables
 				for _, t := range db.Tables.GetAll() {
 					t.schema = db // restore schema reference
+					t.publishPartitioning()
+					t.migrateColumnOptions()
+					t.compileComputors()
+					for _, d := range t.Dictionaries {
+						d.load(t) // dictionaries must be present before the shards decode their columns
+					}
 					func (t *table) {
 						t.iterateShards(nil, func (s *storageShard) {
 							s.load(t)
@@ -107,6 +124,7 @@ func LoadDatabases() {
 }
 
 func (db *database) save() {
+	scm.SchemaVersion.Add(1) // prepared statements must be parsed again
 	os.MkdirAll(db.path, 0750)
 	if stat, err := os.Stat(db.path + "schema.json"); err == nil && stat.Size() > 0 {
 		// rescue a copy of schema.json in case the schema is not serializable
@@ -140,7 +158,8 @@ func (db *database) rebuild(all bool, repartition bool) {
 	for _, t := range dbs {
 		go func(t *table) {
 			t.mu.Lock() // table lock
-			// TODO: check LRU statistics and remove unused computed columns
+			// drop time partitions that have run out of retention
+			t.dropExpiredPartitions()
 
 			// rebuild shards
 			shardlist := t.Shards // if Shards AND PShards are present, Shards is the single point of truth
@@ -148,16 +167,18 @@ func (db *database) rebuild(all bool, repartition bool) {
 				shardlist = t.PShards
 			}
 			maincount := uint(0)
-			var sdone sync.WaitGroup
-			sdone.Add(len(shardlist))
+			position := make(map[*storageShard]int)
 			for i, s := range shardlist {
-				maincount += s.main_count + uint(len(s.inserts)) // estimate size of that table
-				go func(shardlist []*storageShard, i int, s *storageShard) {
-					shardlist[i] = s.rebuild(all)
-					sdone.Done()
-				}(shardlist, i, s)
+				maincount += s.Count() // live items, so mostly-deleted tables shrink their shard count
+				position[s] = i
 			}
-			sdone.Wait()
+			// rebuild on the shard's NUMA node, so the new main storage is allocated node-local
+			runOnShards(append([]*storageShard{}, shardlist...), func(s *storageShard) {
+				shardlist[position[s]] = s.rebuild(all)
+			})
+
+			// merge undersized and split oversized shards
+			t.rebalance()
 
 			// check if we should do the repartitioning
 			if repartition {
@@ -167,6 +188,9 @@ func (db *database) rebuild(all bool, repartition bool) {
 				}
 			}
 
+			// LRU statistics: free computed columns that were not read since the last rebuild
+			t.dropUnusedComputed()
+
 			t.mu.Unlock()
 			done.Done()
 		}(t)
@@ -209,6 +233,7 @@ func DropDatabase(schema string) {
 		panic("Database " + schema + " does not exist")
 	}
 
+	scm.SchemaVersion.Add(1)
 	// remove remains of the folder structure
 	os.RemoveAll(db.path)
 }
@@ -259,15 +284,222 @@ func DropTable(schema, name string, ifexists bool) {
 		panic("Table " + schema + "." + name + " does not exist")
 	}
 	db.Tables.Remove(name)
+	caches := db.removeGroupCaches(name)
 	db.save()
 	db.schemalock.Unlock()
 
 	// delete shard files from disk
+	for _, t := range append(caches, t) {
+		t.removeFromDisk()
+	}
+}
+
+func (t *table) removeFromDisk() {
 	for _, s := range t.Shards {
 		s.RemoveFromDisk()
 	}
 	for _, s := range t.PShards {
 		s.RemoveFromDisk()
 	}
+	for _, d := range t.Dictionaries {
+		d.RemoveFromDisk(t)
+	}
+}
+
+// removes the preaggregation tables of GROUP BY queries over a table (named .table:group, see queryplan.scm), so a
+// renamed or dropped table doesn't leave its groups to a table that takes over the name; this happens inside schemalock
+func (db *database) removeGroupCaches(name string) (result []*table) {
+	for _, t := range db.Tables.GetAll() {
+		if strings.HasPrefix(t.Name, "." + name + ":") {
+			db.Tables.Remove(t.Name)
+			result = append(result, t)
+		}
+	}
+	return
+}
+
+
+// renames a table and moves it into another database if newschema differs; the shard, log and dictionary files follow the table
+func RenameTable(schema, name, newschema, newname string) {
+	db := GetDatabase(schema)
+	if db == nil {
+		panic("Database " + schema + " does not exist")
+	}
+	newdb := GetDatabase(newschema)
+	if newdb == nil {
+		panic("Database " + newschema + " does not exist")
+	}
+	t := db.Tables.Get(name)
+	if t == nil {
+		panic("Table " + schema + "." + name + " does not exist")
+	}
+	t.mu.Lock() // no rebuild or alter may write files while they are moved
+	defer t.mu.Unlock()
+	// lock both schemas in a fixed order, so two concurrent renames in opposite directions don't deadlock
+	first, second := db, newdb
+	if second.Name < first.Name {
+		first, second = second, first
+	}
+	first.schemalock.Lock()
+	defer first.schemalock.Unlock()
+	if second != first {
+		second.schemalock.Lock()
+		defer second.schemalock.Unlock()
+	}
+	if db.Tables.Get(name) != t {
+		panic("Table " + schema + "." + name + " does not exist") // concurrent drop or rename
+	}
+	if newdb.Tables.Get(newname) != nil {
+		panic("Table " + newschema + "." + newname + " already exists")
+	}
+
+	var files []string // files that move to the other database
+	shardlist := t.Shards
+	if shardlist == nil {
+		shardlist = t.PShards
+	}
+	if newdb != db {
+		for _, t2 := range db.Tables.GetAll() {
+			for _, f := range t2.Foreign {
+				if f.Tbl1 == name || f.Tbl2 == name {
+					panic("Table " + schema + "." + name + " is referenced by foreign key " + f.Id + " and cannot be moved to another database")
+				}
+			}
+		}
+		// the files are moved after the new schemas are written, see moveJournal
+		if t.PersistencyMode != Memory {
+			for _, s := range shardlist {
+				for _, col := range t.Columns {
+					files = append(files, s.uuid.String() + "-" + ProcessColumnName(col.Name))
+				}
+				files = append(files, s.uuid.String() + ".log")
+			}
+			for _, d := range t.Dictionaries {
+				files = append(files, d.Uuid.String() + ".dict")
+			}
+		}
+	} else {
+		// foreign keys are stored in both tables
+		for _, t2 := range db.Tables.GetAll() {
+			for i, f := range t2.Foreign {
+				if f.Tbl1 == name {
+					t2.Foreign[i].Tbl1 = newname
+				}
+				if f.Tbl2 == name {
+					t2.Foreign[i].Tbl2 = newname
+				}
+			}
+		}
+	}
+
+	db.Tables.Remove(name)
+	caches := db.removeGroupCaches(name) // they are rebuilt under the new name on demand
+	defer func () {
+		for _, t := range caches {
+			t.removeFromDisk()
+		}
+	}()
+	t.Name = newname
+	t.schema = newdb
+	newdb.Tables.Set(t)
+	if newdb != db {
+		writeSchemaFiles(db, newdb)
+		j := moveJournal{[]string{db.Name, newdb.Name}, db.Name, newdb.Name, files}
+		j.write()
+		func () {
+			// the open logfile handles stay valid while their files are moved
+			for _, s := range shardlist {
+				s.mu.Lock()
+			}
+			defer func () {
+				for _, s := range shardlist {
+					s.mu.Unlock()
+				}
+			}()
+			j.redo()
+		}()
+		os.Remove(Basepath + "/move.json")
+		scm.SchemaVersion.Add(1)
+	} else {
+		db.save()
+	}
+}
+
+/*
+
+moving a table into another database changes two schema.json files and moves its files, so it is journaled:
+ 1. both schemas are written to schema.json.new
+ 2. Basepath/move.json lists the schemas and the files and is synced to disk
+ 3. the schema.json.new files replace schema.json and the files are moved
+ 4. move.json is removed
+LoadDatabases redoes the steps 3 and 4 if move.json exists, so a crash leaves the table in exactly one database.
+
+*/
+type moveJournal struct {
+	Schemas []string // databases whose schema.json.new replaces schema.json
+	From string // database the files are moved from
+	To string
+	Files []string
+}
+
+func (j *moveJournal) write() {
+	f, err := os.Create(Basepath + "/move.json.new")
+	if err != nil {
+		panic(err)
+	}
+	jsonbytes, _ := json.Marshal(j)
+	_, err = f.Write(jsonbytes)
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		panic(err)
+	}
+	if err := os.Rename(Basepath + "/move.json.new", Basepath + "/move.json"); err != nil {
+		panic(err)
+	}
 }
 
+// finishes the move; every step can be repeated
+func (j *moveJournal) redo() {
+	for _, schema := range j.Schemas {
+		path := Basepath + "/" + schema + "/"
+		if _, err := os.Stat(path + "schema.json.new"); err == nil {
+			if stat, err := os.Stat(path + "schema.json"); err == nil && stat.Size() > 0 {
+				os.Rename(path + "schema.json", path + "schema.json.old")
+			}
+			if err := os.Rename(path + "schema.json.new", path + "schema.json"); err != nil {
+				panic(err)
+			}
+		}
+	}
+	for _, file := range j.Files {
+		if err := os.Rename(Basepath + "/" + j.From + "/" + file, Basepath + "/" + j.To + "/" + file); err != nil && !os.IsNotExist(err) {
+			panic(err)
+		}
+	}
+}
+
+// writes schema.json.new of the databases; they replace schema.json when the journal of the change is written
+func writeSchemaFiles(dbs ...*database) {
+	for _, db := range dbs {
+		os.MkdirAll(db.path, 0750)
+		jsonbytes, err := json.MarshalIndent(db, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+		f, err := os.Create(db.path + "schema.json.new")
+		if err != nil {
+			panic(err)
+		}
+		_, err = f.Write(jsonbytes)
+		if err == nil {
+			err = f.Sync()
+		}
+		f.Close()
+		if err != nil {
+			panic(err)
+		}
+	}
+}
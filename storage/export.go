@@ -0,0 +1,266 @@
+/*
+Copyright (C) 2024  Carl-Philip Hänsch
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package storage
+
+import "io"
+import "os"
+import "sync"
+import "bufio"
+import "strconv"
+import "strings"
+import "net/http"
+import "encoding/json"
+import "github.com/launix-de/memcp/scm"
+
+/*
+
+export:
+ - exportCSV, exportJSON and exportSQL stream the rows of a table into a file or an HTTP response
+ - rows come from a parallel scan over the shards; each row is written under a lock, so the row
+   order is not defined
+ - computed columns (generated columns and caches of the query planner) are not exported since they
+   are derived from the other columns
+ - exportJSON writes a #table line first, so the output can be read with loadJSON again;
+   exportCSV writes the header that loadCSV maps onto the columns;
+   exportSQL writes the CREATE TABLE statement and INSERT statements with up to 100 rows each
+
+*/
+
+type ExportOptions struct {
+	FilterCols []string
+	Filter scm.Scmer // condition over FilterCols; nil exports all rows
+	Delimiter string // CSV only
+	NullMarker string // CSV only
+	Header bool // CSV only
+	Create bool // SQL only: write CREATE TABLE first
+}
+
+func DefaultExportOptions() ExportOptions {
+	return ExportOptions{nil, nil, ";", "\\N", true, true}
+}
+
+// reads the options list of the export declarations
+func ParseExportOptions(list []scm.Scmer) ExportOptions {
+	options := DefaultExportOptions()
+	for i := 0; i + 1 < len(list); i += 2 {
+		switch scm.String(list[i]) {
+			case "filtercols":
+				cols := list[i+1].([]scm.Scmer)
+				options.FilterCols = make([]string, len(cols))
+				for j, col := range cols {
+					options.FilterCols[j] = scm.String(col)
+				}
+			case "filter":
+				options.Filter = list[i+1]
+			case "delimiter":
+				options.Delimiter = scm.String(list[i+1])
+			case "null":
+				options.NullMarker = scm.String(list[i+1])
+			case "header":
+				options.Header = scm.ToBool(list[i+1])
+			case "create":
+				options.Create = scm.ToBool(list[i+1])
+			default:
+				panic("unknown option: " + scm.String(list[i]))
+		}
+	}
+	return options
+}
+
+// opens the destination of an export: a filename or the res object of an HTTP handler
+func OpenExport(destination scm.Scmer, contentType string) (*bufio.Writer, func()) {
+	if res, ok := destination.([]scm.Scmer); ok && len(res) > 1 && res[0] == "res" {
+		w := res[1].(http.ResponseWriter)
+		w.Header().Set("Content-Type", contentType)
+		b := bufio.NewWriterSize(w, 64 * 1024)
+		return b, func () {
+			b.Flush()
+		}
+	}
+	f, err := os.Create(scm.String(destination))
+	if err != nil {
+		panic(err)
+	}
+	b := bufio.NewWriterSize(f, 1024 * 1024)
+	return b, func () {
+		b.Flush()
+		f.Close()
+	}
+}
+
+func getExportTable(schema, table string) *table {
+	db := GetDatabase(schema)
+	if db == nil {
+		panic("database " + schema + " does not exist")
+	}
+	t := db.Tables.Get(table)
+	if t == nil {
+		panic("table " + table + " does not exist")
+	}
+	return t
+}
+
+// columns that are written by an export
+func (t *table) exportColumns() []string {
+	t.schema.schemalock.Lock()
+	defer t.schema.schemalock.Unlock()
+	cols := make([]string, 0, len(t.Columns))
+	for _, c := range t.Columns {
+		if c.Computor == nil {
+			cols = append(cols, c.Name)
+		}
+	}
+	return cols
+}
+
+// scans the rows that match the filter and passes them to row one at a time; returns the number of rows
+func (t *table) exportRows(cols []string, options ExportOptions, row func([]scm.Scmer)) int {
+	filtercols, filter := options.FilterCols, options.Filter
+	if filter == nil {
+		filtercols, filter = []string{}, scm.Eval(scm.Read("export", "(lambda () true)"), &scm.Globalenv)
+	}
+	var mu sync.Mutex
+	count := 0
+	t.scan(filtercols, filter, cols, func (a ...scm.Scmer) scm.Scmer {
+		mu.Lock()
+		defer mu.Unlock()
+		row(a)
+		count++
+		return true
+	}, nil, nil, nil, false)
+	return count
+}
+
+func ExportCSV(schema, table string, w io.Writer, options ExportOptions) int {
+	t := getExportTable(schema, table)
+	cols := t.exportColumns()
+	field := func (v scm.Scmer) string {
+		if v == nil {
+			return options.NullMarker
+		}
+		s := toText(v)
+		if s == options.NullMarker || strings.Contains(s, options.Delimiter) || strings.ContainsAny(s, "\"\r\n") {
+			return "\"" + strings.ReplaceAll(s, "\"", "\"\"") + "\""
+		}
+		return s
+	}
+	line := func (values []scm.Scmer) {
+		for i, v := range values {
+			if i > 0 {
+				io.WriteString(w, options.Delimiter)
+			}
+			io.WriteString(w, field(v))
+		}
+		io.WriteString(w, "\n")
+	}
+	if options.Header {
+		header := make([]scm.Scmer, len(cols))
+		for i, col := range cols {
+			header[i] = col
+		}
+		line(header)
+	}
+	return t.exportRows(cols, options, line)
+}
+
+// JSON value of a cell
+func jsonValue(v scm.Scmer) scm.Scmer {
+	switch x := v.(type) {
+		case scm.LazyString:
+			return x.GetValue()
+		case float64, string, bool, nil:
+			return v
+	}
+	return scm.String(v)
+}
+
+func ExportJSON(schema, table string, w io.Writer, options ExportOptions) int {
+	t := getExportTable(schema, table)
+	cols := t.exportColumns()
+	keys := make([][]byte, len(cols))
+	for i, col := range cols {
+		keys[i], _ = json.Marshal(col)
+	}
+	io.WriteString(w, "#table " + t.Name + "\n")
+	return t.exportRows(cols, options, func (values []scm.Scmer) {
+		io.WriteString(w, "{")
+		for i, v := range values {
+			if i > 0 {
+				io.WriteString(w, ", ")
+			}
+			w.Write(keys[i])
+			io.WriteString(w, ": ")
+			b, err := json.Marshal(jsonValue(v))
+			if err != nil {
+				b = []byte("null") // NaN and Inf
+			}
+			w.Write(b)
+		}
+		io.WriteString(w, "}\n")
+	})
+}
+
+// SQL literal of a cell
+func sqlValue(v scm.Scmer) string {
+	switch x := v.(type) {
+		case nil:
+			return "NULL"
+		case float64:
+			return strconv.FormatFloat(x, 'f', -1, 64)
+		case bool:
+			if x {
+				return "TRUE"
+			}
+			return "FALSE"
+	}
+	return sqlString(toText(v))
+}
+
+func ExportSQL(schema, table string, w io.Writer, options ExportOptions) int {
+	t := getExportTable(schema, table)
+	cols := t.exportColumns()
+	if options.Create {
+		io.WriteString(w, t.ShowCreate() + ";\n\n")
+	}
+	quoted := make([]string, len(cols))
+	for i, col := range cols {
+		quoted[i] = sqlIdentifier(col)
+	}
+	insert := "INSERT INTO " + sqlIdentifier(t.Name) + " (" + strings.Join(quoted, ", ") + ") VALUES\n"
+	pending := 0 // rows of the current INSERT statement
+	count := t.exportRows(cols, options, func (values []scm.Scmer) {
+		if pending == 0 {
+			io.WriteString(w, insert)
+		} else {
+			io.WriteString(w, ",\n")
+		}
+		literals := make([]string, len(values))
+		for i, v := range values {
+			literals[i] = sqlValue(v)
+		}
+		io.WriteString(w, "(" + strings.Join(literals, ", ") + ")")
+		pending++
+		if pending == 100 {
+			io.WriteString(w, ";\n")
+			pending = 0
+		}
+	})
+	if pending > 0 {
+		io.WriteString(w, ";\n")
+	}
+	return count
+}
@@ -0,0 +1,216 @@
+/*
+Copyright (C) 2024  Carl-Philip Hänsch
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package storage
+
+import "strings"
+import "github.com/launix-de/memcp/scm"
+
+/*
+
+expression indexes:
+ - a key part of an index is either a column name or an expression over columns like (toLower email)
+ - expressions are stored in a canonical source form where every column is written as its name;
+   extractBoundaries derives the same form from filter conditions, so (equal?? (toLower t.email) "x")
+   matches the key part (toLower email) structurally
+ - the values of an expression are computed with the ComputeColumn kernel when the shard index is built;
+   the delta btree ignores expression key parts, delta items are always emitted
+
+*/
+
+func isExpressionKey(key string) bool {
+	return strings.HasPrefix(key, "(")
+}
+
+// canonical source of an expression; mapping translates variables into column names
+// returns false if the expression uses no column or a variable that is not a column
+func expressionKey(code scm.Scmer, mapping func(scm.Symbol) (string, bool)) (string, bool) {
+	var b strings.Builder
+	usesColumn := false
+	var walk func(v scm.Scmer, head bool) bool
+	walk = func(v scm.Scmer, head bool) bool {
+		switch x := v.(type) {
+			case scm.Symbol:
+				if head {
+					b.WriteString(string(x)) // function name
+					return true
+				}
+				col, ok := mapping(x)
+				if !ok {
+					return false // free variable: the value is not known at index build time
+				}
+				b.WriteString(col)
+				usesColumn = true
+				return true
+			case []scm.Scmer:
+				if len(x) == 0 {
+					return false
+				}
+				if _, ok := x[0].(scm.Symbol); !ok {
+					return false // lambdas and native funcs are not comparable
+				}
+				b.WriteByte('(')
+				for i, y := range x {
+					if i != 0 {
+						b.WriteByte(' ')
+					}
+					if !walk(y, i == 0) {
+						return false
+					}
+				}
+				b.WriteByte(')')
+				return true
+			case string, float64, int64, bool, nil:
+				b.WriteString(scm.SerializeToString(x, &scm.Globalenv))
+				return true
+		}
+		return false
+	}
+	if !walk(code, false) || !usesColumn {
+		return "", false
+	}
+	return b.String(), true
+}
+
+// canonicalizes an expression from the SQL parser where each column is a symbol
+func expressionKeyFromCode(code scm.Scmer) string {
+	key, ok := expressionKey(scm.StripSourceInfo(code), func(sym scm.Symbol) (string, bool) {
+		return string(sym), true
+	})
+	if !ok {
+		panic("index expression must be calculated from columns only: " + scm.SerializeToString(code, &scm.Globalenv))
+	}
+	return key
+}
+
+// columns that a key part is calculated from, in order of their first appearance
+func keyColumns(key string) []string {
+	if !isExpressionKey(key) {
+		return []string{key}
+	}
+	result := make([]string, 0, 2)
+	var walk func(v scm.Scmer, head bool)
+	walk = func(v scm.Scmer, head bool) {
+		switch x := v.(type) {
+			case scm.Symbol:
+				if !head {
+					for _, col := range result {
+						if col == string(x) {
+							return
+						}
+					}
+					result = append(result, string(x))
+				}
+			case []scm.Scmer:
+				for i, y := range x {
+					walk(y, i == 0)
+				}
+		}
+	}
+	walk(scm.StripSourceInfo(scm.Read("index", key)), false)
+	return result
+}
+
+func keyUsesColumn(key string, name string) bool {
+	for _, col := range keyColumns(key) {
+		if col == name {
+			return true
+		}
+	}
+	return false
+}
+
+// replaces a column inside a key part
+func renameKeyColumn(key string, name string, newname string) string {
+	if !isExpressionKey(key) {
+		if key == name {
+			return newname
+		}
+		return key
+	}
+	return expressionKeyFromCode(renameSymbol(scm.StripSourceInfo(scm.Read("index", key)), false, name, newname))
+}
+
+func renameSymbol(v scm.Scmer, head bool, name string, newname string) scm.Scmer {
+	switch x := v.(type) {
+		case scm.Symbol:
+			if !head && string(x) == name {
+				return scm.Symbol(newname)
+			}
+		case []scm.Scmer:
+			result := make([]scm.Scmer, len(x))
+			for i, y := range x {
+				result[i] = renameSymbol(y, i == 0, name, newname)
+			}
+			return result
+	}
+	return v
+}
+
+// computes the values of an expression key part over the main storage
+func (s *storageShard) computeExpression(key string) ColumnStorage {
+	inputCols := keyColumns(key)
+	params := make([]scm.Scmer, len(inputCols))
+	cols := make([]ColumnStorage, len(inputCols))
+	for i, col := range inputCols {
+		var ok bool
+		cols[i], ok = s.columns[col]
+		if !ok {
+			panic("column " + s.t.Name + "." + col + " does not exist")
+		}
+		params[i] = scm.Symbol(col)
+	}
+	computor := scm.Eval([]scm.Scmer{scm.Symbol("lambda"), params, scm.StripSourceInfo(scm.Read("index", key))}, &scm.Globalenv)
+	result := new(StorageSCMER)
+	result.values = computeValues(cols, s.main_count, computor)
+	return result
+}
+
+// key parts of an index declaration: column names or expressions over columns
+func indexKeyList(v scm.Scmer) []string {
+	list := v.([]scm.Scmer)
+	result := make([]string, len(list))
+	for i, key := range list {
+		switch key.(type) {
+			case []scm.Scmer, scm.SourceInfo:
+				result[i] = expressionKeyFromCode(key)
+			default:
+				result[i] = scm.String(key)
+		}
+	}
+	return result
+}
+
+// drops boundaries over expressions that no declared index provides; implicit indexes are only built over plain columns
+func (t *table) indexableBoundaries(cols boundaries) boundaries {
+	result := cols[:0]
+	nextcol:
+	for _, b := range cols {
+		if isExpressionKey(b.col) {
+			for _, index := range t.Indexes {
+				for _, key := range index.Cols {
+					if key == b.col {
+						result = append(result, b)
+						continue nextcol
+					}
+				}
+			}
+			continue
+		}
+		result = append(result, b)
+	}
+	return result
+}
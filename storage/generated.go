@@ -0,0 +1,319 @@
+/*
+Copyright (C) 2024  Carl-Philip Hänsch
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package storage
+
+import "io"
+import "os"
+import "fmt"
+import "strings"
+import "github.com/launix-de/memcp/scm"
+
+/*
+
+computed columns:
+ - the computor of a GENERATED column is persisted as scm source together with its input columns
+ - computed caches (created by the query planner via createcolumn) are computed once over the main storage;
+   their computors are temporary closures of the query plan, so they are neither serialized nor managed by the LRU
+ - GENERATED ALWAYS AS (expr) STORED columns are computed on insert and update and stored like normal columns
+ - GENERATED ALWAYS AS (expr) VIRTUAL columns are also computed on insert and update, but their main storage is
+   a StorageComputed that evaluates the expression on read; the rebuild materializes the values of virtual columns
+   that were read since the last rebuild and drops the values of unused ones
+
+*/
+
+// main storage of a VIRTUAL column: values are computed from the input columns unless they are materialized
+type StorageComputed struct {
+	inputs []ColumnStorage
+	computor scm.Scmer
+	cache ColumnStorage // materialized values or nil
+}
+
+func (s *StorageComputed) GetValue(i uint) scm.Scmer {
+	if s.cache != nil {
+		return s.cache.GetValue(i)
+	}
+	args := make([]scm.Scmer, len(s.inputs))
+	for j, col := range s.inputs {
+		args[j] = col.GetValue(i)
+	}
+	return scm.Apply(s.computor, args...)
+}
+
+func (s *StorageComputed) String() string {
+	if s.cache != nil {
+		return "computed " + s.cache.String()
+	}
+	return "computed"
+}
+
+func (s *StorageComputed) Size() uint {
+	if s.cache != nil {
+		return s.cache.Size()
+	}
+	return uint(len(s.inputs)) * 16
+}
+
+// virtual columns are never built by the compression loop; rebuild creates them from the other columns
+func (s *StorageComputed) prepare() {}
+func (s *StorageComputed) scan(i uint, value scm.Scmer) {}
+func (s *StorageComputed) proposeCompression(i uint) ColumnStorage { return nil }
+func (s *StorageComputed) init(i uint) {}
+func (s *StorageComputed) build(i uint, value scm.Scmer) {}
+func (s *StorageComputed) finish() {}
+
+func (s *StorageComputed) Serialize(f io.Writer) {
+	if s.cache != nil {
+		s.cache.Serialize(f) // materialized values are loaded as cache again
+	}
+}
+func (s *StorageComputed) Deserialize(f io.Reader) uint {
+	return 0 // not registered in storages
+}
+
+// compiles the persisted computors after load; computed caches whose source can't be compiled become normal columns
+func (t *table) compileComputors() {
+	for i, c := range t.Columns {
+		if c.ComputorSource == "" {
+			continue
+		}
+		func () {
+			defer func () {
+				if r := recover(); r != nil {
+					fmt.Println("warning: cannot compile computor of column", t.Name + "." + c.Name + ":", r)
+					t.Columns[i].Computor = nil
+				}
+			}()
+			t.Columns[i].Computor = scm.Eval(scm.Read("computor", c.ComputorSource), &scm.Globalenv)
+		}()
+	}
+}
+
+// turns a column into a GENERATED ALWAYS AS column; code is the expression with column symbols; mode is STORED or VIRTUAL
+func (t *table) GenerateColumn(name string, cols []string, code scm.Scmer, mode string) {
+	mode = strings.ToUpper(mode)
+	if mode == "" {
+		mode = "VIRTUAL" // MySQL's default
+	}
+	if mode != "STORED" && mode != "VIRTUAL" {
+		panic("unknown generated column mode " + mode)
+	}
+	params := make([]scm.Scmer, len(cols))
+	for i, col := range cols {
+		if col == name {
+			panic("Generated column '" + name + "' cannot refer to itself")
+		}
+		params[i] = scm.Symbol(col)
+	}
+	source := scm.SerializeToString([]scm.Scmer{scm.Symbol("lambda"), params, code}, &scm.Globalenv)
+	t.schema.schemalock.Lock()
+	found := false
+	for i, c := range t.Columns {
+		if c.Name == name {
+			t.Columns[i].Generated = mode
+			t.Columns[i].ComputorCols = cols
+			t.Columns[i].ComputorSource = source // only GENERATED columns are persisted
+			found = true
+		}
+	}
+	for _, col := range cols {
+		exists := false
+		for _, c := range t.Columns {
+			if c.Name == col {
+				exists = true
+			}
+		}
+		if !exists {
+			t.schema.schemalock.Unlock()
+			panic("column " + t.Name + "." + col + " does not exist")
+		}
+	}
+	if found {
+		t.schema.save()
+	}
+	t.schema.schemalock.Unlock()
+	if !found {
+		panic("column " + t.Name + "." + name + " does not exist")
+	}
+	t.ComputeColumn(name, cols, scm.Eval(scm.Read("computor", source), &scm.Globalenv))
+}
+
+// adds the GENERATED columns to inserted rows
+func (t *table) computeGenerated(columns []string, values [][]scm.Scmer) ([]string, [][]scm.Scmer) {
+	if !t.hasGenerated() {
+		return columns, values // fast path: table without generated columns
+	}
+	newcolumns := columns
+	for _, c := range t.Columns {
+		if c.Generated == "" || c.Computor == nil {
+			continue
+		}
+		found := false
+		for i, col := range newcolumns {
+			if col == c.Name {
+				found = true
+				for _, row := range values {
+					if i < len(row) && row[i] != nil { // NULL stands for DEFAULT
+						panic("The value specified for generated column '" + c.Name + "' in table '" + t.Name + "' is not allowed")
+					}
+				}
+			}
+		}
+		if !found {
+			if len(newcolumns) == len(columns) {
+				newcolumns = append([]string{}, columns...)
+			}
+			newcolumns = append(newcolumns, c.Name)
+		}
+	}
+	newvalues := make([][]scm.Scmer, len(values))
+	for r, row := range values {
+		newrow := make([]scm.Scmer, len(newcolumns))
+		copy(newrow, row)
+		newvalues[r] = newrow
+	}
+	t.fillGenerated(newcolumns, newvalues)
+	return newcolumns, newvalues
+}
+
+func (t *table) hasGenerated() bool {
+	for _, c := range t.Columns {
+		if c.Generated != "" && c.Computor != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// recomputes the GENERATED columns of complete rows in place (in column order, so generated columns may use earlier ones)
+func (t *table) fillGenerated(columns []string, values [][]scm.Scmer) {
+	colidx := func(name string) int {
+		for i, col := range columns {
+			if col == name {
+				return i
+			}
+		}
+		return -1
+	}
+	for _, c := range t.Columns {
+		if c.Generated == "" || c.Computor == nil {
+			continue
+		}
+		target := colidx(c.Name)
+		if target < 0 {
+			continue
+		}
+		inputs := make([]int, len(c.ComputorCols))
+		for i, col := range c.ComputorCols {
+			inputs[i] = colidx(col)
+		}
+		args := make([]scm.Scmer, len(inputs))
+		for _, row := range values {
+			for i, j := range inputs {
+				if j >= 0 && j < len(row) {
+					args[i] = row[j]
+				} else {
+					args[i] = nil
+				}
+			}
+			row[target] = scm.Apply(c.Computor, args...)
+		}
+	}
+}
+
+// returns a generated column that is computed from the given column or ""
+func (t *table) generatedDependency(name string) string {
+	for _, c := range t.Columns {
+		if c.Computor != nil && c.Generated != "" {
+			for _, col := range c.ComputorCols {
+				if col == name {
+					return c.Name
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// wraps the main storage of VIRTUAL columns into StorageComputed; values that are already built are kept as cache
+func (s *storageShard) virtualizeColumns() {
+	for _, c := range s.t.Columns {
+		if c.Generated != "VIRTUAL" || c.Computor == nil {
+			continue
+		}
+		sc, ok := s.columns[c.Name].(*StorageComputed)
+		if !ok {
+			sc = new(StorageComputed)
+			if cache, ok := s.columns[c.Name]; ok {
+				if _, empty := cache.(*StorageSparse); !empty || s.main_count == 0 {
+					sc.cache = cache
+				}
+			}
+			s.columns[c.Name] = sc
+		}
+		sc.computor = c.Computor
+	}
+	// inputs are resolved after wrapping, so virtual columns may use other virtual columns
+	for _, c := range s.t.Columns {
+		if sc, ok := s.columns[c.Name].(*StorageComputed); ok {
+			sc.inputs = make([]ColumnStorage, len(c.ComputorCols))
+			for i, col := range c.ComputorCols {
+				sc.inputs[i] = s.columns[col]
+			}
+		}
+	}
+}
+
+// marks VIRTUAL columns as used for the LRU statistics
+func (t *table) touchComputed(cols []string) {
+	for _, col := range cols {
+		for _, c := range t.Columns {
+			if c.Name == col && c.Generated == "VIRTUAL" {
+				t.computedReads.Store(col, true)
+			}
+		}
+	}
+}
+
+// LRU step of the rebuild (inside t.mu): drops the values of VIRTUAL columns that were not read since the last rebuild
+func (t *table) dropUnusedComputed() {
+	for _, c := range t.Columns {
+		if c.Computor == nil || c.Generated != "VIRTUAL" {
+			continue // planner caches and STORED columns keep their values
+		}
+		_, used := t.computedReads.LoadAndDelete(c.Name)
+		t.iterateShards(nil, func (s *storageShard) {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			sc, ok := s.columns[c.Name].(*StorageComputed)
+			if !ok {
+				return
+			}
+			if used && sc.cache == nil {
+				// read since the last rebuild: materialize
+				store := new(StorageSCMER)
+				store.values = computeValues(sc.inputs, s.main_count, sc.computor)
+				sc.cache = store
+			} else if !used && sc.cache != nil {
+				// unused: compute on read again
+				sc.cache = nil
+				if t.PersistencyMode != Memory {
+					os.Remove(t.schema.path + s.uuid.String() + "-" + ProcessColumnName(c.Name))
+				}
+			}
+		})
+	}
+}
@@ -19,11 +19,14 @@ package storage
 
 import "fmt"
 import "sort"
+import "strings"
 import "sync"
 import "reflect"
 import "github.com/google/btree"
 import "github.com/launix-de/memcp/scm"
 
+const indexSavingsThreshold = 2.0 // building an index costs 1x the time as traversing the list
+
 type indexPair struct {
 	itemid int // -1 for reference items
 	data []scm.Scmer
@@ -34,6 +37,7 @@ type StorageIndex struct {
 	Savings float64 // store the amount of time savings here -> add selectivity (outputted / size) on each
 	mainIndexes StorageInt // we can do binary searches here
 	deltaBtree *btree.BTreeG[indexPair]
+	cols []ColumnStorage // storage of the key parts; expressions are computed when the index is built
 	t *storageShard
 	active bool
 	mu sync.Mutex
@@ -103,12 +107,13 @@ func (t *storageShard) iterateIndex(cols boundaries, lower []scm.Scmer, upperLas
 		// if the index is inactive, use the other one
 		retry_indexscan:
 		old_indexes := t.Indexes
+		nextindex:
 		for _, index := range old_indexes {
 			// naive index search algo; TODO: improve
 			if len(index.Cols) >= len(lower) {
 				for i := 0; i < len(lower); i++ {
 					if cols[i].col != index.Cols[i] {
-						continue // this index does not fit
+						continue nextindex // this index does not fit
 					}
 				}
 				// this index fits!
@@ -129,6 +134,10 @@ func (t *storageShard) iterateIndex(cols boundaries, lower []scm.Scmer, upperLas
 			index.Cols[i] = cols[i].col
 		}
 		index.Savings = 0.0 // count how many cost we wasted so we decide when to build the index
+		if declared := t.t.declaredIndex(index.Cols); declared != nil {
+			index.Cols = append([]string{}, declared.Cols...) // declared indexes are built over all their columns right away
+			index.Savings = indexSavingsThreshold
+		}
 		index.active = false // tell the engine that index has to be built first
 		index.t = t
 		t.Indexes = append(t.Indexes, index)
@@ -156,20 +165,93 @@ func rebuildIndexes(t1 *storageShard, t2 *storageShard) {
 	// (also consider incremental indexes??)
 }
 
-// iterate over index
-func (s *StorageIndex) iterate(lower []scm.Scmer, upperLast scm.Scmer, maxInsertIndex int, callback func(uint)) {
-
-	// find columns in storage
+// sorts the main storage and fills the delta btree; this happens inside the shard's read lock
+func (s *StorageIndex) build() {
+	s.mu.Lock()
+	if s.active {
+		// someone has built it in the meantime
+		s.mu.Unlock()
+		return
+	}
+	fmt.Println("building index on", s.t.t.Name, "over", s.Cols)
 	cols := make([]ColumnStorage, len(s.Cols))
 	for i, c := range s.Cols {
-		cols[i] = s.t.columns[c]
+		if isExpressionKey(c) {
+			cols[i] = s.t.computeExpression(c)
+		} else {
+			cols[i] = s.t.columns[c]
+		}
 	}
+	s.cols = cols
 
-	savings_threshold := 2.0 // building an index costs 1x the time as traversing the list
+	// main storage
+	tmp := make([]uint, s.t.main_count)
+	for i := uint(0); i < s.t.main_count; i++ {
+		tmp[i] = i // fill with natural order
+	}
+	// sort indexes
+	sort.Slice(tmp, func (i, j int) bool {
+		for _, c := range cols {
+			a := c.GetValue(tmp[i])
+			b := c.GetValue(tmp[j])
+			if scm.Less(a, b) {
+				return true // less
+			} else if !reflect.DeepEqual(a, b) {
+				return false // greater
+			}
+			// otherwise: next iteration
+		}
+		return false // fully equal
+	})
+	// store sorted values into compressed format
+	s.mainIndexes.prepare()
+	for i, v := range tmp {
+		s.mainIndexes.scan(uint(i), v)
+	}
+	s.mainIndexes.init(uint(len(tmp)))
+	for i, v := range tmp {
+		s.mainIndexes.build(uint(i), v)
+	}
+	s.mainIndexes.finish()
+
+	// delta storage
+	s.deltaBtree = btree.NewG[indexPair](8, func (i, j indexPair) bool {
+		for _, col := range s.Cols {
+			colpos, ok := s.t.deltaColumns[col]
+			if !ok {
+				continue // non-existing column -> don't compare
+			}
+			var a, b scm.Scmer
+			if colpos < len(i.data) {
+				a = i.data[colpos]
+			}
+			if colpos < len(j.data) {
+				b = j.data[colpos]
+			}
+			if scm.Less(a, b) {
+				return true // less
+			} else if !reflect.DeepEqual(a, b) {
+				return false // greater
+			}
+			// otherwise: next iteration
+		}
+		return false // fully equal
+	})
+	// fill deltaBtree (no locking required; we are already in a readlock)
+	for i, data := range s.t.inserts {
+		s.deltaBtree.ReplaceOrInsert(indexPair{i, data})
+	}
+
+	s.active = true // mark as ready
+	s.mu.Unlock()
+}
+
+// iterate over index
+func (s *StorageIndex) iterate(lower []scm.Scmer, upperLast scm.Scmer, maxInsertIndex int, callback func(uint)) {
 	s.Savings = s.Savings + 1.0 // mark that we could save time
 	if !s.active {
 		// index is not built yet
-		if s.Savings < savings_threshold {
+		if s.Savings < indexSavingsThreshold {
 			// iterate over all items because we don't want to store the index
 			for i := uint(0); i < s.t.main_count; i++ {
 				callback(i)
@@ -178,79 +260,10 @@ func (s *StorageIndex) iterate(lower []scm.Scmer, upperLast scm.Scmer, maxInsert
 				callback(s.t.main_count + uint(i))
 			}
 			return
-		} else {
-			// rebuild index
-			s.mu.Lock()
-			if s.active {
-				// someone has built it in the meantime
-				s.mu.Unlock()
-				goto start_scan
-			}
-			fmt.Println("building index on", s.t.t.Name, "over", s.Cols)
-
-			// main storage
-			tmp := make([]uint, s.t.main_count)
-			for i := uint(0); i < s.t.main_count; i++ {
-				tmp[i] = i // fill with natural order
-			}
-			// sort indexes
-			sort.Slice(tmp, func (i, j int) bool {
-				for _, c := range cols {
-					a := c.GetValue(tmp[i])
-					b := c.GetValue(tmp[j])
-					if scm.Less(a, b) {
-						return true // less
-					} else if !reflect.DeepEqual(a, b) {
-						return false // greater
-					}
-					// otherwise: next iteration
-				}
-				return false // fully equal
-			})
-			// store sorted values into compressed format
-			s.mainIndexes.prepare()
-			for i, v := range tmp {
-				s.mainIndexes.scan(uint(i), v)
-			}
-			s.mainIndexes.init(uint(len(tmp)))
-			for i, v := range tmp {
-				s.mainIndexes.build(uint(i), v)
-			}
-			s.mainIndexes.finish()
-
-			// delta storage
-			s.deltaBtree = btree.NewG[indexPair](8, func (i, j indexPair) bool {
-				for _, col := range s.Cols {
-					colpos, ok := s.t.deltaColumns[col]
-					if !ok {
-						continue // non-existing column -> don't compare
-					}
-					var a, b scm.Scmer
-					if colpos < len(i.data) {
-						a = i.data[colpos]
-					}
-					if colpos < len(j.data) {
-						b = j.data[colpos]
-					}
-					if scm.Less(a, b) {
-						return true // less
-					} else if !reflect.DeepEqual(a, b) {
-						return false // greater
-					}
-					// otherwise: next iteration
-				}
-				return false // fully equal
-			})
-			// fill deltaBtree (no locking required; we are already in a readlock)
-			for i, data := range s.t.inserts {
-				s.deltaBtree.ReplaceOrInsert(indexPair{i, data})
-			}
-
-			s.active = true // mark as ready
-			s.mu.Unlock()
 		}
+		s.build()
 	}
-	start_scan:
+	cols := s.cols[:len(lower)] // an index over more columns is searched by its prefix
 
 	// bisect where the lower bound is found
 	idx := sort.Search(int(s.t.main_count), func (idx int) bool {
@@ -323,3 +336,195 @@ func (s *StorageIndex) iterate(lower []scm.Scmer, upperLast scm.Scmer, maxInsert
 		}
 	}
 }
+
+/*
+
+declared indexes:
+ - CREATE INDEX declares an index in the table schema; every shard builds it right away
+ - shards that are created later (rebuild, repartitioning) build the declared index on the first scan
+   that can use it, regardless of the savings heuristic
+ - implicit indexes that the engine creates on its own are listed by SHOW INDEX, but not persisted
+
+*/
+
+// returns the declared index that starts with cols
+func (t *table) declaredIndex(cols []string) *tableIndex {
+	nextindex:
+	for i, index := range t.Indexes {
+		if len(index.Cols) < len(cols) {
+			continue
+		}
+		for j, col := range cols {
+			if index.Cols[j] != col {
+				continue nextindex
+			}
+		}
+		return &t.Indexes[i]
+	}
+	return nil
+}
+
+// returns the index over exactly these columns or adds it to the shard
+func (t *storageShard) addIndex(cols []string, savings float64) *StorageIndex {
+	t.indexMutex.Lock()
+	defer t.indexMutex.Unlock()
+	for _, index := range t.Indexes {
+		if reflect.DeepEqual(index.Cols, cols) {
+			return index
+		}
+	}
+	index := new(StorageIndex)
+	index.Cols = append([]string{}, cols...)
+	index.Savings = savings
+	index.active = false
+	index.t = t
+	t.Indexes = append(append([]*StorageIndex{}, t.Indexes...), index) // copy, so running scans keep their list
+	return index
+}
+
+func (t *table) CreateIndex(id string, cols []string, ifnotexists bool) bool {
+	t.schema.schemalock.Lock()
+	for _, index := range t.Indexes {
+		if index.Id == id {
+			t.schema.schemalock.Unlock()
+			if ifnotexists {
+				return false
+			}
+			panic("Index " + id + " already exists in table " + t.Name)
+		}
+	}
+	for _, key := range cols {
+		for _, col := range keyColumns(key) {
+			found := false
+			for _, c := range t.Columns {
+				if c.Name == col {
+					found = true
+				}
+			}
+			if !found {
+				t.schema.schemalock.Unlock()
+				panic("column " + t.Name + "." + col + " does not exist")
+			}
+		}
+	}
+	t.Indexes = append(t.Indexes, tableIndex{id, cols})
+	t.schema.save()
+	t.schema.schemalock.Unlock()
+
+	// build the index in all shards
+	t.iterateShards(nil, func (s *storageShard) {
+		s.mu.RLock()
+		s.addIndex(cols, indexSavingsThreshold).build()
+		s.mu.RUnlock()
+	})
+	return true
+}
+
+func (t *table) DropIndex(id string, ifexists bool) bool {
+	t.schema.schemalock.Lock()
+	defer t.schema.schemalock.Unlock()
+	for i, index := range t.Indexes {
+		if index.Id == id {
+			t.Indexes = append(t.Indexes[:i:i], t.Indexes[i+1:]...)
+			t.schema.save()
+			// free the shard indexes; the engine may create them again if it finds them useful
+			t.iterateShards(nil, func (s *storageShard) {
+				s.indexMutex.Lock()
+				indexes := make([]*StorageIndex, 0, len(s.Indexes))
+				for _, index2 := range s.Indexes {
+					if !reflect.DeepEqual(index2.Cols, index.Cols) {
+						indexes = append(indexes, index2)
+					}
+				}
+				s.Indexes = indexes
+				s.indexMutex.Unlock()
+			})
+			return true
+		}
+	}
+	if ifexists {
+		return false
+	}
+	panic("Index " + id + " does not exist in table " + t.Name)
+}
+
+// removes a dropped column from the declared indexes (like MySQL does) and frees all shard indexes that use it
+func (t *table) dropIndexColumn(name string) {
+	indexes := make([]tableIndex, 0, len(t.Indexes))
+	for _, index := range t.Indexes {
+		cols := make([]string, 0, len(index.Cols))
+		for _, col := range index.Cols {
+			if !keyUsesColumn(col, name) {
+				cols = append(cols, col)
+			}
+		}
+		if len(cols) > 0 {
+			indexes = append(indexes, tableIndex{index.Id, cols})
+		}
+	}
+	t.Indexes = indexes
+	t.iterateShards(nil, func (s *storageShard) {
+		s.indexMutex.Lock()
+		indexes := make([]*StorageIndex, 0, len(s.Indexes))
+		nextindex:
+		for _, index := range s.Indexes {
+			for _, col := range index.Cols {
+				if keyUsesColumn(col, name) {
+					continue nextindex
+				}
+			}
+			indexes = append(indexes, index)
+		}
+		s.Indexes = indexes
+		s.indexMutex.Unlock()
+	})
+}
+
+// lists unique keys, declared and implicit indexes like MySQL's SHOW INDEX (one row per column)
+func (t *table) ShowIndexes() scm.Scmer {
+	result := make([]scm.Scmer, 0)
+	addIndex := func(id string, unique bool, cols []string, typ string, comment string) {
+		nonunique := float64(1)
+		if unique {
+			nonunique = 0
+		}
+		for i, col := range cols {
+			var column, expression scm.Scmer = col, nil
+			if isExpressionKey(col) {
+				column, expression = nil, sqlKeyExpression(col) // like MySQL's functional key parts
+			}
+			result = append(result, []scm.Scmer{"Table", t.Name, "Non_unique", nonunique, "Key_name", id, "Seq_in_index", float64(i + 1), "Column_name", column, "Index_type", typ, "Comment", comment, "Expression", expression})
+		}
+	}
+	// count in how many shards an index is built
+	shardlist := t.Shards
+	if shardlist == nil {
+		shardlist = t.PShards
+	}
+	built := make(map[string]int)
+	var implicit [][]string
+	for _, s := range shardlist {
+		for _, index := range s.Indexes {
+			key := strings.Join(index.Cols, ",")
+			if _, ok := built[key]; !ok {
+				if declared := t.declaredIndex(index.Cols); declared == nil || len(declared.Cols) != len(index.Cols) {
+					implicit = append(implicit, index.Cols)
+				}
+				built[key] = 0
+			}
+			if index.active {
+				built[key]++
+			}
+		}
+	}
+	for _, u := range t.Unique {
+		addIndex(u.Id, true, u.Cols, "HASH", "")
+	}
+	for _, index := range t.Indexes {
+		addIndex(index.Id, false, index.Cols, "BTREE", fmt.Sprintf("built in %d of %d shards", built[strings.Join(index.Cols, ",")], len(shardlist)))
+	}
+	for _, cols := range implicit {
+		addIndex("auto_" + strings.Join(cols, "_"), false, cols, "BTREE", fmt.Sprintf("automatic, built in %d of %d shards", built[strings.Join(cols, ",")], len(shardlist)))
+	}
+	return result
+}
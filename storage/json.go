@@ -26,65 +26,265 @@ JSON storage on disk for persistence:
  - a line can also say #update <recordid> json
  - on rewrite, db/_table.jsonl is rebuild and replaced (maybe once a week)
 
+import:
+ - <recordid> is the JSON value of the primary key (or the first unique key); composite keys are written as JSON array
+ - #update only changes the columns that are present in the json object
+ - rows are inserted in batches; a batch ends when the set of columns changes or a directive follows
+ - columns are created as soon as they occur; nested objects are stored as JSON text
+   or flattened into dotted columns like address.city
+ - lines that can't be imported are skipped and reported with their line number
+
 */
 
+import "io"
 import "os"
+import "fmt"
+import "sort"
+import "sync"
 import "bufio"
+import "strings"
 import "encoding/json"
 import "github.com/launix-de/memcp/scm"
 
-func LoadJSON(schema, filename string) {
-	f, _ := os.Open(filename)
+type JSONOptions struct {
+	Flatten bool // nested objects become dotted columns
+	Table string // table of the rows before the first #table line
+	FixedTable bool // #table lines are rejected, so an upload only writes to Table
+}
+
+// reads the options list of loadJSON
+func ParseJSONOptions(list []scm.Scmer, options *JSONOptions) {
+	for i := 0; i + 1 < len(list); i += 2 {
+		switch scm.String(list[i]) {
+			case "flatten":
+				options.Flatten = scm.ToBool(list[i+1])
+			case "table":
+				options.Table = scm.String(list[i+1])
+			default:
+				panic("unknown option: " + scm.String(list[i]))
+		}
+	}
+}
+
+// state of a running JSONL import
+type jsonLoader struct {
+	schema string
+	options JSONOptions
+	t *table
+	known map[string]bool // columns of t that already exist
+	cols []string // columns of the buffered rows
+	buffer [][]scm.Scmer
+	lines []int // line of each buffered row
+	count int
+	errors []ImportError
+}
+
+// LoadJSON imports a .jsonl file; returns the number of inserted rows and the skipped lines
+func LoadJSON(schema, filename string, options JSONOptions) (int, []ImportError) {
+	f, err := os.Open(filename)
+	if err != nil {
+		panic(err)
+	}
 	defer f.Close()
-	scanner := bufio.NewScanner(f)
-	scanner.Split(bufio.ScanLines)
+	return ReadJSON(schema, f, options)
+}
 
-	lines := make(chan string, 512)
+func ReadJSON(schema string, r io.Reader, options JSONOptions) (int, []ImportError) {
+	if GetDatabase(schema) == nil {
+		panic("database " + schema + " does not exist")
+	}
+	l := jsonLoader{schema: schema, options: options}
+	if options.Table != "" {
+		l.t, _ = CreateTable(schema, options.Table, Safe, true)
+		l.known = make(map[string]bool)
+	}
+	reader := bufio.NewReaderSize(r, 1024 * 1024)
+	lineno := 0
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			panic(err)
+		}
+		if line == "" && err == io.EOF {
+			break
+		}
+		lineno++
+		l.process(lineno, strings.TrimRight(line, "\r\n"))
+		if err == io.EOF {
+			break
+		}
+	}
+	l.flush()
+	sort.SliceStable(l.errors, func (i, j int) bool {
+		return l.errors[i].Line < l.errors[j].Line // failed rows are reported when their batch is flushed, i.e. after the lines behind them
+	})
+	return l.count, l.errors
+}
 
-	go func () {
-		for scanner.Scan() {
-			lines <- scanner.Text()
+func (l *jsonLoader) process(lineno int, s string) {
+	defer func () {
+		if r := recover(); r != nil {
+			l.errors = append(l.errors, ImportError{lineno, fmt.Sprint(r)})
 		}
-		close(lines)
 	}()
+	if strings.TrimSpace(s) == "" {
+		return
+	} else if strings.HasPrefix(s, "#table ") {
+		// new table (or find the existing one)
+		if l.options.FixedTable {
+			panic("#table is not allowed here; rows are imported into table " + l.options.Table)
+		}
+		l.flush()
+		l.t, l.known = nil, make(map[string]bool)
+		l.t, _ = CreateTable(l.schema, strings.TrimSpace(s[7:]), Safe, true)
+	} else if strings.HasPrefix(s, "#delete ") {
+		l.flush()
+		dec := json.NewDecoder(strings.NewReader(s[8:]))
+		var id interface{}
+		if err := dec.Decode(&id); err != nil {
+			panic("invalid record id: " + err.Error())
+		}
+		l.modify(id, nil)
+	} else if strings.HasPrefix(s, "#update ") {
+		l.flush()
+		dec := json.NewDecoder(strings.NewReader(s[8:]))
+		var id interface{}
+		var changes map[string]interface{}
+		if err := dec.Decode(&id); err != nil {
+			panic("invalid record id: " + err.Error())
+		}
+		if err := dec.Decode(&changes); err != nil {
+			panic("invalid update: " + err.Error())
+		}
+		cols, values := l.row(changes)
+		list := make([]scm.Scmer, 0, 2 * len(cols))
+		for i, col := range cols {
+			list = append(list, col, values[i])
+		}
+		l.modify(id, list)
+	} else if s[0] == '#' {
+		// comment
+	} else {
+		var x map[string]interface{}
+		if err := json.Unmarshal([]byte(s), &x); err != nil {
+			panic("invalid JSON: " + err.Error())
+		}
+		if x == nil {
+			panic("line is not a JSON object")
+		}
+		cols, values := l.row(x)
+		if len(l.buffer) >= 4096 || strings.Join(cols, "\x00") != strings.Join(l.cols, "\x00") {
+			l.flush()
+		}
+		if len(l.buffer) == 0 {
+			l.cols = cols
+		}
+		l.buffer = append(l.buffer, values)
+		l.lines = append(l.lines, lineno)
+	}
+}
 
-	var t *table
-	for s := range(lines) {
-		if s == "" {
-			// ignore
-		} else if s[0:7] == "#table " {
-			// new table (or find the existing one)
-			t, _ = CreateTable(schema, s[7:], Safe, true)
-		} else if s[0] == '#' {
-			// comment
-		} else {
-			if t == nil {
-				panic("no table set")
-			} else {
-				if len(t.Columns) == 0 {
-					// JSON with an unknown table format -> create dummy cols
-					var x map[string]scm.Scmer
-					json.Unmarshal([]byte(s), &x) // parse JSON
-					for c, _ := range x {
-						// create column with dummy storage for next rebuild
-						t.CreateColumn(c, "ANY", []int{}, "AUTO CREATED")
-					}
-				}
-				func (t *table, s string) {
-					var y map[string]scm.Scmer
-					json.Unmarshal([]byte(s), &y) // parse JSON
-					cols := make([]string, len(y))
-					x := make([]scm.Scmer, len(y))
-					i := 0
-					for k, v := range y {
-						cols[i] = k
-						x[i] = v
-						i++
+// converts a JSON object into sorted columns and values; missing columns are created
+func (l *jsonLoader) row(x map[string]interface{}) ([]string, []scm.Scmer) {
+	if l.t == nil {
+		panic("no table set")
+	}
+	cols := make([]string, 0, len(x))
+	values := make(map[string]scm.Scmer, len(x))
+	var walk func(prefix string, x map[string]interface{})
+	walk = func(prefix string, x map[string]interface{}) {
+		for k, v := range x {
+			switch y := v.(type) {
+				case map[string]interface{}:
+					if l.options.Flatten {
+						walk(prefix + k + ".", y)
+						continue
 					}
-					t.Insert(cols, [][]scm.Scmer{x}, nil, nil, false) // put into table
-				}(t, s)
+					b, _ := json.Marshal(y)
+					v = string(b)
+				case []interface{}:
+					b, _ := json.Marshal(y)
+					v = string(b)
 			}
+			cols = append(cols, prefix + k)
+			values[prefix + k] = v
 		}
 	}
+	walk("", x)
+	sort.Strings(cols)
+	result := make([]scm.Scmer, len(cols))
+	for i, col := range cols {
+		if !l.known[col] {
+			// create column with dummy storage for next rebuild
+			l.t.CreateColumn(col, "ANY", []int{}, "")
+			l.known[col] = true
+		}
+		result[i] = values[col]
+	}
+	return cols, result
+}
+
+// inserts the buffered rows
+func (l *jsonLoader) flush() {
+	if len(l.buffer) == 0 {
+		return
+	}
+	buffer, lines := l.buffer, l.lines
+	l.buffer, l.lines = nil, nil
+	count, errors := l.t.importRows(l.cols, buffer, lines)
+	l.count += count
+	l.errors = append(l.errors, errors...)
 }
 
+// deletes (changes == nil) or updates the record with the given primary key
+func (l *jsonLoader) modify(id interface{}, changes []scm.Scmer) {
+	if l.t == nil {
+		panic("no table set")
+	}
+	var key []string
+	for _, u := range l.t.Unique {
+		if u.Id == "PRIMARY" || key == nil {
+			key = u.Cols
+		}
+	}
+	if key == nil {
+		panic("table " + l.t.Name + " has no primary key")
+	}
+	ids, ok := id.([]interface{})
+	if !ok {
+		ids = []interface{}{id}
+	}
+	if len(ids) != len(key) {
+		panic(fmt.Sprintf("record id must have %d values", len(key)))
+	}
+	// (lambda (k0 k1) (and (equal? k0 v0) (equal? k1 v1)))
+	params := make([]scm.Scmer, len(key))
+	body := []scm.Scmer{scm.Symbol("and")}
+	for i, v := range ids {
+		params[i] = scm.Symbol(fmt.Sprintf("k%d", i))
+		if v == nil {
+			body = append(body, []scm.Scmer{scm.Symbol("nil?"), params[i]})
+		} else {
+			body = append(body, []scm.Scmer{scm.Symbol("equal?"), params[i], v})
+		}
+	}
+	condition := scm.Eval([]scm.Scmer{scm.Symbol("lambda"), params, body}, &scm.Globalenv)
+	var mu sync.Mutex
+	count := 0
+	l.t.scan(key, condition, []string{"$update"}, func (a ...scm.Scmer) scm.Scmer {
+		update := a[0].(func(...scm.Scmer) scm.Scmer)
+		if changes == nil {
+			update()
+		} else {
+			update(changes)
+		}
+		mu.Lock()
+		count++
+		mu.Unlock()
+		return true
+	}, nil, nil, nil, false)
+	if count == 0 {
+		b, _ := json.Marshal(id)
+		panic("no record with id " + string(b))
+	}
+}
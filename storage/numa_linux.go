@@ -0,0 +1,72 @@
+/*
+Copyright (C) 2024  Carl-Philip Hänsch
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package storage
+
+import "os"
+import "fmt"
+import "unsafe"
+import "strconv"
+import "strings"
+import "syscall"
+
+const mpolPreferred = 1 // MPOL_PREFERRED from linux/mempolicy.h
+
+// returns the cpu list of each NUMA node (empty if the machine has no NUMA information)
+func numaNodes() (result [][]int) {
+	for i := 0; ; i++ {
+		data, err := os.ReadFile(fmt.Sprintf("/sys/devices/system/node/node%d/cpulist", i))
+		if err != nil {
+			return
+		}
+		result = append(result, parseCpuList(strings.TrimSpace(string(data))))
+	}
+}
+
+// parses lists like 0-3,8-11
+func parseCpuList(s string) (result []int) {
+	for _, part := range strings.Split(s, ",") {
+		if part == "" {
+			continue
+		}
+		lo, hi, found := strings.Cut(part, "-")
+		a, _ := strconv.Atoi(lo)
+		b := a
+		if found {
+			b, _ = strconv.Atoi(hi)
+		}
+		for cpu := a; cpu <= b; cpu++ {
+			result = append(result, cpu)
+		}
+	}
+	return
+}
+
+// binds the current OS thread to the cpus of a node and prefers memory from that node; call runtime.LockOSThread() before
+func pinThreadToNode(node int, cpus []int) {
+	var cpumask [16]uint64 // up to 1024 cpus
+	for _, cpu := range cpus {
+		if cpu < len(cpumask) * 64 {
+			cpumask[cpu / 64] |= 1 << (cpu % 64)
+		}
+	}
+	syscall.RawSyscall(syscall.SYS_SCHED_SETAFFINITY, 0, uintptr(len(cpumask) * 8), uintptr(unsafe.Pointer(&cpumask[0])))
+	var nodemask [16]uint64
+	if node < len(nodemask) * 64 {
+		nodemask[node / 64] |= 1 << (node % 64)
+		syscall.RawSyscall(syscall.SYS_SET_MEMPOLICY, mpolPreferred, uintptr(unsafe.Pointer(&nodemask[0])), uintptr(len(nodemask) * 64))
+	}
+}
@@ -22,24 +22,46 @@ import "sort"
 import "sync"
 import "time"
 import "runtime"
-import "github.com/jtolds/gls"
 import "github.com/launix-de/memcp/scm"
 
 type shardDimension struct {
 	Column string
 	NumPartitions int
 	Pivots []scm.Scmer
+	Interval float64 `json:",omitempty"` // time dimension: width of a partition in seconds; pivots are unix timestamps
+	Retention float64 `json:",omitempty"` // time dimension: partitions older than that many seconds are dropped (0 = keep forever)
+}
+
+// a partitioning schema together with its shards; swapped as a whole, so readers never combine
+// the dimensions of one schema with the shards of another
+type partitionSchema struct {
+	dims []shardDimension
+	shards []*storageShard
+}
+
+// publishes PDimensions and PShards to readers that don't hold t.mu; call after every change of them
+func (t *table) publishPartitioning() {
+	t.partitioning.Store(&partitionSchema{t.PDimensions, t.PShards})
+}
+
+// returns a consistent pair of PDimensions and PShards without taking t.mu
+func (t *table) currentPartitioning() ([]shardDimension, []*storageShard) {
+	if p := t.partitioning.Load(); p != nil {
+		return p.dims, p.shards
+	}
+	return t.PDimensions, t.PShards // never partitioned since load
 }
 
 // computes the index of a datapoint in PShards
 func computeShardIndex(schema []shardDimension, values []scm.Scmer) (result int) {
 	for i, sd := range schema {
 		// get slice idx of this dimension
+		value := sd.key(values[i])
 		min := 0 // greater equal min
 		max := sd.NumPartitions-1 // smaller than max
 		for min < max {
 			pivot := (min + max - 1) / 2
-			if scm.Less(values[i], sd.Pivots[pivot]) {
+			if scm.Less(value, sd.Pivots[pivot]) {
 				max = pivot
 			} else {
 				min = pivot + 1
@@ -52,50 +74,19 @@ func computeShardIndex(schema []shardDimension, values []scm.Scmer) (result int)
 
 func (t *table) iterateShards(boundaries []columnboundaries, callback func(*storageShard)) {
 	shards := t.Shards
-	var done sync.WaitGroup
-	if shards != nil {
-		done.Add(len(shards))
-		for _, s := range shards {
-			// iterateShardIndex will go
-			gls.Go(func(s *storageShard) func () {
-				return func() {
-					if s == nil {
-						fmt.Println("Warning: a shard is missing")
-						return
-					}
-					callback(s)
-					done.Done()
-				}
-			}(s))
-		}
-	} else {
-		iterateShardIndex(t.PDimensions, boundaries, t.PShards, callback, &done, false)
+	if shards == nil {
+		// only visit the partitions that may contain matching rows
+		shards = make([]*storageShard, 0)
+		dims, pshards := t.currentPartitioning()
+		iterateShardIndex(dims, boundaries, pshards, &shards)
 	}
-	done.Wait()
+	runOnShards(shards, callback) // parallel on the scan worker pool
 }
 
-// iterate over all shards parallely
-func iterateShardIndex(schema []shardDimension, boundaries []columnboundaries, shards []*storageShard, callback func(*storageShard), done *sync.WaitGroup, parallel bool) {
+// collects all shards whose partitions intersect with the boundaries
+func iterateShardIndex(schema []shardDimension, boundaries []columnboundaries, shards []*storageShard, result *[]*storageShard) {
 	if len(schema) == 0 {
-		if len(shards) == 1 && !parallel {
-			// execute without go
-			callback(shards[0])
-		} else {
-			done.Add(len(shards))
-			for _, s := range shards {
-				// iterateShardIndex will go
-				gls.Go(func(s *storageShard) func() {
-					return func() {
-						if s == nil {
-							fmt.Println("Warning: a shard is missing")
-							return
-						}
-						callback(s)
-						done.Done()
-					}
-				}(s))
-			}
-		}
+		*result = append(*result, shards...)
 		return
 	}
 	blockdim := 1 // shards[idx * blockdim:idx*blockdim+blockdim]
@@ -106,6 +97,7 @@ func iterateShardIndex(schema []shardDimension, boundaries []columnboundaries, s
 	for _, b := range boundaries {
 		if b.col == schema[0].Column {
 			// iterate this axis over boundaries
+			b.lower, b.upper = schema[0].key(b.lower), schema[0].key(b.upper)
 			min := 0
 			if b.lower != nil {
 				// lower bound is given -> find lowest part
@@ -152,7 +144,7 @@ func iterateShardIndex(schema []shardDimension, boundaries []columnboundaries, s
 
 			for i := min; i <= max; i++ {
 				// recurse over range
-				iterateShardIndex(schema[1:], boundaries, shards[i*blockdim:(i+1)*blockdim], callback, done, parallel || (min != max))
+				iterateShardIndex(schema[1:], boundaries, shards[i*blockdim:(i+1)*blockdim], result)
 			}
 			return // finish (don't run into next boundary, don't run into the all-loop)
 		}
@@ -160,7 +152,7 @@ func iterateShardIndex(schema []shardDimension, boundaries []columnboundaries, s
 
 	// else: no boundaries: iterate all
 	for i := 0; i < len(shards); i += blockdim {
-		iterateShardIndex(schema[1:], boundaries, shards[i:i+blockdim], callback, done, parallel || len(shards) >= blockdim)
+		iterateShardIndex(schema[1:], boundaries, shards[i:i+blockdim], result)
 	}
 }
 
@@ -232,12 +224,15 @@ func (t *table) proposerepartition(maincount uint) (shardCandidates []shardDimen
 	// reevaluate partitioning schema
 	for _, c := range t.Columns {
 		if c.PartitioningScore > 0 {
-			shardCandidates = append(shardCandidates, shardDimension{c.Name, c.PartitioningScore, nil})
+			shardCandidates = append(shardCandidates, shardDimension{c.Name, c.PartitioningScore, nil, 0, 0})
 		}
 	}
 	if len(shardCandidates) == 0 || Settings.PartitionMaxDimensions == 0 {
 		return
 	}
+	if len(t.PDimensions) > 0 && t.PDimensions[0].Interval > 0 {
+		return // time partitioned tables keep their schema; partitions are added on insert and dropped by retention
+	}
 
 	// sort for highest ranking column
 	sort.Slice(shardCandidates, func (i, j int) bool { // Less
@@ -251,7 +246,7 @@ func (t *table) proposerepartition(maincount uint) (shardCandidates []shardDimen
 	sf := 0.01 // scale factor
 	best := 100000000
 	bestSf := sf
-	desiredNumberOfShards := (2 * maincount) / Settings.ShardSize + 1 // TODO: find a balancing mechanism
+	desiredNumberOfShards := (2 * maincount) / Settings.ShardSize + 1 // maincount is the live item count, so shard sizes follow deletions too
 	for iter := 2; iter < 300; iter++ { // find perfect scale factor such that we get the best number of shards
 		deviation := 1
 		for _, sc := range shardCandidates {
@@ -260,7 +255,7 @@ func (t *table) proposerepartition(maincount uint) (shardCandidates []shardDimen
 		deviation -= int(desiredNumberOfShards)
 		if deviation < 0 {
 			if -deviation < best {
-				best, bestSf = deviation, sf
+				best, bestSf = -deviation, sf
 			}
 			// too few shards: increase sf
 			sf = sf * (1.0+1.0/float64(iter))
@@ -321,90 +316,51 @@ func (t *table) repartition(shardCandidates []shardDimension) {
 		oldshards = t.PShards
 	}
 
-	// collect all dataset IDs (this is done sequentially and takes ~4s for 8G of data)
+	// create the new shards locked, so writes forwarded to them wait until they are built
+	newshards := make([]*storageShard, totalShards)
+	for si := range newshards {
+		newshards[si] = NewShard(t)
+		newshards[si].mu.Lock()
+	}
+
+	// seal the old shards one by one and collect all dataset IDs (this is done sequentially and takes ~4s for 8G of data)
 	datasetids := make([][][]uint, totalShards) // newshard, oldshard, item
+	fill := make([]uint, totalShards) // recids already assigned per new shard
+	snapshots := make([]*shardSnapshot, len(oldshards)) // rows at seal time; the copy reads these without a lock
 	total_count := uint64(0)
 	for si, s := range oldshards {
-		s.mu.RLock()
+		s.mu.Lock() // block writes only while this shard is sealed
+		snapshots[si] = s.snapshot()
 		total_count += uint64(s.Count())
+		redirect := newShardRedirect(newshards, shardCandidates, s.main_count + uint(len(s.inserts)))
 		for idx, items := range s.partition(shardCandidates) {
 			if datasetids[idx] == nil {
 				datasetids[idx] = make([][]uint, len(oldshards))
 			}
 			datasetids[idx][si] = items
+			for k, recid := range items {
+				redirect.move(recid, idx, fill[idx] + uint(k))
+			}
+			fill[idx] += uint(len(items))
 		}
+		// from now on, inserts, updates and deletes on s are forwarded to the new shards
+		s.redirect = redirect
+		s.mu.Unlock()
 	}
 	// put values into shards
 	fmt.Println("moving data from", t.Name, len(oldshards), "into", totalShards,"shards")
-	newshards := make([]*storageShard, totalShards)
 	var done sync.WaitGroup
 	done.Add(totalShards)
-	progress := make(chan int, runtime.NumCPU() / 2) // don't go all at once, we don't have enough RAM
-	for i := 0; i < runtime.NumCPU() / 2; i++ {
+	workers := runtime.NumCPU() / 2 // don't go all at once, we don't have enough RAM
+	if workers < 1 {
+		workers = 1 // single core machines
+	}
+	progress := make(chan int, workers)
+	for i := 0; i < workers; i++ {
 		go func() { // threadpool with half of the cores
 			for si := range progress {
-				// create a new shard and put all data in
-				s := NewShard(t)
-				// directly build main storage from list, no delta
-				for _, items := range datasetids[si] {
-					s.main_count += uint(len(items))
-				}
-				// allocate only once
-				values := make([]scm.Scmer, s.main_count)
-				for _, col := range t.Columns {
-					// build the cache-optimized scmer list
-					var i uint // index and amount of items
-					for s2id, items := range datasetids[si] {
-						reader := oldshards[s2id].ColumnReader(col.Name)
-						for _, item := range items {
-							values[i] = reader(item) // call decompression only once; this uses more RAM at once but is way faster
-							i++
-						}
-					}
-
-					// compress into a new column
-					var newcol ColumnStorage = new(StorageSCMER)
-					for {
-						newcol.prepare()
-						for i, v := range values {
-							newcol.scan(uint(i), v)
-						}
-						newcol2 := newcol.proposeCompression(i)
-						if newcol2 == nil {
-							break // we found the optimal storage format
-						} else {
-							// redo scan phase with compression
-							//fmt.Printf("Compression with %T\n", newcol2)
-							newcol = newcol2
-						}
-					}
-					newcol.init(s.main_count) // allocate memory
-					for i, v := range values {
-						newcol.build(uint(i), v)
-					}
-					newcol.finish()
-					s.columns[col.Name] = newcol
-
-					// write to disc (only if required)
-					if s.t.PersistencyMode != Memory {
-						f, err := os.Create(s.t.schema.path + s.uuid.String() + "-" + ProcessColumnName(col.Name))
-						if err != nil {
-							panic(err)
-						}
-						newcol.Serialize(f) // col takes ownership of f, so they will defer f.Close() at the right time
-						f.Close()
-					}
-				}
-				newshards[si] = s
-
-				if s.t.PersistencyMode == Safe || s.t.PersistencyMode == Logged {
-					// open a logfile
-					f, err := os.OpenFile(s.t.schema.path + s.uuid.String() + ".log", os.O_RDWR|os.O_CREATE, 0750)
-					if err != nil {
-						panic(err)
-					}
-					s.logfile = f
-				}
+				t.fillShard(newshards[si], snapshots, datasetids[si])
+				newshards[si].mu.Unlock() // forwarded writes may now proceed
 				done.Done()
 			}
 		}()
@@ -415,18 +371,22 @@ func (t *table) repartition(shardCandidates []shardDimension) {
 	}
 	done.Wait()
 
-	for _, s := range oldshards {
-		// TODO: set next such that Inserts will be redirected
-		s.mu.RUnlock()
-	}
-
-	// verify transformation result
+	// verify transformation result (main storage only; forwarded writes live in the deltas)
 	total_count2 := uint64(0)
 	for _, s := range newshards {
-		total_count2 += uint64(s.Count())
+		total_count2 += uint64(s.main_count)
 	}
 	if total_count != total_count2 {
 		fmt.Println("error: aborted partitioning schema for ", t.Name, "after", time.Since(start), " because of inconsistency: before", total_count, "items, after", total_count2)
+		for _, s := range oldshards {
+			// the old shards have received all writes themselves, so just stop forwarding
+			s.mu.Lock()
+			s.redirect = nil
+			s.mu.Unlock()
+		}
+		for _, s := range newshards {
+			s.RemoveFromDisk()
+		}
 		return
 	}
 
@@ -437,6 +397,7 @@ func (t *table) repartition(shardCandidates []shardDimension) {
 	}
 	t.PShards = newshards
 	t.PDimensions = shardCandidates
+	t.publishPartitioning()
 
 	t.Shards = nil // now it's live!
 	fmt.Println("activated new partitioning schema for ", t.Name, "after", time.Since(start))
@@ -451,14 +412,76 @@ func (t *table) repartition(shardCandidates []shardDimension) {
 	}
 }
 
+// builds a new shard directly into main storage from a list of recids per source shard (no delta)
+func (t *table) buildShard(oldshards []*shardSnapshot, items [][]uint) *storageShard {
+	// create a new shard and put all data in (items[i] are the recids to take from oldshards[i])
+	s := NewShard(t)
+	t.fillShard(s, oldshards, items)
+	return s
+}
+
+// fills the main storage of an empty shard
+func (t *table) fillShard(s *storageShard, oldshards []*shardSnapshot, items [][]uint) {
+	// directly build main storage from list, no delta
+	for _, recids := range items {
+		s.main_count += uint(len(recids))
+	}
+	// allocate only once
+	values := make([]scm.Scmer, s.main_count)
+	for _, col := range t.Columns {
+		// build the cache-optimized scmer list
+		var i uint // index and amount of items
+		for s2id, recids := range items {
+			reader := oldshards[s2id].ColumnReader(col.Name)
+			for _, item := range recids {
+				values[i] = reader(item) // call decompression only once; this uses more RAM at once but is way faster
+				i++
+			}
+		}
+
+		// compress into a new column
+		var newcol ColumnStorage = new(StorageSCMER)
+		for {
+			newcol.prepare()
+			for i, v := range values {
+				newcol.scan(uint(i), v)
+			}
+			newcol2 := newcol.proposeCompression(i)
+			if newcol2 == nil {
+				break // we found the optimal storage format
+			} else {
+				// redo scan phase with compression
+				//fmt.Printf("Compression with %T\n", newcol2)
+				newcol = t.useGlobalDictionary(col.Name, newcol2)
+			}
+		}
+		newcol.init(s.main_count) // allocate memory
+		for i, v := range values {
+			newcol.build(uint(i), v)
+		}
+		newcol.finish()
+		s.columns[col.Name] = newcol
+
+		// write to disc (only if required)
+		if s.t.PersistencyMode != Memory {
+			f, err := os.Create(s.t.schema.path + s.uuid.String() + "-" + ProcessColumnName(col.Name))
+			if err != nil {
+				panic(err)
+			}
+			newcol.Serialize(f) // col takes ownership of f, so they will defer f.Close() at the right time
+			f.Close()
+		}
+	}
+	s.virtualizeColumns()
+
+	// the logfile has already been opened by NewShard
+}
+
 func (s *storageShard) partition(schema []shardDimension) (result map[int][]uint) {
 	// assigns each dataset into a target shard
 	result = make(map[int][]uint)
 
-	/* this is already done from outside and all locks are kept until the rebuild is done
-	s.mu.RLock() // TODO: somehow seal that shard such that future inserts/deletes are blocked or forwarded
-	defer s.mu.RUnlock()
-	*/
+	// this runs inside s.mu.Lock() from outside; afterwards the shard is sealed with a redirect
 	values := make([]scm.Scmer, len(schema))
 
 	/* collect main storage */
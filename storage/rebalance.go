@@ -0,0 +1,155 @@
+/*
+Copyright (C) 2024  Carl-Philip Hänsch
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package storage
+
+import "fmt"
+import "time"
+
+/*
+
+shard balancing (unpartitioned tables only):
+ - shards with at most half of ShardSize live items are merged with their neighbours
+ - shards with more than twice ShardSize live items are split into ShardSize pieces
+ - a replaced shard keeps a redirect (see redirect.go)
+
+*/
+
+// merges undersized shards and splits oversized shards; this happens inside t.mu.Lock()
+func (t *table) rebalance() {
+	if t.Shards == nil || len(t.Shards) < 1 || Settings.ShardSize < 2 {
+		return // partitioned tables are balanced by repartition
+	}
+	oldshards := t.Shards
+	counts := make([]uint, len(oldshards))
+	for i, s := range oldshards {
+		counts[i] = s.Count()
+	}
+	// the last shard is still filled by inserts, so it may be small
+	last := len(oldshards) - 1
+
+	// plan: each group of old shards becomes a list of new shard sizes
+	type group struct {
+		from, to int // oldshards[from:to]
+		pieces uint // number of new shards
+	}
+	groups := make([]group, 0)
+	changed := false
+	for i := 0; i < len(oldshards); {
+		if oldshards[i].next != nil || oldshards[i].redirect != nil {
+			groups = append(groups, group{i, i + 1, 0}) // busy with another rebuild: keep
+			i++
+			continue
+		}
+		if counts[i] > 2 * Settings.ShardSize {
+			// split
+			groups = append(groups, group{i, i + 1, (counts[i] + Settings.ShardSize - 1) / Settings.ShardSize})
+			changed = true
+			i++
+			continue
+		}
+		if counts[i] <= Settings.ShardSize / 2 && i < last {
+			// merge consecutive undersized shards as long as they fit into one shard
+			sum := counts[i]
+			j := i + 1
+			for j < last && oldshards[j].next == nil && oldshards[j].redirect == nil && counts[j] <= Settings.ShardSize / 2 && sum + counts[j] <= Settings.ShardSize {
+				sum += counts[j]
+				j++
+			}
+			if j - i >= 2 {
+				groups = append(groups, group{i, j, 1})
+				changed = true
+				i = j
+				continue
+			}
+		}
+		groups = append(groups, group{i, i + 1, 0}) // keep
+		i++
+	}
+	if !changed {
+		return
+	}
+
+	fmt.Println("rebalancing shards of", t.Name)
+	start := time.Now() // time measurement
+	newshards := make([]*storageShard, 0, len(oldshards))
+	var replaced []*storageShard
+	for _, g := range groups {
+		if g.pieces == 0 {
+			newshards = append(newshards, oldshards[g.from])
+			continue
+		}
+		sources := oldshards[g.from:g.to]
+		snapshots := make([]*shardSnapshot, len(sources))
+		for si, s := range sources {
+			s.mu.Lock() // block writes while the rows are copied
+			snapshots[si] = s.snapshot()
+		}
+		// collect live recids of all sources in order
+		recids := make([][]uint, len(sources))
+		var total uint
+		for si, s := range sources {
+			for idx := uint(0); idx < s.main_count + uint(len(s.inserts)); idx++ {
+				if !s.deletions.Get(idx) {
+					recids[si] = append(recids[si], idx)
+				}
+			}
+			total += uint(len(recids[si]))
+		}
+		// cut the rows into pieces of nearly equal size
+		pieceSize := (total + g.pieces - 1) / g.pieces
+		targets := make([]*storageShard, g.pieces) // shared by the redirects of all sources
+		redirects := make([]*shardRedirect, len(sources))
+		for si, s := range sources {
+			redirects[si] = newShardRedirect(targets, nil, s.main_count + uint(len(s.inserts)))
+		}
+		si, pos := 0, 0 // current source and position inside recids[si]
+		for p := uint(0); p < g.pieces; p++ {
+			items := make([][]uint, len(sources))
+			var n uint
+			for n < pieceSize && si < len(sources) {
+				take := len(recids[si]) - pos
+				if uint(take) > pieceSize - n {
+					take = int(pieceSize - n)
+				}
+				items[si] = recids[si][pos:pos+take]
+				// remember where this slice of the source went
+				for k, recid := range items[si] {
+					redirects[si].move(recid, int(p), n + uint(k))
+				}
+				n += uint(take)
+				pos += take
+				if pos == len(recids[si]) {
+					si++
+					pos = 0
+				}
+			}
+			targets[p] = t.buildShard(snapshots, items)
+			newshards = append(newshards, targets[p])
+		}
+		for si, s := range sources {
+			s.redirect = redirects[si]
+			s.mu.Unlock()
+			replaced = append(replaced, s)
+		}
+	}
+	t.Shards = newshards
+	for _, s := range replaced {
+		s.RemoveFromDisk()
+	}
+	t.schema.save()
+	fmt.Println("rebalanced", t.Name, "from", len(oldshards), "to", len(newshards), "shards in", time.Since(start))
+}
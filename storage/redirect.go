@@ -0,0 +1,157 @@
+/*
+Copyright (C) 2024  Carl-Philip Hänsch
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package storage
+
+import "github.com/launix-de/memcp/scm"
+
+/*
+
+shard redirects:
+ - when a shard is merged, split or repartitioned, it is sealed and gets a redirect
+ - every row of the sealed shard knows its successor shard and recid there
+ - inserts, updates and deletes that still reach the old shard (e.g. from a scan that
+   started before the switch) are forwarded to the successors
+ - successors that are still being built are locked, so forwarded writes wait for them
+
+all methods are called while the old shard holds its write lock
+
+the rows of a sealed shard are copied from a shardSnapshot that is taken under the seal lock:
+forwarded writes still append to the old shard's delta while it holds its write lock and waits
+for the (locked) successor, so the copy can neither read the live delta nor take the shard lock
+
+*/
+
+// read-only view of a shard's rows at the time it was sealed
+type shardSnapshot struct {
+	main_count uint
+	columns map[string]ColumnStorage
+	inserts [][]scm.Scmer // rows are never changed in place (ALTER builds new rows), so sharing them is safe
+	deltaColumns map[string]int
+}
+
+// captures the current rows of the shard; call with s.mu held
+func (s *storageShard) snapshot() *shardSnapshot {
+	result := new(shardSnapshot)
+	result.main_count = s.main_count
+	result.columns = make(map[string]ColumnStorage, len(s.columns))
+	for k, v := range s.columns {
+		result.columns[k] = v
+	}
+	result.inserts = s.inserts[:len(s.inserts):len(s.inserts)]
+	result.deltaColumns = make(map[string]int, len(s.deltaColumns))
+	for k, v := range s.deltaColumns {
+		result.deltaColumns[k] = v
+	}
+	return result
+}
+
+func (s *shardSnapshot) ColumnReader(col string) func(uint) scm.Scmer {
+	cstorage, ok := s.columns[col]
+	if !ok {
+		panic("Column does not exist: `" + col + "`")
+	}
+	colidx, inDelta := s.deltaColumns[col]
+	return func(idx uint) scm.Scmer {
+		if idx < s.main_count {
+			return cstorage.GetValue(idx)
+		}
+		item := s.inserts[idx - s.main_count]
+		if inDelta && colidx < len(item) {
+			return item[colidx]
+		}
+		return nil
+	}
+}
+
+type shardRedirect struct {
+	targets []*storageShard
+	schema []shardDimension // if set, new rows are routed by partitioning schema; otherwise they go to the last target
+	shardOf []int32 // old recid -> index into targets; -1 = row was already deleted
+	recidOf []uint // old recid -> recid in target
+}
+
+func newShardRedirect(targets []*storageShard, schema []shardDimension, sealed uint) *shardRedirect {
+	result := new(shardRedirect)
+	result.targets = targets
+	result.schema = schema
+	result.shardOf = make([]int32, sealed)
+	result.recidOf = make([]uint, sealed)
+	for i := range result.shardOf {
+		result.shardOf[i] = -1
+	}
+	return result
+}
+
+// remembers that a row of the old shard is now found at targets[target] under recid
+func (r *shardRedirect) move(idx uint, target int, recid uint) {
+	for uint(len(r.shardOf)) <= idx {
+		r.shardOf = append(r.shardOf, -1)
+		r.recidOf = append(r.recidOf, 0)
+	}
+	r.shardOf[idx] = int32(target)
+	r.recidOf[idx] = recid
+}
+
+func (r *shardRedirect) delete(idx uint) {
+	if idx < uint(len(r.shardOf)) && r.shardOf[idx] >= 0 {
+		r.targets[r.shardOf[idx]].UpdateFunction(r.recidOf[idx], false)()
+		r.shardOf[idx] = -1
+	}
+}
+
+// forwards rows that have just been appended to old's delta storage
+func (r *shardRedirect) insert(old *storageShard, columns []string, values [][]scm.Scmer) {
+	base := old.main_count + uint(len(old.inserts)) - uint(len(values)) // old recid of values[0]
+	if r.schema == nil {
+		first := r.targets[len(r.targets)-1].insertRecid(columns, values)
+		for i := range values {
+			r.move(base + uint(i), len(r.targets)-1, first + uint(i))
+		}
+		return
+	}
+	// route each row into its partition
+	dimcols := make([]int, len(r.schema))
+	for i, sd := range r.schema {
+		dimcols[i] = -1
+		for j, col := range columns {
+			if col == sd.Column {
+				dimcols[i] = j
+			}
+		}
+	}
+	dimvalues := make([]scm.Scmer, len(r.schema))
+	for i, row := range values {
+		for j, c := range dimcols {
+			if c >= 0 {
+				dimvalues[j] = row[c]
+			} else {
+				dimvalues[j] = nil
+			}
+		}
+		target := computeShardIndex(r.schema, dimvalues)
+		r.move(base + uint(i), target, r.targets[target].insertRecid(columns, values[i:i+1]))
+	}
+}
+
+// inserts into a shard and returns the recid of the first inserted row
+func (t *storageShard) insertRecid(columns []string, values [][]scm.Scmer) uint {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	result := t.main_count + uint(len(t.inserts))
+	t.Insert(columns, values, true)
+	return result
+}
@@ -43,7 +43,9 @@ type emptyResult struct {}
 // map reduce implementation based on scheme scripts
 func (t *table) scan(conditionCols []string, condition scm.Scmer, callbackCols []string, callback scm.Scmer, aggregate scm.Scmer, neutral scm.Scmer, aggregate2 scm.Scmer, isOuter bool) scm.Scmer {
 	/* analyze query */
-	boundaries := extractBoundaries(conditionCols, condition)
+	t.touchComputed(conditionCols)
+	t.touchComputed(callbackCols)
+	boundaries := t.indexableBoundaries(extractBoundaries(conditionCols, condition))
 	lower, upperLast := indexFromBoundaries(boundaries)
 	// give sharding hints
 	for _, b := range boundaries {
@@ -95,7 +95,9 @@ func (s *globalqueue) Pop() any {
 func (t *table) scan_order(conditionCols []string, condition scm.Scmer, sortcols []scm.Scmer, sortdirs []bool, offset int, limit int, callbackCols []string, callback scm.Scmer, aggregate scm.Scmer, neutral scm.Scmer, isOuter bool) scm.Scmer {
 
 	/* analyze condition query */
-	boundaries := extractBoundaries(conditionCols, condition)
+	t.touchComputed(conditionCols)
+	t.touchComputed(callbackCols)
+	boundaries := t.indexableBoundaries(extractBoundaries(conditionCols, condition))
 	lower, upperLast := indexFromBoundaries(boundaries)
 	// TODO: append sortcols to boundaries
 
@@ -0,0 +1,253 @@
+/*
+Copyright (C) 2024  Carl-Philip Hänsch
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package storage
+
+import "fmt"
+import "sync"
+import "time"
+import "runtime"
+import "strings"
+import "sync/atomic"
+import "github.com/docker/go-units"
+import "github.com/launix-de/memcp/scm"
+
+/*
+
+scan worker pool:
+ - Settings.ScanWorkers workers are spread over the NUMA nodes of the machine
+ - with Settings.NUMA, every worker is pinned to the cpus of its node and prefers node-local memory
+ - every shard is owned by a node; scans and rebuilds of that shard are queued on that node,
+   so the main storage is built and read by the same node
+ - unpinned, the caller helps with its own tasks that no worker has picked up yet; pinned, only
+   workers do that (nested scans inside scan callbacks), so shards are not scanned off-node by the
+   caller, but nested scans still can't deadlock when all workers are busy
+ - the memory policy only prefers the node for pages the thread faults in first; the Go heap is
+   shared by all threads, so node-local placement of main storage is best effort
+
+*/
+
+type scanTask struct {
+	claimed atomic.Bool
+	fn func()
+	done *sync.WaitGroup
+	err scm.Scmer // panic of fn, re-raised in the caller
+}
+
+// runs the task unless someone else has already claimed it
+func (task *scanTask) run() bool {
+	if !task.claimed.CompareAndSwap(false, true) {
+		return false
+	}
+	defer task.done.Done()
+	defer func() {
+		if r := recover(); r != nil {
+			task.err = r
+		}
+	}()
+	task.fn()
+	return true
+}
+
+type numaNode struct {
+	id int
+	cpus []int
+	queue chan *scanTask
+	workers int
+	tasks atomic.Uint64 // shard tasks run by the workers of this node
+	stolen atomic.Uint64 // shard tasks of this node that were run by the caller
+	busy atomic.Int64 // nanoseconds the workers spent in tasks
+}
+
+type scanPool struct {
+	nodes []*numaNode
+	pinned bool
+	quit chan struct{}
+}
+
+var currentScanPool atomic.Pointer[scanPool]
+var shardNodeCounter atomic.Uint32
+
+// (re)starts the worker pool according to Settings; old workers finish their current task and quit
+func startScanPool() {
+	workers := Settings.ScanWorkers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	var topology [][]int // cpus of each node
+	if Settings.NUMA {
+		topology = numaNodes()
+	}
+	nodecount := 1
+	if len(topology) > 1 {
+		nodecount = len(topology)
+	}
+	if nodecount > workers {
+		nodecount = workers // at least one worker per node
+	}
+	p := new(scanPool)
+	p.pinned = nodecount > 1
+	p.quit = make(chan struct{})
+	p.nodes = make([]*numaNode, nodecount)
+	for i := range p.nodes {
+		n := new(numaNode)
+		n.id = i
+		if p.pinned {
+			n.cpus = topology[i]
+		}
+		n.workers = workers / nodecount
+		if i < workers % nodecount {
+			n.workers++
+		}
+		n.queue = make(chan *scanTask, 1024)
+		p.nodes[i] = n
+		for j := 0; j < n.workers; j++ {
+			go p.worker(n)
+		}
+	}
+	if old := currentScanPool.Swap(p); old != nil {
+		close(old.quit) // tasks left in the old queues are run by the quitting workers or their callers
+	}
+}
+
+func getScanPool() *scanPool {
+	p := currentScanPool.Load()
+	if p == nil {
+		startScanPool()
+		p = currentScanPool.Load()
+	}
+	return p
+}
+
+func (p *scanPool) worker(n *numaNode) {
+	if p.pinned {
+		runtime.LockOSThread() // affinity and memory policy are per OS thread; never unlocked, so the pinned thread exits with the worker instead of returning to the scheduler
+		pinThreadToNode(n.id, n.cpus)
+		scm.WithGoroutineValue("scanworker", n.id, func() {
+			p.work(n)
+		})
+		return
+	}
+	p.work(n)
+}
+
+func (p *scanPool) work(n *numaNode) {
+	for {
+		select {
+			case task := <-n.queue:
+				start := time.Now()
+				if task.run() {
+					n.tasks.Add(1)
+					n.busy.Add(int64(time.Since(start)))
+				}
+			case <-p.quit:
+				for { // run what is left, callers of a pinned pool may not help
+					select {
+						case task := <-n.queue:
+							task.run()
+						default:
+							return
+					}
+				}
+		}
+	}
+}
+
+// assigns a NUMA node to a new or freshly loaded shard (round robin)
+func nextShardNode() int {
+	return int(shardNodeCounter.Add(1))
+}
+
+// runs callback for each shard on the node that owns the shard and waits for all of them
+func runOnShards(shards []*storageShard, callback func(*storageShard)) {
+	if len(shards) == 1 && shards[0] != nil {
+		callback(shards[0]) // execute without scheduling
+		return
+	}
+	p := getScanPool()
+	var done sync.WaitGroup
+	tasks := make([]*scanTask, 0, len(shards))
+	nodes := make([]*numaNode, 0, len(shards))
+	queued := make([]bool, 0, len(shards))
+	for _, s := range shards {
+		if s == nil {
+			fmt.Println("Warning: a shard is missing")
+			continue
+		}
+		task := new(scanTask)
+		task.fn = scm.WrapContext(func(s *storageShard) func() {
+			return func() {
+				callback(s)
+			}
+		}(s))
+		task.done = &done
+		done.Add(1)
+		n := p.nodes[s.node % len(p.nodes)]
+		select {
+			case n.queue <- task:
+				queued = append(queued, true)
+			default: // queue is full: the caller will run it
+				queued = append(queued, false)
+		}
+		tasks = append(tasks, task)
+		nodes = append(nodes, n)
+	}
+	// help with the tasks that are still waiting (from the back, so workers and caller don't collide)
+	helps := true
+	if p.pinned {
+		_, helps = scm.GoroutineValue("scanworker") // only a worker waiting for a nested scan has to help
+		select {
+			case <-p.quit:
+				helps = true // the pool was replaced in the meantime and its workers may be gone
+			default:
+		}
+	}
+	for i := len(tasks) - 1; i >= 0; i-- {
+		if (helps || !queued[i]) && tasks[i].run() {
+			nodes[i].stolen.Add(1)
+		}
+	}
+	done.Wait()
+	for _, task := range tasks {
+		if task.err != nil {
+			panic(task.err) // propagate errors of the scan callbacks
+		}
+	}
+}
+
+func PrintNodeUsage() string {
+	p := getScanPool()
+	shards := make([]int, len(p.nodes))
+	sizes := make([]uint, len(p.nodes))
+	for _, db := range databases.GetAll() {
+		for _, t := range db.Tables.GetAll() {
+			shardlist := t.Shards
+			if shardlist == nil {
+				shardlist = t.PShards
+			}
+			for _, s := range shardlist {
+				shards[s.node % len(p.nodes)]++
+				sizes[s.node % len(p.nodes)] += s.Size()
+			}
+		}
+	}
+	var b strings.Builder
+	b.WriteString(fmt.Sprintf("Node\tWorkers\tShards\tSize\tTasks\tCaller-run\tBusy (pinned=%v)\n", p.pinned))
+	for i, n := range p.nodes {
+		b.WriteString(fmt.Sprintf("%d\t%d\t%d\t%s\t%d\t%d\t%s\n", n.id, n.workers, shards[i], units.BytesSize(float64(sizes[i])), n.tasks.Load(), n.stolen.Load(), time.Duration(n.busy.Load())))
+	}
+	return b.String()
+}
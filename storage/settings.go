@@ -23,13 +23,17 @@ type SettingsT struct {
 	PartitionMaxDimensions int
 	DefaultEngine string
 	ShardSize uint
+	ScanWorkers int // size of the scan worker pool (0 = one worker per CPU)
+	NUMA bool // pin scan workers to NUMA nodes and schedule shards on the node that owns them
+	StrictTypes bool // reject values that don't fit the column type; otherwise they are converted, truncated or clamped
 }
 
-var Settings SettingsT = SettingsT{false, 10, "safe", 60000}
+var Settings SettingsT = SettingsT{false, 10, "safe", 60000, 0, false, false}
 
 // call this after you filled Settings
 func InitSettings() {
 	scm.SettingsHaveGoodBacktraces = Settings.Backtrace
+	startScanPool()
 }
 
 func ChangeSettings(a ...scm.Scmer) scm.Scmer {
@@ -44,6 +48,12 @@ func ChangeSettings(a ...scm.Scmer) scm.Scmer {
 				return Settings.DefaultEngine
 			case "ShardSize":
 				return float64(Settings.ShardSize)
+			case "ScanWorkers":
+				return float64(Settings.ScanWorkers)
+			case "NUMA":
+				return Settings.NUMA
+			case "StrictTypes":
+				return Settings.StrictTypes
 			default:
 				panic("unknown setting: " + scm.String(a[0]))
 		}
@@ -58,6 +68,14 @@ func ChangeSettings(a ...scm.Scmer) scm.Scmer {
 				Settings.DefaultEngine = scm.String(a[1])
 			case "ShardSize":
 				Settings.ShardSize = uint(scm.ToInt(a[1]))
+			case "ScanWorkers":
+				Settings.ScanWorkers = scm.ToInt(a[1])
+				startScanPool() // resize
+			case "NUMA":
+				Settings.NUMA = scm.ToBool(a[1])
+				startScanPool()
+			case "StrictTypes":
+				Settings.StrictTypes = scm.ToBool(a[1])
 			default:
 				panic("unknown setting: " + scm.String(a[0]))
 		}
@@ -42,14 +42,15 @@ type storageShard struct {
 	deletions NonLockingReadMap.NonBlockingBitMap // items removed from main or inserts (based on main_count + i)
 	logfile *os.File // only in safe mode
 	mu sync.RWMutex // delta write lock (working on main storage is lock free)
-	uniquelock sync.Mutex // unique insert lock (only used in the sharded case)
+	uniquelock sync.Mutex // unique insert lock (used when every unique key contains all partitioning dimensions)
 	next *storageShard // TODO: also make a next-partition-schema
+	redirect *shardRedirect // set when this shard was merged, split or repartitioned into other shards
+	node int // NUMA node that scans and rebuilds this shard (see scanpool.go)
+	autoinc autoIncrementRange // auto_increment range reserved by this shard
 	// indexes
 	Indexes []*StorageIndex // sorted keys
 	indexMutex sync.Mutex
-	hashmaps1 map[[1]string]map[[1]scm.Scmer]uint // hashmaps for single columned unique keys
-	hashmaps2 map[[2]string]map[[2]scm.Scmer]uint // hashmaps for single columned unique keys
-	hashmaps3 map[[3]string]map[[3]scm.Scmer]uint // hashmaps for single columned unique keys
+	hashmaps map[string]*uniqueHashmap // hashmaps for unique keys of any arity (see unique.go)
 }
 
 func (s *storageShard) Size() uint {
@@ -71,10 +72,9 @@ func (u *storageShard) UnmarshalJSON(data []byte) error {
 	u.uuid.UnmarshalText(data)
 	u.columns = make(map[string]ColumnStorage)
 	u.deltaColumns = make(map[string]int)
-	u.hashmaps1 = make(map[[1]string]map[[1]scm.Scmer]uint)
-	u.hashmaps2 = make(map[[2]string]map[[2]scm.Scmer]uint)
-	u.hashmaps3 = make(map[[3]string]map[[3]scm.Scmer]uint)
+	u.hashmaps = make(map[string]*uniqueHashmap)
 	u.deletions.Reset()
+	u.node = nextShardNode()
 	// the rest of the unmarshalling is done in the caller because u.t is nil in the moment
 	return nil
 }
@@ -113,10 +113,17 @@ func (u *storageShard) load(t *table) {
 
 			columnstorage := reflect.New(storages[magicbyte]).Interface().(ColumnStorage)
 			u.main_count = columnstorage.Deserialize(f) // read; ownership of f goes to Deserialize, so they will free the handle
+			if gs, ok := columnstorage.(*StorageGlobalString); ok {
+				gs.dict = t.findDictionary(gs.dictid) // restore reference to the table's shared dictionary
+				if gs.dict == nil {
+					panic("missing global dictionary for column " + t.Name + "." + col.Name)
+				}
+			}
 			u.columns[col.Name] = columnstorage
 			f.Close()
 		}
 	}
+	u.virtualizeColumns()
 
 	if t.PersistencyMode == Safe || t.PersistencyMode == Logged {
 		f, err := os.OpenFile(u.t.schema.path + u.uuid.String() + ".log", os.O_RDWR|os.O_CREATE, 0750)
@@ -155,11 +162,10 @@ func NewShard(t *table) *storageShard {
 	result := new(storageShard)
 	result.uuid, _ = uuid.NewRandom()
 	result.t = t
+	result.node = nextShardNode()
 	result.columns = make(map[string]ColumnStorage)
 	result.deltaColumns = make(map[string]int)
-	result.hashmaps1 = make(map[[1]string]map[[1]scm.Scmer]uint)
-	result.hashmaps2 = make(map[[2]string]map[[2]scm.Scmer]uint)
-	result.hashmaps3 = make(map[[3]string]map[[3]scm.Scmer]uint)
+	result.hashmaps = make(map[string]*uniqueHashmap)
 	result.deletions.Reset()
 	for _, column := range t.Columns {
 		result.columns[column.Name] = new (StorageSparse)
@@ -184,6 +190,7 @@ func (t *storageShard) UpdateFunction(idx uint, withTrigger bool) func(...scm.Sc
 
 		result := false // result = true when update was possible; false if there was a RESTRICT
 		if len(a) > 0 {
+			a[0] = t.t.checkUpdate(a[0].([]scm.Scmer)) // types, NOT NULL and AUTO_INCREMENT (outside the lock, since it may read the shards)
 			func () {
 				t.mu.Lock() // write lock
 				defer t.mu.Unlock() // write lock
@@ -225,6 +232,9 @@ func (t *storageShard) UpdateFunction(idx uint, withTrigger bool) func(...scm.Sc
 					return // leave inner func to unlock
 				}
 
+				t.t.fillGenerated(cols, [][]scm.Scmer{d2})
+				t.t.checkConstraints(cols, [][]scm.Scmer{d2})
+
 				// unique constraint checking
 				if t.t.Unique != nil {
 					t.deletions.Set(idx, true) // mark as deleted
@@ -240,6 +250,11 @@ func (t *storageShard) UpdateFunction(idx uint, withTrigger bool) func(...scm.Sc
 				}
 
 				t.insertDataset(cols, [][]scm.Scmer{d2})
+				if t.redirect != nil {
+					// shard has been replaced: move the changed row over to the successors
+					t.redirect.delete(idx)
+					t.redirect.insert(t, cols, [][]scm.Scmer{d2})
+				}
 				if t.t.PersistencyMode == Safe || t.t.PersistencyMode == Logged {
 					var b strings.Builder
 					b.Write([]byte("delete "))
@@ -267,6 +282,9 @@ func (t *storageShard) UpdateFunction(idx uint, withTrigger bool) func(...scm.Sc
 				defer t.mu.Unlock() // write lock
 
 				t.deletions.Set(idx, true) // mark as deleted
+				if t.redirect != nil {
+					t.redirect.delete(idx) // shard has been replaced: also delete in the successor
+				}
 				if t.t.PersistencyMode == Safe || t.t.PersistencyMode == Logged {
 					var b strings.Builder
 					b.Write([]byte("delete "))
@@ -327,6 +345,10 @@ func (t *storageShard) Insert(columns []string, values [][]scm.Scmer, alreadyLoc
 		// also insert into next storage
 		t.next.Insert(columns, values, false)
 	}
+	if t.redirect != nil {
+		// shard has been replaced: successors take new rows
+		t.redirect.insert(t, columns, values)
+	}
 	if !alreadyLocked {
 		t.mu.Unlock()
 	}
@@ -360,23 +382,8 @@ func (t *storageShard) insertDataset(columns []string, values [][]scm.Scmer) {
 		t.inserts = append(t.inserts, newrow)
 
 		// notify all hashmaps
-		for k, v := range t.hashmaps1 {
-			v[[1]scm.Scmer{
-				newrow[t.deltaColumns[k[0]]],
-			}] = recid
-		}
-		for k, v := range t.hashmaps2 {
-			v[[2]scm.Scmer{
-				newrow[t.deltaColumns[k[0]]],
-				newrow[t.deltaColumns[k[1]]],
-			}] = recid
-		}
-		for k, v := range t.hashmaps3 {
-			v[[3]scm.Scmer{
-				newrow[t.deltaColumns[k[0]]],
-				newrow[t.deltaColumns[k[1]]],
-				newrow[t.deltaColumns[k[2]]],
-			}] = recid
+		for _, hm := range t.hashmaps {
+			hm.insert(t, recid, newrow)
 		}
 
 		// also notify indices
@@ -391,112 +398,16 @@ func (t *storageShard) insertDataset(columns []string, values [][]scm.Scmer) {
 
 func (t *storageShard) GetRecordidForUnique(columns []string, values []scm.Scmer) (result uint, present bool) {
 	t.mu.RLock()
-	if len(columns) == 1 {
-		columns_ := (*[1]string)(columns)
-		values_ := (*[1]scm.Scmer)(values)
-		hm, ok := t.hashmaps1[*columns_]
-		if !ok {
-			// no hashmap entry? create the hashmap
-			t.mu.RUnlock()
-			t.mu.Lock()
-			hm := make(map[[1]scm.Scmer]uint)
-			col := []ColumnStorage{
-				t.columns[columns[0]],
-			}
-			for i := uint(0); i < t.main_count; i++ {
-				hm[[1]scm.Scmer{
-					col[0].GetValue(i),
-				}] = i
-			}
-			dcolids := []int{
-				t.deltaColumns[columns[0]],
-			}
-			for i := uint(0); i < uint(len(t.inserts)); i++ {
-				hm[[1]scm.Scmer{
-					t.inserts[i][dcolids[0]],
-				}] = i + t.main_count
-			}
-			t.hashmaps1[*columns_] = hm
-			t.mu.Unlock()
-			return t.GetRecordidForUnique(columns, values) // retry
-		}
-		result, present = hm[*values_] // read recid from hashmap
-	} else
-	if len(columns) == 2 {
-		columns_ := (*[2]string)(columns)
-		values_ := (*[2]scm.Scmer)(values)
-		hm, ok := t.hashmaps2[*columns_]
-		if !ok {
-			// no hashmap entry? create the hashmap
-			t.mu.RUnlock()
-			t.mu.Lock()
-			hm := make(map[[2]scm.Scmer]uint)
-			col := []ColumnStorage{
-				t.columns[columns[0]],
-				t.columns[columns[1]],
-			}
-			for i := uint(0); i < t.main_count; i++ {
-				hm[[2]scm.Scmer{
-					col[0].GetValue(i),
-					col[1].GetValue(i),
-				}] = i
-			}
-			dcolids := []int{
-				t.deltaColumns[columns[0]],
-				t.deltaColumns[columns[1]],
-			}
-			for i := uint(0); i < uint(len(t.inserts)); i++ {
-				hm[[2]scm.Scmer{
-					t.inserts[i][dcolids[0]],
-					t.inserts[i][dcolids[1]],
-				}] = i + t.main_count
-			}
-			t.hashmaps2[*columns_] = hm
-			t.mu.Unlock()
-			return t.GetRecordidForUnique(columns, values) // retry
-		}
-		result, present = hm[*values_] // read recid from hashmap
-	} else
-	if len(columns) == 3 {
-		columns_ := (*[3]string)(columns)
-		values_ := (*[3]scm.Scmer)(values)
-		hm, ok := t.hashmaps3[*columns_]
-		if !ok {
-			// no hashmap entry? create the hashmap
-			t.mu.RUnlock()
-			t.mu.Lock()
-			hm := make(map[[3]scm.Scmer]uint)
-			col := []ColumnStorage{
-				t.columns[columns[0]],
-				t.columns[columns[1]],
-				t.columns[columns[2]],
-			}
-			for i := uint(0); i < t.main_count; i++ {
-				hm[[3]scm.Scmer{
-					col[0].GetValue(i),
-					col[1].GetValue(i),
-					col[2].GetValue(i),
-				}] = i
-			}
-			dcolids := []int{
-				t.deltaColumns[columns[0]],
-				t.deltaColumns[columns[1]],
-				t.deltaColumns[columns[2]],
-			}
-			for i := uint(0); i < uint(len(t.inserts)); i++ {
-				hm[[3]scm.Scmer{
-					t.inserts[i][dcolids[0]],
-					t.inserts[i][dcolids[1]],
-					t.inserts[i][dcolids[2]],
-				}] = i + t.main_count
-			}
-			t.hashmaps3[*columns_] = hm
-			t.mu.Unlock()
-			return t.GetRecordidForUnique(columns, values) // retry
-		}
-		result, present = hm[*values_] // read recid from hashmap
+	hm, ok := t.hashmaps[strings.Join(columns, "\x00")]
+	if !ok {
+		// no hashmap entry? create the hashmap
+		t.mu.RUnlock()
+		t.mu.Lock()
+		t.buildUniqueHashmap(columns)
+		t.mu.Unlock()
+		return t.GetRecordidForUnique(columns, values) // retry
 	}
-
+	result, present = hm.values[uniqueHashKey(values)] // read recid from hashmap
 	t.mu.RUnlock()
 	return
 }
@@ -532,6 +443,10 @@ func (t *storageShard) rebuild(all bool) *storageShard {
 
 	// concurrency! when rebuild is run in background, inserts and deletions into and from old delta storage must be duplicated to the ongoing process
 	t.mu.Lock()
+	if t.redirect != nil {
+		t.mu.Unlock()
+		return t // shard was replaced in the meantime; its successors are rebuilt on their own
+	}
 	if t.next != nil {
 		t.mu.Unlock()
 		// lock+unlock the next shard so we don't return too early (sync hazards)
@@ -542,6 +457,7 @@ func (t *storageShard) rebuild(all bool) *storageShard {
 	}
 	result := new(storageShard)
 	result.t = t.t
+	result.node = t.node // stay on the same NUMA node
 	t.next = result
 	result.mu.Lock() // interlock so no one will rebuild the shard twice
 	defer result.mu.Unlock()
@@ -570,9 +486,7 @@ func (t *storageShard) rebuild(all bool) *storageShard {
 		// prepare delta storage
 		result.columns = make(map[string]ColumnStorage)
 		result.deltaColumns = make(map[string]int)
-		result.hashmaps1 = make(map[[1]string]map[[1]scm.Scmer]uint)
-		result.hashmaps2 = make(map[[2]string]map[[2]scm.Scmer]uint)
-		result.hashmaps3 = make(map[[3]string]map[[3]scm.Scmer]uint)
+		result.hashmaps = make(map[string]*uniqueHashmap)
 		result.deletions.Reset()
 		if t.t.PersistencyMode == Safe || t.t.PersistencyMode == Logged {
 			// safe mode: also write all deltas to disk
@@ -623,7 +537,7 @@ func (t *storageShard) rebuild(all bool) *storageShard {
 				} else {
 					// redo scan phase with compression
 					//fmt.Printf("Compression with %T\n", newcol2)
-					newcol = newcol2
+					newcol = t.t.useGlobalDictionary(col, newcol2)
 				}
 			}
 			// build phase
@@ -668,6 +582,7 @@ func (t *storageShard) rebuild(all bool) *storageShard {
 				f.Close()
 			}
 		}
+		result.virtualizeColumns()
 		b.WriteString(") -> ")
 		b.WriteString(fmt.Sprint(result.main_count))
 		fmt.Println(b.String())
@@ -689,9 +604,7 @@ func (t *storageShard) rebuild(all bool) *storageShard {
 		result.inserts = t.inserts
 		result.deletions = deletions
 		result.Indexes = t.Indexes
-		result.hashmaps1 = t.hashmaps1
-		result.hashmaps2 = t.hashmaps2
-		result.hashmaps3 = t.hashmaps3
+		result.hashmaps = t.hashmaps
 	}
 	return result
 }
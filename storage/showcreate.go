@@ -0,0 +1,267 @@
+/*
+Copyright (C) 2024  Carl-Philip Hänsch
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package storage
+
+import "fmt"
+import "strings"
+import "strconv"
+import "github.com/launix-de/memcp/scm"
+
+/*
+
+SHOW CREATE TABLE:
+ - the DDL is rendered from the storage schema, not from the original statement
+ - expressions of generated columns, checks and functional key parts are stored as scm code;
+   they are translated back into SQL for the operators the SQL parser produces, other functions are
+   rendered as function calls
+ - time partitioning uses memcp's PARTITION BY RANGE ... INTERVAL syntax; the automatic sharding is
+   written as a comment since it is not part of the schema a user declares
+
+*/
+
+func sqlIdentifier(s string) string {
+	return "`" + strings.ReplaceAll(s, "`", "``") + "`"
+}
+
+func sqlString(s string) string {
+	return "'" + strings.ReplaceAll(strings.ReplaceAll(s, "\\", "\\\\"), "'", "\\'") + "'"
+}
+
+// infix operators and functions of scm code that the SQL parser produces
+var sqlInfixOperators = map[scm.Symbol]string {
+	"+": "+", "-": "-", "*": "*", "/": "/",
+	"<": "<", ">": ">", "<=": "<=", ">=": ">=",
+	"equal?": "=", "equal??": "=",
+	"and": "AND", "or": "OR",
+	"strlike": "LIKE",
+}
+var sqlFunctions = map[scm.Symbol]string {
+	"toLower": "LOWER", "toUpper": "UPPER",
+	"concat": "CONCAT", "coalesce": "COALESCE",
+	"floor": "FLOOR", "ceil": "CEIL", "round": "ROUND",
+	"password": "PASSWORD", "now": "UNIX_TIMESTAMP", "parse_date": "UNIX_TIMESTAMP",
+}
+
+// renders scm code as SQL expression; colname translates the symbols of columns
+func sqlExpression(code scm.Scmer, colname func(scm.Symbol) string) string {
+	switch v := code.(type) {
+		case scm.Symbol:
+			return colname(v)
+		case string:
+			return sqlString(v)
+		case float64:
+			return strconv.FormatFloat(v, 'f', -1, 64)
+		case int64:
+			return fmt.Sprint(v)
+		case bool:
+			if v {
+				return "TRUE"
+			}
+			return "FALSE"
+		case nil:
+			return "NULL"
+		case []scm.Scmer:
+			if len(v) == 0 {
+				return "NULL"
+			}
+			head, _ := v[0].(scm.Symbol)
+			args := make([]string, len(v) - 1)
+			for i, arg := range v[1:] {
+				args[i] = sqlExpression(arg, colname)
+			}
+			if op, ok := sqlInfixOperators[head]; ok && len(args) >= 2 {
+				return "(" + strings.Join(args, " " + op + " ") + ")"
+			}
+			switch head {
+				case "not":
+					if inner, ok := v[1].([]scm.Scmer); ok && len(inner) == 3 && (inner[0] == scm.Symbol("equal?") || inner[0] == scm.Symbol("equal??")) {
+						return "(" + sqlExpression(inner[1], colname) + " <> " + sqlExpression(inner[2], colname) + ")"
+					}
+					return "(NOT " + args[0] + ")"
+				case "nil?":
+					return "(" + args[0] + " IS NULL)"
+				case "if":
+					// CASE WHEN a THEN b ... ELSE c END
+					var b strings.Builder
+					b.WriteString("CASE")
+					for i := 0; i + 1 < len(args); i += 2 {
+						b.WriteString(" WHEN " + args[i] + " THEN " + args[i+1])
+					}
+					if len(args) % 2 == 1 {
+						b.WriteString(" ELSE " + args[len(args)-1])
+					}
+					b.WriteString(" END")
+					return b.String()
+				case "contains?":
+					if list, ok := v[1].([]scm.Scmer); ok && len(list) > 0 && len(args) == 2 {
+						items := make([]string, len(list) - 1)
+						for i, item := range list[1:] {
+							items[i] = sqlExpression(item, colname)
+						}
+						return "(" + args[1] + " IN (" + strings.Join(items, ", ") + "))"
+					}
+			}
+			name, ok := sqlFunctions[head]
+			if !ok {
+				name = strings.ToUpper(string(head))
+			}
+			return name + "(" + strings.Join(args, ", ") + ")"
+	}
+	return sqlString(scm.String(code))
+}
+
+// renders the body of a stored lambda source whose params stand for cols
+func sqlLambdaExpression(source string, cols []string) string {
+	code := scm.StripSourceInfo(scm.Read("show", source)).([]scm.Scmer) // (lambda (params) body)
+	mapping := make(map[scm.Symbol]string)
+	if params, ok := code[1].([]scm.Scmer); ok {
+		for i, p := range params {
+			if sym, ok := p.(scm.Symbol); ok && i < len(cols) {
+				mapping[sym] = cols[i]
+			}
+		}
+	}
+	return sqlExpression(code[2], func(sym scm.Symbol) string {
+		if col, ok := mapping[sym]; ok {
+			return sqlIdentifier(col)
+		}
+		return sqlIdentifier(string(sym))
+	})
+}
+
+// renders an expression key part as SQL
+func sqlKeyExpression(key string) string {
+	return sqlExpression(scm.StripSourceInfo(scm.Read("index", key)), func(sym scm.Symbol) string {
+		return sqlIdentifier(string(sym))
+	})
+}
+
+// renders a key part list of a unique key or index
+func sqlKeyParts(cols []string) string {
+	parts := make([]string, len(cols))
+	for i, col := range cols {
+		if isExpressionKey(col) {
+			parts[i] = "(" + sqlKeyExpression(col) + ")"
+		} else {
+			parts[i] = sqlIdentifier(col)
+		}
+	}
+	return "(" + strings.Join(parts, ",") + ")"
+}
+
+// renders an interval in seconds with the largest exact unit of the SQL parser
+func sqlInterval(seconds float64) string {
+	units := []struct{name string; size float64}{{"WEEK", 604800}, {"DAY", 86400}, {"HOUR", 3600}, {"MINUTE", 60}}
+	for _, u := range units {
+		if seconds >= u.size && float64(int64(seconds / u.size)) * u.size == seconds {
+			return fmt.Sprintf("%d %s", int64(seconds / u.size), u.name)
+		}
+	}
+	return fmt.Sprintf("%d SECOND", int64(seconds))
+}
+
+// reconstructs a MySQL compatible CREATE TABLE statement from the schema
+func (t *table) ShowCreate() string {
+	t.schema.schemalock.Lock()
+	defer t.schema.schemalock.Unlock()
+	lines := make([]string, 0, len(t.Columns) + len(t.Unique) + len(t.Indexes) + len(t.Foreign) + len(t.Checks))
+	for _, c := range t.Columns {
+		var b strings.Builder
+		b.WriteString("  " + sqlIdentifier(c.Name) + " " + strings.ToLower(c.Typ))
+		if len(c.Typdimensions) > 0 {
+			dims := make([]string, len(c.Typdimensions))
+			for i, d := range c.Typdimensions {
+				dims[i] = fmt.Sprint(d)
+			}
+			b.WriteString("(" + strings.Join(dims, ",") + ")")
+		}
+		if c.Generated != "" && c.ComputorSource != "" {
+			b.WriteString(" GENERATED ALWAYS AS (" + sqlLambdaExpression(c.ComputorSource, c.ComputorCols) + ") " + c.Generated)
+		}
+		// keys are listed below
+		tokens := tokenizeColumnOptions(c.Extrainfo)
+		rest := make([]string, 0, len(tokens))
+		for _, token := range tokens {
+			switch strings.ToUpper(token) {
+				case "PRIMARY", "UNIQUE", "KEY":
+				default:
+					rest = append(rest, token)
+			}
+		}
+		c.Extrainfo = strings.Join(rest, " ")
+		if options := c.OptionString(); options != "" {
+			b.WriteString(" " + options)
+		}
+		lines = append(lines, b.String())
+	}
+	for _, u := range t.Unique {
+		if u.Id == "PRIMARY" {
+			lines = append(lines, "  PRIMARY KEY " + sqlKeyParts(u.Cols))
+		} else {
+			lines = append(lines, "  UNIQUE KEY " + sqlIdentifier(u.Id) + " " + sqlKeyParts(u.Cols))
+		}
+	}
+	for _, index := range t.Indexes {
+		lines = append(lines, "  KEY " + sqlIdentifier(index.Id) + " " + sqlKeyParts(index.Cols))
+	}
+	for _, f := range t.Foreign {
+		if f.Tbl1 != t.Name {
+			continue // foreign keys are stored in both tables
+		}
+		constraint := "  "
+		if f.Id != "" {
+			constraint = "  CONSTRAINT " + sqlIdentifier(f.Id) + " "
+		}
+		lines = append(lines, constraint + "FOREIGN KEY " + sqlKeyParts(f.Cols1) + " REFERENCES " + sqlIdentifier(f.Tbl2) + " " + sqlKeyParts(f.Cols2))
+	}
+	for _, c := range t.Checks {
+		lines = append(lines, "  CONSTRAINT " + sqlIdentifier(c.Id) + " CHECK (" + sqlLambdaExpression(c.Expr, c.Cols) + ")")
+	}
+
+	var b strings.Builder
+	b.WriteString("CREATE TABLE " + sqlIdentifier(t.Name) + " (\n")
+	b.WriteString(strings.Join(lines, ",\n"))
+	b.WriteString("\n) ENGINE=")
+	switch t.PersistencyMode {
+		case Memory:
+			b.WriteString("MEMORY")
+		case Logged:
+			b.WriteString("LOGGING")
+		default:
+			b.WriteString("InnoDB")
+	}
+	t.initAutoIncrement()
+	if t.Auto_increment > 1 {
+		b.WriteString(fmt.Sprintf(" AUTO_INCREMENT=%d", t.Auto_increment))
+	}
+	b.WriteString(" DEFAULT CHARSET=utf8mb4")
+	sharding := make([]string, 0, len(t.PDimensions))
+	for _, sd := range t.PDimensions {
+		if sd.Interval > 0 {
+			b.WriteString("\nPARTITION BY RANGE (" + sqlIdentifier(sd.Column) + ") INTERVAL " + sqlInterval(sd.Interval))
+			if sd.Retention > 0 {
+				b.WriteString(" RETENTION " + sqlInterval(sd.Retention))
+			}
+		} else {
+			sharding = append(sharding, fmt.Sprintf("%s (%d partitions)", sqlIdentifier(sd.Column), sd.NumPartitions))
+		}
+	}
+	if len(sharding) > 0 {
+		b.WriteString("\n/* sharded by " + strings.Join(sharding, ", ") + " */")
+	}
+	return b.String()
+}
@@ -0,0 +1,476 @@
+/*
+Copyright (C) 2024  Carl-Philip Hänsch
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package storage
+
+import "io"
+import "os"
+import "fmt"
+import "bufio"
+import "strconv"
+import "strings"
+import "encoding/hex"
+import "github.com/launix-de/memcp/scm"
+
+/*
+
+SQL dump import (mysqldump):
+ - the file is read line by line and split into statements by a state machine that knows
+   '...', "..." and `...` quotes with their escapes, -- and # line comments and block comments
+ - the content of versioned comments (block comments starting with ! and a version number like
+   !40101) is executed like MySQL does
+ - DELIMITER lines change the statement delimiter (used around triggers and procedures)
+ - INSERT statements whose values are literals (which is what mysqldump writes) are parsed here
+   and passed to table.Insert as one batch; USE switches the schema; all other statements are
+   executed with parse_sql
+ - statements that fail are skipped and reported with the line where they start
+
+*/
+
+// LoadSQL executes a SQL dump; returns the number of executed statements and the failed ones
+func LoadSQL(schema, filename string) (int, []ImportError) {
+	f, err := os.Open(filename)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+	return ReadSQL(schema, f)
+}
+
+func ReadSQL(schema string, r io.Reader) (int, []ImportError) {
+	parseSQL, ok := scm.Globalenv.Vars["parse_sql"]
+	if !ok {
+		panic("the SQL parser is not loaded")
+	}
+	// statements run in their own session like a connection of the mysql protocol
+	en := scm.Env{scm.Vars{
+		"session": scm.NewSession(),
+		"resultrow": func (a ...scm.Scmer) scm.Scmer { return true }, // results of SELECTs are dropped
+	}, nil, &scm.Globalenv, false}
+
+	count := 0
+	var errors []ImportError
+	splitSQLStatements(bufio.NewReaderSize(r, 1024 * 1024), func (stmt string, line int) {
+		defer func () {
+			if r := recover(); r != nil {
+				errors = append(errors, ImportError{line, fmt.Sprint(r)})
+			}
+		}()
+		if db, ok := parseUseStatement(stmt); ok {
+			if GetDatabase(db) == nil {
+				panic("database " + db + " does not exist")
+			}
+			schema = db
+		} else if ins, ok := parseDumpInsert(stmt); ok {
+			ins.execute(schema)
+		} else {
+			scm.Eval(scm.Apply(parseSQL, schema, stmt), &en)
+		}
+		count++
+	})
+	return count, errors
+}
+
+// reads the statements of a SQL file; emit gets each statement without its delimiter and the line where it starts
+func splitSQLStatements(r *bufio.Reader, emit func(string, int)) {
+	delimiter := ";"
+	var stmt strings.Builder
+	start := 0 // line of the first character of stmt
+	var quote byte // ', " or ` while inside a quoted string
+	inComment := false // inside /* */
+	inVersioned := false // inside /*! */
+	lineno := 0
+	flush := func () {
+		s := strings.TrimSpace(stmt.String())
+		stmt.Reset()
+		if s != "" {
+			emit(s, start)
+		}
+	}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil && err != io.EOF {
+			panic(err)
+		}
+		if line == "" && err == io.EOF {
+			break
+		}
+		lineno++
+		line = strings.TrimRight(line, "\r\n")
+		if quote == 0 && !inComment && stmt.Len() == 0 {
+			trimmed := strings.TrimSpace(line)
+			if len(trimmed) > 10 && strings.EqualFold(trimmed[:10], "DELIMITER ") {
+				delimiter = strings.TrimSpace(trimmed[10:])
+				continue
+			}
+		}
+		for i := 0; i < len(line); {
+			c := line[i]
+			if stmt.Len() == 0 && !inComment && (c == ' ' || c == '\t') {
+				i++ // whitespace between statements
+				continue
+			}
+			if stmt.Len() == 0 {
+				start = lineno
+			}
+			if inComment {
+				if strings.HasPrefix(line[i:], "*/") {
+					inComment = false
+					i += 2
+				} else {
+					i++
+				}
+				continue
+			}
+			if quote != 0 {
+				stmt.WriteByte(c)
+				if c == '\\' && quote != '`' && i + 1 < len(line) {
+					stmt.WriteByte(line[i+1]) // escaped character
+					i += 2
+					continue
+				}
+				if c == quote {
+					if i + 1 < len(line) && line[i+1] == quote {
+						stmt.WriteByte(quote) // doubled quote
+						i += 2
+						continue
+					}
+					quote = 0
+				}
+				i++
+				continue
+			}
+			if strings.HasPrefix(line[i:], delimiter) {
+				flush()
+				i += len(delimiter)
+				continue
+			}
+			switch {
+				case inVersioned && strings.HasPrefix(line[i:], "*/"):
+					inVersioned = false
+					stmt.WriteByte(' ')
+					i += 2
+				case strings.HasPrefix(line[i:], "/*!"):
+					inVersioned = true
+					i += 3
+					for i < len(line) && line[i] >= '0' && line[i] <= '9' {
+						i++ // version number
+					}
+				case strings.HasPrefix(line[i:], "/*"):
+					inComment = true
+					i += 2
+				case c == '#' || strings.HasPrefix(line[i:], "--") && (i + 2 == len(line) || line[i+2] == ' ' || line[i+2] == '\t'):
+					i = len(line) // line comment
+				case c == '\'' || c == '"' || c == '`':
+					quote = c
+					stmt.WriteByte(c)
+					i++
+				default:
+					stmt.WriteByte(c)
+					i++
+			}
+		}
+		if stmt.Len() > 0 {
+			stmt.WriteByte('\n')
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	flush() // last statement without delimiter
+}
+
+// recognizes USE db
+func parseUseStatement(stmt string) (string, bool) {
+	p := sqlDumpParser{stmt, 0}
+	if !p.keyword("USE") {
+		return "", false
+	}
+	db, ok := p.identifier()
+	if !ok || !p.end() {
+		return "", false
+	}
+	return db, true
+}
+
+// INSERT statement with literal values
+type dumpInsert struct {
+	schema string // "" = current schema
+	table string
+	cols []string // nil = all columns in table order
+	rows [][]scm.Scmer
+}
+
+// parses INSERT [INTO] t [(cols)] VALUES (...),...; returns false for everything else (the statement then goes through parse_sql)
+func parseDumpInsert(stmt string) (result dumpInsert, ok bool) {
+	p := sqlDumpParser{stmt, 0}
+	if !p.keyword("INSERT") {
+		return
+	}
+	p.keyword("INTO")
+	if result.table, ok = p.identifier(); !ok {
+		return
+	}
+	if p.symbol('.') {
+		result.schema = result.table
+		if result.table, ok = p.identifier(); !ok {
+			return
+		}
+	}
+	ok = false
+	if p.symbol('(') {
+		for {
+			col, isIdent := p.identifier()
+			if !isIdent {
+				return
+			}
+			result.cols = append(result.cols, col)
+			if p.symbol(')') {
+				break
+			}
+			if !p.symbol(',') {
+				return
+			}
+		}
+	}
+	if !p.keyword("VALUES") && !p.keyword("VALUE") {
+		return
+	}
+	for {
+		if !p.symbol('(') {
+			return
+		}
+		row := make([]scm.Scmer, 0, len(result.cols))
+		if !p.symbol(')') {
+			for {
+				v, isLiteral := p.literal()
+				if !isLiteral {
+					return
+				}
+				row = append(row, v)
+				if p.symbol(')') {
+					break
+				}
+				if !p.symbol(',') {
+					return
+				}
+			}
+		}
+		result.rows = append(result.rows, row)
+		if !p.symbol(',') {
+			break
+		}
+	}
+	ok = p.end() // ON DUPLICATE KEY UPDATE and others go through parse_sql
+	return
+}
+
+func (ins dumpInsert) execute(schema string) {
+	if ins.schema != "" {
+		schema = ins.schema
+	}
+	db := GetDatabase(schema)
+	if db == nil {
+		panic("database " + schema + " does not exist")
+	}
+	t := db.Tables.Get(ins.table)
+	if t == nil {
+		panic("table " + ins.table + " does not exist")
+	}
+	cols := ins.cols
+	if cols == nil {
+		cols = t.exportColumns()
+	}
+	for _, row := range ins.rows {
+		if len(row) != len(cols) {
+			panic(fmt.Sprintf("Column count doesn't match value count: %d columns, %d values", len(cols), len(row)))
+		}
+	}
+	t.Insert(cols, ins.rows, nil, nil, false)
+}
+
+// minimal tokenizer for the statements mysqldump writes
+type sqlDumpParser struct {
+	s string
+	i int
+}
+
+func (p *sqlDumpParser) skipSpace() {
+	for p.i < len(p.s) && (p.s[p.i] == ' ' || p.s[p.i] == '\t' || p.s[p.i] == '\n' || p.s[p.i] == '\r') {
+		p.i++
+	}
+}
+
+func (p *sqlDumpParser) end() bool {
+	p.skipSpace()
+	return p.i == len(p.s)
+}
+
+func (p *sqlDumpParser) symbol(c byte) bool {
+	p.skipSpace()
+	if p.i < len(p.s) && p.s[p.i] == c {
+		p.i++
+		return true
+	}
+	return false
+}
+
+func isWordChar(c byte) bool {
+	return c == '_' || c == '$' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c >= 0x80
+}
+
+func (p *sqlDumpParser) word() string {
+	p.skipSpace()
+	j := p.i
+	for j < len(p.s) && isWordChar(p.s[j]) {
+		j++
+	}
+	return p.s[p.i:j]
+}
+
+func (p *sqlDumpParser) keyword(kw string) bool {
+	if w := p.word(); strings.EqualFold(w, kw) {
+		p.i += len(w)
+		return true
+	}
+	return false
+}
+
+func (p *sqlDumpParser) identifier() (string, bool) {
+	p.skipSpace()
+	if p.i < len(p.s) && p.s[p.i] == '`' {
+		var b strings.Builder
+		for j := p.i + 1; j < len(p.s); j++ {
+			if p.s[j] == '`' {
+				if j + 1 < len(p.s) && p.s[j+1] == '`' {
+					b.WriteByte('`')
+					j++
+					continue
+				}
+				p.i = j + 1
+				return b.String(), true
+			}
+			b.WriteByte(p.s[j])
+		}
+		return "", false
+	}
+	w := p.word()
+	p.i += len(w)
+	return w, w != ""
+}
+
+// NULL, TRUE, FALSE, numbers, strings (with charset introducer) and hex literals
+func (p *sqlDumpParser) literal() (scm.Scmer, bool) {
+	p.skipSpace()
+	if p.i >= len(p.s) {
+		return nil, false
+	}
+	c := p.s[p.i]
+	switch {
+		case c == '\'' || c == '"':
+			return p.stringLiteral()
+		case c == '_':
+			p.i += len(p.word()) // _binary, _utf8mb4 ...
+			p.skipSpace()
+			if p.i < len(p.s) && p.s[p.i] == '\'' {
+				return p.stringLiteral()
+			}
+			return nil, false
+		case c == '-' || c == '+' || c == '.' || c >= '0' && c <= '9':
+			if strings.HasPrefix(p.s[p.i:], "0x") {
+				w := p.word()
+				b, err := hex.DecodeString(w[2:])
+				if err != nil {
+					return nil, false
+				}
+				p.i += len(w)
+				return string(b), true
+			}
+			j := p.i + 1
+			for j < len(p.s) && (p.s[j] >= '0' && p.s[j] <= '9' || p.s[j] == '.' || p.s[j] == 'e' || p.s[j] == 'E' || (p.s[j] == '-' || p.s[j] == '+') && (p.s[j-1] == 'e' || p.s[j-1] == 'E')) {
+				j++
+			}
+			f, err := strconv.ParseFloat(p.s[p.i:j], 64)
+			if err != nil {
+				return nil, false
+			}
+			p.i = j
+			return f, true
+		case (c == 'x' || c == 'X') && p.i + 1 < len(p.s) && p.s[p.i+1] == '\'':
+			p.i++
+			s, ok := p.stringLiteral()
+			if !ok {
+				return nil, false
+			}
+			b, err := hex.DecodeString(s.(string))
+			return string(b), err == nil
+	}
+	switch strings.ToUpper(p.word()) {
+		case "NULL":
+			p.i += 4
+			return nil, true
+		case "TRUE":
+			p.i += 4
+			return true, true
+		case "FALSE":
+			p.i += 5
+			return false, true
+	}
+	return nil, false // expressions are left to parse_sql
+}
+
+// quoted string with MySQL's backslash escapes
+func (p *sqlDumpParser) stringLiteral() (scm.Scmer, bool) {
+	quote := p.s[p.i]
+	var b strings.Builder
+	for j := p.i + 1; j < len(p.s); j++ {
+		c := p.s[j]
+		if c == '\\' && j + 1 < len(p.s) {
+			j++
+			switch p.s[j] {
+				case '0':
+					b.WriteByte(0)
+				case 'b':
+					b.WriteByte('\b')
+				case 'n':
+					b.WriteByte('\n')
+				case 'r':
+					b.WriteByte('\r')
+				case 't':
+					b.WriteByte('\t')
+				case 'Z':
+					b.WriteByte(26)
+				case '%', '_':
+					b.WriteByte('\\') // kept for LIKE patterns
+					b.WriteByte(p.s[j])
+				default:
+					b.WriteByte(p.s[j])
+			}
+			continue
+		}
+		if c == quote {
+			if j + 1 < len(p.s) && p.s[j+1] == quote {
+				b.WriteByte(quote)
+				j++
+				continue
+			}
+			p.i = j + 1
+			return b.String(), true
+		}
+		b.WriteByte(c)
+	}
+	return nil, false
+}
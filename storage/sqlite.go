@@ -0,0 +1,638 @@
+/*
+Copyright (C) 2024  Carl-Philip Hänsch
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package storage
+
+import "os"
+import "fmt"
+import "math"
+import "strconv"
+import "strings"
+import "unicode/utf16"
+import "encoding/binary"
+import "github.com/launix-de/memcp/scm"
+
+/*
+
+SQLite import:
+ - loadSQLite reads a SQLite 3 database file without cgo and imports all of its tables
+ - the file is read page by page: the 100 byte header gives the page size and the text encoding,
+   page 1 is the root of sqlite_master (type, name, tbl_name, rootpage, sql)
+ - tables are b-trees: interior pages (5) point to children, leaf pages (13) hold rowid + record;
+   WITHOUT ROWID tables are index b-trees (2, 10) where also the interior cells hold rows
+ - payloads that don't fit into the page continue in a chain of overflow pages
+ - a record is a header of serial types (varints) followed by the values
+ - the columns are read from the CREATE TABLE statement in sqlite_master; their types are mapped by
+   SQLite's affinity rules; an INTEGER PRIMARY KEY column is an alias for the rowid and is NULL in the record
+ - indexes, views, triggers and the internal sqlite_ tables are not imported
+
+*/
+
+type sqliteFile struct {
+	f *os.File
+	pageSize int
+	usable int // page size without the reserved bytes at the end of each page
+	utf16 binary.ByteOrder // nil for UTF-8
+}
+
+type sqliteColumn struct {
+	name string
+	declared string // type name as declared
+	typ string
+	dims []int
+	notNull bool
+	primary bool
+	autoIncrement bool
+	def scm.Scmer // literal DEFAULT; older records lack columns that were added later
+	defSQL string
+	virtual bool // generated column that is not stored in the record
+}
+
+type sqliteTable struct {
+	name string
+	columns []sqliteColumn
+	primary []string
+	withoutRowid bool
+	rowidColumn int // INTEGER PRIMARY KEY column or -1
+}
+
+func LoadSQLite(schema, filename string) (int, []ImportError) {
+	if GetDatabase(schema) == nil {
+		panic("database " + schema + " does not exist")
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+	s := &sqliteFile{f: f}
+	s.readHeader()
+
+	// read sqlite_master first, so the import does not interleave two b-tree walks
+	type masterEntry struct {
+		name string
+		rootpage uint32
+		sql string
+	}
+	var tables []masterEntry
+	s.walk(1, 0, func (rowid int64, payload []byte) {
+		row := s.record(payload)
+		if len(row) >= 5 && row[0] == "table" && row[3] != nil && !strings.HasPrefix(strings.ToLower(scm.String(row[1])), "sqlite_") {
+			tables = append(tables, masterEntry{scm.String(row[1]), uint32(row[3].(int64)), scm.String(row[4])})
+		}
+	})
+
+	count := 0
+	var errors []ImportError
+	for _, entry := range tables {
+		func () {
+			defer func () {
+				if r := recover(); r != nil {
+					errors = append(errors, ImportError{0, "table " + entry.name + ": " + fmt.Sprint(r)})
+				}
+			}()
+			def := parseSQLiteTable(entry.name, entry.sql)
+			n, errs := s.importTable(schema, def, entry.rootpage)
+			count += n
+			errors = append(errors, errs...)
+		}()
+	}
+	return count, errors
+}
+
+func (s *sqliteFile) readHeader() {
+	header := make([]byte, 100)
+	if _, err := s.f.ReadAt(header, 0); err != nil || string(header[:16]) != "SQLite format 3\x00" {
+		panic("not a SQLite 3 database file")
+	}
+	s.pageSize = int(binary.BigEndian.Uint16(header[16:]))
+	if s.pageSize == 1 {
+		s.pageSize = 65536
+	}
+	if s.pageSize < 512 || s.pageSize & (s.pageSize - 1) != 0 {
+		panic(fmt.Sprintf("invalid SQLite page size %d", s.pageSize))
+	}
+	s.usable = s.pageSize - int(header[20])
+	switch binary.BigEndian.Uint32(header[56:]) {
+		case 0, 1:
+		case 2:
+			s.utf16 = binary.LittleEndian
+		case 3:
+			s.utf16 = binary.BigEndian
+		default:
+			panic("unknown SQLite text encoding")
+	}
+}
+
+func (s *sqliteFile) page(pgno uint32) []byte {
+	if pgno == 0 {
+		panic("corrupt SQLite file: page 0 referenced")
+	}
+	page := make([]byte, s.pageSize)
+	if _, err := s.f.ReadAt(page, int64(pgno - 1) * int64(s.pageSize)); err != nil {
+		panic(fmt.Sprintf("corrupt SQLite file: page %d: %v", pgno, err))
+	}
+	return page
+}
+
+// walks a table or index b-tree in key order and passes each cell's payload to visit (rowid is 0 for index b-trees)
+func (s *sqliteFile) walk(pgno uint32, depth int, visit func(int64, []byte)) {
+	if depth > 64 {
+		panic("corrupt SQLite file: b-tree too deep")
+	}
+	page := s.page(pgno)
+	hdr := 0
+	if pgno == 1 {
+		hdr = 100 // the file header is in front of the first page's b-tree header
+	}
+	typ := page[hdr]
+	cells := int(binary.BigEndian.Uint16(page[hdr+3:]))
+	pointers := hdr + 8
+	if typ == 2 || typ == 5 {
+		pointers = hdr + 12
+	}
+	for i := 0; i < cells; i++ {
+		pos := int(binary.BigEndian.Uint16(page[pointers + 2 * i:]))
+		switch typ {
+			case 13: // table leaf: payload size, rowid, payload
+				size, n := sqliteVarint(page[pos:])
+				pos += n
+				rowid, n := sqliteVarint(page[pos:])
+				pos += n
+				visit(int64(rowid), s.payload(page, pos, int(size), false))
+			case 5: // table interior: left child, key
+				s.walk(binary.BigEndian.Uint32(page[pos:]), depth + 1, visit)
+			case 10: // index leaf: payload size, payload
+				size, n := sqliteVarint(page[pos:])
+				visit(0, s.payload(page, pos + n, int(size), true))
+			case 2: // index interior: left child, payload size, payload
+				s.walk(binary.BigEndian.Uint32(page[pos:]), depth + 1, visit)
+				size, n := sqliteVarint(page[pos+4:])
+				visit(0, s.payload(page, pos + 4 + n, int(size), true))
+			default:
+				panic(fmt.Sprintf("corrupt SQLite file: page %d has type %d", pgno, typ))
+		}
+	}
+	if typ == 2 || typ == 5 {
+		s.walk(binary.BigEndian.Uint32(page[hdr+8:]), depth + 1, visit) // right-most child
+	}
+}
+
+// payload of a cell; the part that does not fit into the page is read from the overflow pages
+func (s *sqliteFile) payload(page []byte, pos, size int, index bool) []byte {
+	maxLocal := s.usable - 35
+	if index {
+		maxLocal = (s.usable - 12) * 64 / 255 - 23
+	}
+	if size <= maxLocal {
+		return page[pos:pos+size]
+	}
+	minLocal := (s.usable - 12) * 32 / 255 - 23
+	local := minLocal + (size - minLocal) % (s.usable - 4)
+	if local > maxLocal {
+		local = minLocal
+	}
+	result := make([]byte, 0, size)
+	result = append(result, page[pos:pos+local]...)
+	next := binary.BigEndian.Uint32(page[pos+local:])
+	for len(result) < size && next != 0 {
+		overflow := s.page(next)
+		next = binary.BigEndian.Uint32(overflow)
+		n := size - len(result)
+		if n > s.usable - 4 {
+			n = s.usable - 4
+		}
+		result = append(result, overflow[4:4+n]...)
+	}
+	if len(result) < size {
+		panic("corrupt SQLite file: overflow chain too short")
+	}
+	return result
+}
+
+func sqliteVarint(b []byte) (uint64, int) {
+	var v uint64
+	for i := 0; i < 8; i++ {
+		v = v << 7 | uint64(b[i] & 0x7f)
+		if b[i] < 0x80 {
+			return v, i + 1
+		}
+	}
+	return v << 8 | uint64(b[8]), 9
+}
+
+// decodes the values of a record
+func (s *sqliteFile) record(data []byte) []scm.Scmer {
+	headerSize, pos := sqliteVarint(data)
+	var types []uint64
+	for pos < int(headerSize) {
+		t, n := sqliteVarint(data[pos:])
+		types = append(types, t)
+		pos += n
+	}
+	values := make([]scm.Scmer, len(types))
+	pos = int(headerSize)
+	for i, t := range types {
+		switch {
+			case t == 0:
+				values[i] = nil
+			case t <= 6: // big-endian two's complement integers of 1, 2, 3, 4, 6 and 8 bytes
+				size := [...]int{0, 1, 2, 3, 4, 6, 8}[t]
+				v := int64(int8(data[pos])) // sign of the first byte
+				for _, b := range data[pos+1:pos+size] {
+					v = v << 8 | int64(b)
+				}
+				values[i] = v // int64, so the column converter sees integers beyond 2^53 exactly
+				pos += size
+			case t == 7:
+				values[i] = math.Float64frombits(binary.BigEndian.Uint64(data[pos:]))
+				pos += 8
+			case t == 8:
+				values[i] = int64(0)
+			case t == 9:
+				values[i] = int64(1)
+			case t >= 12 && t % 2 == 0: // blob
+				size := int(t - 12) / 2
+				values[i] = string(data[pos:pos+size])
+				pos += size
+			case t >= 13: // text
+				size := int(t - 13) / 2
+				values[i] = s.text(data[pos:pos+size])
+				pos += size
+			default:
+				panic(fmt.Sprintf("invalid serial type %d", t))
+		}
+	}
+	return values
+}
+
+func (s *sqliteFile) text(b []byte) string {
+	if s.utf16 == nil {
+		return string(b)
+	}
+	units := make([]uint16, len(b) / 2)
+	for i := range units {
+		units[i] = s.utf16.Uint16(b[2*i:])
+	}
+	return string(utf16.Decode(units))
+}
+
+// creates the table (or the missing columns) and inserts the rows of the b-tree
+func (s *sqliteFile) importTable(schema string, def sqliteTable, rootpage uint32) (int, []ImportError) {
+	t, created := CreateTable(schema, def.name, Safe, true)
+	cols := make([]string, 0, len(def.columns))
+	colIndex := make([]int, len(def.columns)) // position in cols of each column
+	for i, c := range def.columns {
+		if c.virtual {
+			continue
+		}
+		colIndex[i] = len(cols)
+		extrainfo := ""
+		if c.notNull {
+			extrainfo = "NOT NULL"
+		}
+		if c.autoIncrement {
+			extrainfo += " AUTO_INCREMENT"
+		}
+		if c.defSQL != "" {
+			extrainfo += " DEFAULT " + c.defSQL
+		}
+		t.CreateColumn(c.name, c.typ, c.dims, strings.TrimSpace(extrainfo))
+		cols = append(cols, c.name)
+	}
+	if created && len(def.primary) > 0 {
+		t.schema.schemalock.Lock()
+		t.Unique = append(t.Unique, uniqueKey{"PRIMARY", def.primary})
+		t.schema.save()
+		t.schema.schemalock.Unlock()
+	}
+
+	// position of each column's value in the record
+	fields := make([]int, 0, len(cols))
+	if def.withoutRowid {
+		// the record starts with the primary key columns
+		for _, pk := range def.primary {
+			for i, c := range def.columns {
+				if c.name == pk {
+					fields = append(fields, i)
+				}
+			}
+		}
+		for i, c := range def.columns {
+			if !c.primary && !c.virtual {
+				fields = append(fields, i)
+			}
+		}
+	} else {
+		for i, c := range def.columns {
+			if !c.virtual {
+				fields = append(fields, i)
+			}
+		}
+	}
+	// converters of the target columns (rows that don't fit are skipped one by one)
+	t.schema.schemalock.Lock()
+	converters := make([]func(scm.Scmer) scm.Scmer, len(cols))
+	for i, col := range cols {
+		for j, c := range t.Columns {
+			if c.Name == col {
+				converters[i] = t.converter(&t.Columns[j])
+			}
+		}
+	}
+	t.schema.schemalock.Unlock()
+
+	count := 0
+	var errors []ImportError
+	var batch [][]scm.Scmer
+	var lines []int
+	flush := func () {
+		if len(batch) > 0 {
+			n, errs := t.importRows(cols, batch, lines) // rows that fail on insert are skipped one by one
+			count += n
+			errors = append(errors, errs...)
+			batch, lines = nil, nil
+		}
+	}
+	rownum := 0
+	s.walk(rootpage, 0, func (rowid int64, payload []byte) {
+		rownum++
+		defer func () {
+			if r := recover(); r != nil {
+				errors = append(errors, ImportError{rownum, fmt.Sprint(r)})
+			}
+		}()
+		values := s.record(payload)
+		row := make([]scm.Scmer, len(cols))
+		for f, i := range fields {
+			if f < len(values) {
+				row[colIndex[i]] = values[f]
+			} else {
+				row[colIndex[i]] = def.columns[i].def // records of older rows lack columns added later
+			}
+		}
+		if def.rowidColumn >= 0 {
+			row[colIndex[def.rowidColumn]] = rowid
+		}
+		for i, v := range row {
+			if v != nil && converters[i] != nil {
+				row[i] = converters[i](v)
+			} else if x, ok := v.(int64); ok {
+				row[i] = scm.Simplify(strconv.FormatInt(x, 10)) // untyped column: float64 or the digits if that would round
+			}
+		}
+		batch = append(batch, row)
+		lines = append(lines, rownum)
+		if len(batch) >= 4096 {
+			flush()
+		}
+	})
+	flush()
+	return count, errors
+}
+
+// reads the columns and the primary key from the CREATE TABLE statement in sqlite_master
+func parseSQLiteTable(name, sql string) sqliteTable {
+	tokens := tokenizeSQLite(sql)
+	start := 0
+	for start < len(tokens) && tokens[start] != "(" {
+		start++
+	}
+	if start == len(tokens) {
+		panic("cannot read the columns of: " + sql)
+	}
+	def := sqliteTable{name: name, rowidColumn: -1}
+	// split the definitions at the top level commas
+	var defs [][]string
+	depth, current := 0, []string{}
+	end := start + 1
+	for ; end < len(tokens); end++ {
+		tok := tokens[end]
+		if tok == "(" {
+			depth++
+		} else if tok == ")" {
+			if depth == 0 {
+				break
+			}
+			depth--
+		} else if tok == "," && depth == 0 {
+			defs = append(defs, current)
+			current = []string{}
+			continue
+		}
+		current = append(current, tok)
+	}
+	defs = append(defs, current)
+	for _, tok := range tokens[end:] {
+		if strings.EqualFold(tok, "ROWID") {
+			def.withoutRowid = true // WITHOUT ROWID
+		}
+	}
+
+	for _, d := range defs {
+		if len(d) == 0 {
+			continue
+		}
+		switch strings.ToUpper(d[0]) {
+			case "CONSTRAINT", "PRIMARY", "UNIQUE", "CHECK", "FOREIGN":
+				// table constraint
+				for i := 0; i + 1 < len(d); i++ {
+					if strings.EqualFold(d[i], "PRIMARY") && strings.EqualFold(d[i+1], "KEY") {
+						def.primary = nil
+						for j := i + 3; j < len(d) && d[j] != ")"; j++ {
+							if d[j-1] == "(" || d[j-1] == "," {
+								def.primary = append(def.primary, sqliteIdentifier(d[j]))
+							}
+						}
+					}
+				}
+				continue
+		}
+		c := sqliteColumn{name: sqliteIdentifier(d[0])}
+		// the type name ends at the first constraint
+		i := 1
+		var typ []string
+		for ; i < len(d); i++ {
+			switch strings.ToUpper(d[i]) {
+				case "CONSTRAINT", "PRIMARY", "NOT", "NULL", "UNIQUE", "CHECK", "DEFAULT", "COLLATE", "REFERENCES", "GENERATED", "AS":
+					goto constraints
+			}
+			typ = append(typ, d[i])
+		}
+		constraints:
+		generated, stored := false, false
+		for ; i < len(d); i++ {
+			switch strings.ToUpper(d[i]) {
+				case "PRIMARY":
+					c.primary = true
+					def.primary = []string{c.name}
+				case "NOT":
+					if i + 1 < len(d) && strings.EqualFold(d[i+1], "NULL") {
+						c.notNull = true
+					}
+				case "AUTOINCREMENT":
+					c.autoIncrement = true
+				case "DEFAULT":
+					if i + 1 < len(d) && d[i+1] != "(" {
+						c.def, c.defSQL = sqliteLiteral(d[i+1])
+					}
+				case "AS":
+					generated = true
+				case "STORED":
+					stored = true
+			}
+		}
+		c.virtual = generated && !stored
+		c.declared = strings.ToUpper(strings.Join(typ, " "))
+		c.typ, c.dims = sqliteType(typ)
+		def.columns = append(def.columns, c)
+	}
+	// mark the primary key columns of a table constraint
+	for _, pk := range def.primary {
+		for i := range def.columns {
+			if def.columns[i].name == pk {
+				def.columns[i].primary = true
+			}
+		}
+	}
+	if !def.withoutRowid && len(def.primary) == 1 {
+		for i, c := range def.columns {
+			if c.name == def.primary[0] && c.declared == "INTEGER" {
+				def.rowidColumn = i // INTEGER PRIMARY KEY is the rowid
+				def.columns[i].autoIncrement = true
+			}
+		}
+	}
+	return def
+}
+
+// maps a declared type by SQLite's affinity rules onto a memcp type
+func sqliteType(tokens []string) (string, []int) {
+	var name []string
+	var dims []int
+	for i := 0; i < len(tokens); i++ {
+		if tokens[i] == "(" {
+			for i++; i < len(tokens) && tokens[i] != ")"; i++ {
+				if tokens[i] != "," {
+					dims = append(dims, scm.ToInt(tokens[i]))
+				}
+			}
+		} else {
+			name = append(name, strings.ToUpper(tokens[i]))
+		}
+	}
+	declared := strings.Join(name, " ")
+	switch {
+		case strings.Contains(declared, "INT"):
+			return "BIGINT", []int{} // SQLite integers have 64 bits
+		case strings.Contains(declared, "CHAR") || strings.Contains(declared, "CLOB") || strings.Contains(declared, "TEXT"):
+			return "LONGTEXT", []int{} // SQLite does not enforce lengths like VARCHAR(n)
+		case declared == "" || strings.Contains(declared, "BLOB"):
+			return "ANY", []int{}
+		case strings.Contains(declared, "REAL") || strings.Contains(declared, "FLOA") || strings.Contains(declared, "DOUB"):
+			return "DOUBLE", []int{}
+		case (strings.HasPrefix(declared, "DEC") || strings.HasPrefix(declared, "NUMERIC")) && len(dims) > 0:
+			return "DECIMAL", dims
+		case strings.HasPrefix(declared, "BOOL"):
+			return "BOOLEAN", []int{}
+	}
+	return "ANY", []int{} // NUMERIC affinity keeps whatever was stored (e.g. dates as text)
+}
+
+// value and SQL representation of a DEFAULT literal
+func sqliteLiteral(tok string) (scm.Scmer, string) {
+	if strings.HasPrefix(tok, "'") {
+		s := strings.ReplaceAll(tok[1:len(tok)-1], "''", "'")
+		return s, sqlString(s)
+	}
+	if f, err := strconv.ParseFloat(tok, 64); err == nil {
+		return f, tok
+	}
+	switch strings.ToUpper(tok) {
+		case "TRUE":
+			return float64(1), "1"
+		case "FALSE":
+			return float64(0), "0"
+	}
+	return nil, "" // NULL, CURRENT_TIMESTAMP and the like
+}
+
+func sqliteIdentifier(tok string) string {
+	if len(tok) >= 2 {
+		switch tok[0] {
+			case '"', '`':
+				return strings.ReplaceAll(tok[1:len(tok)-1], tok[:1] + tok[:1], tok[:1])
+			case '[':
+				return tok[1:len(tok)-1]
+		}
+	}
+	return tok
+}
+
+// splits SQL into words, quoted identifiers, strings and single punctuation characters
+func tokenizeSQLite(sql string) []string {
+	var tokens []string
+	for i := 0; i < len(sql); {
+		c := sql[i]
+		switch {
+			case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+				i++
+			case c == '-' && i + 1 < len(sql) && sql[i+1] == '-':
+				for i < len(sql) && sql[i] != '\n' {
+					i++
+				}
+			case c == '/' && i + 1 < len(sql) && sql[i+1] == '*':
+				end := strings.Index(sql[i+2:], "*/")
+				if end < 0 {
+					i = len(sql)
+				} else {
+					i += end + 4
+				}
+			case c == '\'' || c == '"' || c == '`' || c == '[':
+				closing := c
+				if c == '[' {
+					closing = ']'
+				}
+				j := i + 1
+				for j < len(sql) {
+					if sql[j] == closing {
+						if closing != ']' && j + 1 < len(sql) && sql[j+1] == closing {
+							j += 2 // doubled quote
+							continue
+						}
+						break
+					}
+					j++
+				}
+				if j < len(sql) {
+					j++
+				}
+				tokens = append(tokens, sql[i:j])
+				i = j
+			case c == '_' || c == '.' || c == '+' || c == '-' || c >= '0' && c <= '9' || c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= 0x80:
+				j := i + 1
+				for j < len(sql) && (sql[j] == '_' || sql[j] == '.' || sql[j] == '$' || sql[j] >= '0' && sql[j] <= '9' || sql[j] >= 'A' && sql[j] <= 'Z' || sql[j] >= 'a' && sql[j] <= 'z' || sql[j] >= 0x80) {
+					j++
+				}
+				tokens = append(tokens, sql[i:j])
+				i = j
+			default:
+				tokens = append(tokens, sql[i:i+1])
+				i++
+		}
+	}
+	return tokens
+}
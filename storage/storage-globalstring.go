@@ -0,0 +1,293 @@
+/*
+Copyright (C) 2024  Carl-Philip Hänsch
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package storage
+
+import "io"
+import "os"
+import "fmt"
+import "sync"
+import "bufio"
+import "sync/atomic"
+import "encoding/json"
+import "encoding/binary"
+import "github.com/google/uuid"
+import "github.com/launix-de/memcp/scm"
+
+/*
+
+global dictionaries:
+ - a table can declare a shared dictionary for a string column
+ - all shards of that table encode the column with codes from the same dictionary
+ - codes are append-only and stable, so two shards with equal codes hold equal strings
+ - the dictionary is stored in <uuid>.dict (jsonl of strings); new entries are appended and synced
+   before any column file that uses their codes is written, so shards and schema.json never reference
+   a code that is missing on disk
+
+*/
+
+type globalDictionary struct {
+	Column string
+	Uuid uuid.UUID
+	values atomic.Pointer[[]string] // code -> string; only grows, so readers don't need a lock
+	reverseMap map[string]uint
+	mu sync.Mutex // write lock for reverseMap, values and saved
+	saved int // amount of entries already on disk
+	t *table // owner (for the path and the persistency mode)
+}
+
+func newGlobalDictionary(t *table, col string) *globalDictionary {
+	result := new(globalDictionary)
+	result.t = t
+	result.Column = col
+	result.Uuid, _ = uuid.NewRandom()
+	result.reverseMap = make(map[string]uint)
+	values := make([]string, 0)
+	result.values.Store(&values)
+	return result
+}
+
+func (d *globalDictionary) Count() uint {
+	return uint(len(*d.values.Load()))
+}
+
+func (d *globalDictionary) Size() uint {
+	var result uint = 64
+	for _, v := range *d.values.Load() {
+		result += uint(len(v)) + 16 + 24 // string header + reverse map entry
+	}
+	return result
+}
+
+// returns the code of a string; unknown strings are added to the dictionary
+func (d *globalDictionary) Code(v string) uint {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	code, ok := d.reverseMap[v]
+	if !ok {
+		values := *d.values.Load()
+		code = uint(len(values))
+		values = append(values, v) // may reallocate, so publish the new slice header atomically
+		d.values.Store(&values)
+		d.reverseMap[v] = code
+	}
+	return code
+}
+
+func (d *globalDictionary) Get(code uint) string {
+	return (*d.values.Load())[code]
+}
+
+func (d *globalDictionary) filename(t *table) string {
+	return t.schema.path + d.Uuid.String() + ".dict"
+}
+
+func (d *globalDictionary) load(t *table) {
+	d.t = t
+	d.reverseMap = make(map[string]uint)
+	values := make([]string, 0)
+	if t.PersistencyMode != Memory {
+		if f, err := os.Open(d.filename(t)); err == nil {
+			scanner := bufio.NewScanner(f)
+			scanner.Buffer(make([]byte, 64*1024), 1024*1024*1024)
+			var good int64 // end of the last complete entry
+			for scanner.Scan() {
+				var v string
+				if json.Unmarshal(scanner.Bytes(), &v) != nil {
+					break // torn append of a crash: no column references these codes
+				}
+				good += int64(len(scanner.Bytes())) + 1
+				d.reverseMap[v] = uint(len(values))
+				values = append(values, v)
+			}
+			f.Close()
+			if st, err := os.Stat(d.filename(t)); err == nil && st.Size() > good {
+				os.Truncate(d.filename(t), good) // so the next append starts at a line boundary
+			}
+		}
+	}
+	d.values.Store(&values)
+	d.saved = len(values)
+}
+
+// appends the entries that are not on disk yet; called before a column that uses them is written
+func (d *globalDictionary) save() {
+	if d.t == nil || d.t.PersistencyMode == Memory {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	values := *d.values.Load()
+	if len(values) == d.saved {
+		return // nothing changed
+	}
+	f, err := os.OpenFile(d.filename(d.t), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	for _, v := range values[d.saved:] {
+		b, _ := json.Marshal(v)
+		w.Write(b)
+		w.WriteString("\n")
+	}
+	if err := w.Flush(); err != nil {
+		panic(err)
+	}
+	if err := f.Sync(); err != nil {
+		panic(err) // shards must not reference codes that might not be on disk
+	}
+	d.saved = len(values)
+}
+
+func (d *globalDictionary) RemoveFromDisk(t *table) {
+	os.Remove(d.filename(t))
+}
+
+func (t *table) getDictionary(col string) *globalDictionary {
+	for _, d := range t.Dictionaries {
+		if d.Column == col {
+			return d
+		}
+	}
+	return nil
+}
+
+func (t *table) findDictionary(id uuid.UUID) *globalDictionary {
+	for _, d := range t.Dictionaries {
+		if d.Uuid == id {
+			return d
+		}
+	}
+	return nil
+}
+
+// declares a shared dictionary for a column; shards pick it up on their next rebuild
+func (t *table) CreateDictionary(col string) bool {
+	t.schema.schemalock.Lock()
+	defer t.schema.schemalock.Unlock()
+	found := false
+	for _, c := range t.Columns {
+		if c.Name == col {
+			found = true
+		}
+	}
+	if !found {
+		panic("column " + t.Name + "." + col + " does not exist")
+	}
+	if t.getDictionary(col) != nil {
+		return false // already has a dictionary
+	}
+	t.Dictionaries = append(t.Dictionaries, newGlobalDictionary(t, col))
+	t.schema.save()
+	return true
+}
+
+// removes the shared dictionary of a column; must only be called when no shard references it anymore
+func (t *table) dropDictionary(col string) {
+	for i, d := range t.Dictionaries {
+		if d.Column == col {
+			d.RemoveFromDisk(t)
+			t.Dictionaries = append(t.Dictionaries[:i], t.Dictionaries[i+1:]...)
+			return
+		}
+	}
+}
+
+// replaces a proposed string storage with a global dictionary storage if the table has a dictionary for that column
+func (t *table) useGlobalDictionary(col string, proposed ColumnStorage) ColumnStorage {
+	if _, ok := proposed.(*StorageString); ok {
+		if d := t.getDictionary(col); d != nil {
+			result := new(StorageGlobalString)
+			result.dict = d
+			result.dictid = d.Uuid
+			return result
+		}
+	}
+	return proposed
+}
+
+type StorageGlobalString struct {
+	values StorageInt // codes into dict
+	dict *globalDictionary
+	dictid uuid.UUID // to restore dict after Deserialize
+}
+
+func (s *StorageGlobalString) Size() uint {
+	return s.values.Size() + 16 + 8 // the dictionary itself is accounted on table level
+}
+
+func (s *StorageGlobalString) String() string {
+	return fmt.Sprintf("string-globaldict[%d entries]", s.dict.Count())
+}
+
+func (s *StorageGlobalString) Serialize(f io.Writer) {
+	s.dict.save() // the codes must be on disk before the column that references them
+	binary.Write(f, binary.LittleEndian, uint8(22)) // 22 = StorageGlobalString
+	io.WriteString(f, "1234567") // dummy
+	f.Write(s.dictid[:])
+	s.values.Serialize(f)
+}
+
+func (s *StorageGlobalString) Deserialize(f io.Reader) uint {
+	var dummy [7]byte
+	f.Read(dummy[:])
+	f.Read(s.dictid[:])
+	// s.dict is restored by the shard loader since we have no table reference here
+	return s.values.DeserializeEx(f, true)
+}
+
+func (s *StorageGlobalString) GetValue(i uint) scm.Scmer {
+	code := s.values.GetValueUInt(i)
+	if s.values.hasNull && code == s.values.null {
+		return nil
+	}
+	return s.dict.Get(uint(int64(code) + s.values.offset))
+}
+
+func (s *StorageGlobalString) prepare() {
+	s.values.prepare()
+}
+func (s *StorageGlobalString) scan(i uint, value scm.Scmer) {
+	switch v := value.(type) {
+		case scm.LazyString:
+			s.values.scan(i, s.dict.Code(v.GetValue()))
+		case string:
+			s.values.scan(i, s.dict.Code(v))
+		default:
+			s.values.scan(i, nil) // NULL
+	}
+}
+func (s *StorageGlobalString) init(i uint) {
+	s.values.init(i)
+}
+func (s *StorageGlobalString) build(i uint, value scm.Scmer) {
+	switch v := value.(type) {
+		case scm.LazyString:
+			s.values.build(i, s.dict.Code(v.GetValue()))
+		case string:
+			s.values.build(i, s.dict.Code(v))
+		default:
+			s.values.build(i, nil)
+	}
+}
+func (s *StorageGlobalString) finish() {
+	s.values.finish()
+}
+func (s *StorageGlobalString) proposeCompression(i uint) ColumnStorage {
+	return nil
+}
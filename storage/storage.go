@@ -57,6 +57,7 @@ var storages = map[uint8]reflect.Type {
 	12: reflect.TypeOf(StorageFloat{}),
 	20: reflect.TypeOf(StorageString{}),
 	21: reflect.TypeOf(StoragePrefix{}),
+	22: reflect.TypeOf(StorageGlobalString{}),
 	//30: reflect.TypeOf(OverlaySCMER{}),
 	31: reflect.TypeOf(OverlayBlob{}),
 }
@@ -344,8 +345,8 @@ func Init(en scm.Env) {
 		[]scm.DeclarationParameter{
 			scm.DeclarationParameter{"schema", "string", "name of the database"},
 			scm.DeclarationParameter{"table", "string", "name of the new table"},
-			scm.DeclarationParameter{"cols", "list", "list of columns and constraints, each '(\"column\" colname typename dimensions typeparams) where dimensions is a list of 0-2 numeric items or '(\"primary\" cols) or '(\"unique\" cols) or '(\"foreign\" cols tbl2 cols2)"},
-			scm.DeclarationParameter{"options", "list", "further options like engine=safe|sloppy|memory"},
+			scm.DeclarationParameter{"cols", "list", "list of columns and constraints, each '(\"column\" colname typename dimensions typeparams) where dimensions is a list of 0-2 numeric items and typeparams is a string of column options like NOT NULL, DEFAULT value or AUTO_INCREMENT or '(\"primary\" cols) or '(\"unique\" cols) or '(\"foreign\" cols tbl2 cols2) or '(\"index\" id cols) or '(\"check\" id cols code) where code is the condition in which each of cols is a symbol; a column can be followed by cols code mode to make it GENERATED ALWAYS AS code (mode STORED or VIRTUAL)"},
+			scm.DeclarationParameter{"options", "list", "further options like engine=safe|sloppy|memory or partition_time=(column interval retention)"},
 			scm.DeclarationParameter{"ifnotexists", "bool", "don't throw an error if table already exists"},
 		}, "bool",
 		func (a ...scm.Scmer) scm.Scmer {
@@ -361,6 +362,8 @@ func Init(en scm.Env) {
 					// TODO: store the collation??
 				} else if options[i] == "auto_increment" {
 					auto_increment, _ = strconv.ParseUint(scm.String(options[i+1]), 0, 64)
+				} else if options[i] == "partition_time" {
+					// applied after the columns have been created
 				} else {
 					panic("unknown option: " + scm.String(options[i]))
 				}
@@ -418,6 +421,10 @@ func Init(en scm.Env) {
 						}
 						fmt.Println("!----! created foreign key")
 					} else
+					if def[0] == "check" {
+						// id cols code
+						t.AddCheck(scm.String(def[1]), stringList(def[2]), def[3])
+					} else
 					if def[0] == "column" {
 						// normal column
 						colname := scm.String(def[1])
@@ -447,6 +454,24 @@ func Init(en scm.Env) {
 						}
 					}
 				}
+				for _, coldef := range(a[2].([]scm.Scmer)) {
+					// generated columns and indexes are declared after all columns exist
+					if def := coldef.([]scm.Scmer); len(def) > 7 && def[0] == "column" {
+						t.GenerateColumn(scm.String(def[1]), stringList(def[5]), def[6], scm.String(def[7]))
+					}
+				}
+				for _, coldef := range(a[2].([]scm.Scmer)) {
+					if def := coldef.([]scm.Scmer); len(def) > 0 && def[0] == "index" {
+						t.CreateIndex(scm.String(def[1]), indexKeyList(def[2]), false)
+					}
+				}
+				for i := 0; i < len(options); i += 2 {
+					if options[i] == "partition_time" {
+						// column interval retention
+						p := options[i+1].([]scm.Scmer)
+						t.PartitionByTime(scm.String(p[0]), scm.ToFloat(p[1]), scm.ToFloat(p[2]))
+					}
+				}
 			}
 			return true
 		},
@@ -460,7 +485,7 @@ func Init(en scm.Env) {
 			scm.DeclarationParameter{"colname", "string", "name of the new column"},
 			scm.DeclarationParameter{"type", "string", "name of the basetype"},
 			scm.DeclarationParameter{"dimensions", "list", "dimensions of the type (e.g. for decimal)"},
-			scm.DeclarationParameter{"options", "string", "further options like AUTO_INCREMENT or NOT NULL"},
+			scm.DeclarationParameter{"options", "string", "column options like NOT NULL, DEFAULT value or AUTO_INCREMENT"},
 			scm.DeclarationParameter{"computorCols", "list", "list of columns that is passed into params of computor"},
 			scm.DeclarationParameter{"computor", "func", "lambda expression that can take other column values and computes the value of that column"},
 		}, "bool",
@@ -505,6 +530,44 @@ func Init(en scm.Env) {
 			return ok
 		},
 	})
+	scm.Declare(&en, &scm.Declaration{
+		"altercolumn", "changes name, type and options of a column (MODIFY, CHANGE and RENAME COLUMN); existing values are converted to the new type",
+		4, 7,
+		[]scm.DeclarationParameter{
+			scm.DeclarationParameter{"schema", "string", "name of the database"},
+			scm.DeclarationParameter{"table", "string", "name of the table"},
+			scm.DeclarationParameter{"colname", "string", "name of the column"},
+			scm.DeclarationParameter{"newname", "string", "new name of the column"},
+			scm.DeclarationParameter{"type", "string", "name of the new basetype; if omitted or nil, only the name is changed"},
+			scm.DeclarationParameter{"dimensions", "list", "dimensions of the type (e.g. for decimal)"},
+			scm.DeclarationParameter{"options", "string", "column options like NOT NULL, DEFAULT value, AUTO_INCREMENT or FIRST/AFTER col"},
+		}, "bool",
+		func (a ...scm.Scmer) scm.Scmer {
+			db := GetDatabase(scm.String(a[0]))
+			if db == nil {
+				panic("database " + scm.String(a[0]) + " does not exist")
+			}
+			t := db.Tables.Get(scm.String(a[1]))
+			if t == nil {
+				panic("table " + scm.String(a[0]) + "." + scm.String(a[1]) + " does not exist")
+			}
+			typename := ""
+			dimensions := []int{}
+			typeparams := ""
+			if len(a) > 4 && a[4] != nil {
+				typename = scm.String(a[4])
+				if len(a) > 5 {
+					for _, d := range a[5].([]scm.Scmer) {
+						dimensions = append(dimensions, scm.ToInt(d))
+					}
+				}
+				if len(a) > 6 {
+					typeparams = scm.String(a[6])
+				}
+			}
+			return t.AlterColumn(scm.String(a[2]), scm.String(a[3]), typename, dimensions, typeparams)
+		},
+	})
 	scm.Declare(&en, &scm.Declaration{
 		"shardcolumn", "tells us how it would partition a column according to their values. Returns a list of pivot elements.",
 		3, 4,
@@ -590,14 +653,42 @@ func Init(en scm.Env) {
 			}
 		},
 	})
+	scm.Declare(&en, &scm.Declaration{
+		"partitionbytime", "partitions a table by fixed time intervals of a column. New partitions are created as data arrives; partitions older than the retention are dropped on rebuild.",
+		4, 5,
+		[]scm.DeclarationParameter{
+			scm.DeclarationParameter{"schema", "string", "name of the database"},
+			scm.DeclarationParameter{"table", "string", "name of the table"},
+			scm.DeclarationParameter{"column", "string", "column holding a unix timestamp or a date string"},
+			scm.DeclarationParameter{"interval", "number", "width of one partition in seconds"},
+			scm.DeclarationParameter{"retention", "number", "drop partitions that are older than that many seconds (default: 0 = keep forever)"},
+		}, "bool",
+		func (a ...scm.Scmer) scm.Scmer {
+			// get tbl
+			db := GetDatabase(scm.String(a[0]))
+			if db == nil {
+				panic("database " + scm.String(a[0]) + " does not exist")
+			}
+			t := db.Tables.Get(scm.String(a[1]))
+			if t == nil {
+				panic("table " + scm.String(a[0]) + "." + scm.String(a[1]) + " does not exist")
+			}
+			retention := 0.0
+			if len(a) > 4 {
+				retention = scm.ToFloat(a[4])
+			}
+			t.PartitionByTime(scm.String(a[2]), scm.ToFloat(a[3]), retention)
+			return true
+		},
+	})
 	scm.Declare(&en, &scm.Declaration{
 		"altertable", "alters a table",
 		4, 4,
 		[]scm.DeclarationParameter{
 			scm.DeclarationParameter{"schema", "string", "name of the database"},
 			scm.DeclarationParameter{"table", "string", "name of the new table"},
-			scm.DeclarationParameter{"operation", "string", "one of drop|engine|collation|auto_increment"},
-			scm.DeclarationParameter{"parameter", "any", "name of the column to drop or value of the parameter"},
+			scm.DeclarationParameter{"operation", "string", "one of drop|engine|collation|auto_increment|dictionary|check|dropcheck|generated"},
+			scm.DeclarationParameter{"parameter", "any", "name of the column to drop, name of the column that gets a shared string dictionary over all shards, '(id cols code) of a new check constraint, name of the check constraint to drop, '(col cols code mode) to make a column GENERATED ALWAYS AS code in mode STORED or VIRTUAL, or value of the parameter"},
 		}, "bool",
 		func (a ...scm.Scmer) scm.Scmer {
 			// get tbl
@@ -613,12 +704,103 @@ func Init(en scm.Env) {
 			switch a[2] {
 			case "drop":
 				return t.DropColumn(scm.String(a[3]))
+			case "dictionary":
+				return t.CreateDictionary(scm.String(a[3]))
+			case "check":
+				def := a[3].([]scm.Scmer)
+				t.AddCheck(scm.String(def[0]), stringList(def[1]), def[2])
+			case "dropcheck":
+				return t.DropCheck(scm.String(a[3]))
+			case "generated":
+				def := a[3].([]scm.Scmer)
+				t.GenerateColumn(scm.String(def[0]), stringList(def[1]), def[2], scm.String(def[3]))
 			default:
 				panic("unimplemented alter table operation: " + scm.String(a[2]))
 			}
 			return true
 		},
 	})
+	scm.Declare(&en, &scm.Declaration{
+		"createindex", "declares an index over one or more columns that is built in all shards and persisted in the schema",
+		4, 5,
+		[]scm.DeclarationParameter{
+			scm.DeclarationParameter{"schema", "string", "name of the database"},
+			scm.DeclarationParameter{"table", "string", "name of the table"},
+			scm.DeclarationParameter{"index", "string", "name of the index"},
+			scm.DeclarationParameter{"cols", "list", "list of columns in the sort order of the index; a key part can also be an expression over columns like (toLower email)"},
+			scm.DeclarationParameter{"ifnotexists", "bool", "if true, don't throw an error if the index already exists"},
+		}, "bool",
+		func (a ...scm.Scmer) scm.Scmer {
+			db := GetDatabase(scm.String(a[0]))
+			if db == nil {
+				panic("database " + scm.String(a[0]) + " does not exist")
+			}
+			t := db.Tables.Get(scm.String(a[1]))
+			if t == nil {
+				panic("table " + scm.String(a[0]) + "." + scm.String(a[1]) + " does not exist")
+			}
+			return t.CreateIndex(scm.String(a[2]), indexKeyList(a[3]), len(a) > 4 && scm.ToBool(a[4]))
+		},
+	})
+	scm.Declare(&en, &scm.Declaration{
+		"dropindex", "removes a declared index",
+		3, 4,
+		[]scm.DeclarationParameter{
+			scm.DeclarationParameter{"schema", "string", "name of the database"},
+			scm.DeclarationParameter{"table", "string", "name of the table"},
+			scm.DeclarationParameter{"index", "string", "name of the index"},
+			scm.DeclarationParameter{"ifexists", "bool", "if true, don't throw an error if the index does not exist"},
+		}, "bool",
+		func (a ...scm.Scmer) scm.Scmer {
+			db := GetDatabase(scm.String(a[0]))
+			if db == nil {
+				panic("database " + scm.String(a[0]) + " does not exist")
+			}
+			t := db.Tables.Get(scm.String(a[1]))
+			if t == nil {
+				panic("table " + scm.String(a[0]) + "." + scm.String(a[1]) + " does not exist")
+			}
+			return t.DropIndex(scm.String(a[2]), len(a) > 3 && scm.ToBool(a[3]))
+		},
+	})
+	scm.Declare(&en, &scm.Declaration{
+		"showindex", "lists the unique keys, declared indexes and automatically created indexes of a table as a list of dictionaries (one per index column) with the keys of MySQL's SHOW INDEX",
+		2, 2,
+		[]scm.DeclarationParameter{
+			scm.DeclarationParameter{"schema", "string", "name of the database"},
+			scm.DeclarationParameter{"table", "string", "name of the table"},
+		}, "list",
+		func (a ...scm.Scmer) scm.Scmer {
+			db := GetDatabase(scm.String(a[0]))
+			if db == nil {
+				panic("database " + scm.String(a[0]) + " does not exist")
+			}
+			t := db.Tables.Get(scm.String(a[1]))
+			if t == nil {
+				panic("table " + scm.String(a[0]) + "." + scm.String(a[1]) + " does not exist")
+			}
+			return t.ShowIndexes()
+		},
+	})
+	scm.Declare(&en, &scm.Declaration{
+		"showcreate", "reconstructs the CREATE TABLE statement of a table from its schema (columns, keys, checks, engine and partitioning)",
+		2, 2,
+		[]scm.DeclarationParameter{
+			scm.DeclarationParameter{"schema", "string", "name of the database"},
+			scm.DeclarationParameter{"table", "string", "name of the table"},
+		}, "string",
+		func (a ...scm.Scmer) scm.Scmer {
+			db := GetDatabase(scm.String(a[0]))
+			if db == nil {
+				panic("database " + scm.String(a[0]) + " does not exist")
+			}
+			t := db.Tables.Get(scm.String(a[1]))
+			if t == nil {
+				panic("table " + scm.String(a[0]) + "." + scm.String(a[1]) + " does not exist")
+			}
+			return t.ShowCreate()
+		},
+	})
 	scm.Declare(&en, &scm.Declaration{
 		"droptable", "removes a table",
 		2, 3,
@@ -636,9 +818,23 @@ func Init(en scm.Env) {
 			return true
 		},
 	})
+	scm.Declare(&en, &scm.Declaration{
+		"renametable", "renames a table; if newschema differs from schema, the table is moved into the other database",
+		4, 4,
+		[]scm.DeclarationParameter{
+			scm.DeclarationParameter{"schema", "string", "name of the database"},
+			scm.DeclarationParameter{"table", "string", "name of the table"},
+			scm.DeclarationParameter{"newschema", "string", "name of the target database"},
+			scm.DeclarationParameter{"newtable", "string", "new name of the table"},
+		}, "bool",
+		func (a ...scm.Scmer) scm.Scmer {
+			RenameTable(scm.String(a[0]), scm.String(a[1]), scm.String(a[2]), scm.String(a[3]))
+			return true
+		},
+	})
 	scm.Declare(&en, &scm.Declaration{
 		"insert", "inserts a new dataset into table and returns the number of successful items",
-		4, 7,
+		4, 8,
 		[]scm.DeclarationParameter{
 			scm.DeclarationParameter{"schema", "string", "name of the database"},
 			scm.DeclarationParameter{"table", "string", "name of the table"},
@@ -647,6 +843,7 @@ func Init(en scm.Env) {
 			scm.DeclarationParameter{"onCollisionCols", "list", "list of columns of the old dataset that have to be passed to onCollision. Can also request $update."},
 			scm.DeclarationParameter{"onCollision", "func", "the function that is called on each collision dataset. The first parameter is filled with the $update function, the second parameter is the dataset as associative list. If not set, an error is thrown in case of a collision."},
 			scm.DeclarationParameter{"mergeNull", "bool", "if true, it will handle NULL values as equal according to SQL 2003's definition of DISTINCT (https://en.wikipedia.org/wiki/Null_(SQL)#When_two_nulls_are_equal:_grouping,_sorting,_and_some_set_operations)"},
+			scm.DeclarationParameter{"onInsertId", "func", "called with the first generated AUTO_INCREMENT value if the insert generated one (used for LAST_INSERT_ID())"},
 		}, "number",
 		func (a ...scm.Scmer) scm.Scmer {
 			db := GetDatabase(scm.String(a[0]))
@@ -677,7 +874,11 @@ func Init(en scm.Env) {
 			for i, row := range rows_ {
 				rows[i] = row.([]scm.Scmer)
 			}
-			return float64(db.Tables.Get(scm.String(a[1])).Insert(cols, rows, onCollisionCols, onCollision, mergeNull))
+			result, firstId := db.Tables.Get(scm.String(a[1])).InsertReturningId(cols, rows, onCollisionCols, onCollision, mergeNull)
+			if firstId != 0 && len(a) > 7 && a[7] != nil {
+				scm.Apply(a[7], float64(firstId))
+			}
+			return float64(result)
 		},
 	})
 	scm.Declare(&en, &scm.Declaration{
@@ -755,43 +956,217 @@ func Init(en scm.Env) {
 		},
 	})
 	scm.Declare(&en, &scm.Declaration{
-		"loadCSV", "loads a CSV file into a table and returns the amount of time it took.\nThe first line of the file must be the headlines. The headlines must match the table's columns exactly.",
-		3, 4,
+		"loadCSV", "loads a CSV file (RFC 4180) into a table and returns the amount of time it took.\nThe first line of the file must be the headlines; they are mapped onto the table's columns by name. Fields can be quoted with \" to contain delimiters and line breaks. Records that can't be imported are skipped and reported with their line number.",
+		3, 5,
 		[]scm.DeclarationParameter{
 			scm.DeclarationParameter{"schema", "string", "name of the database"},
 			scm.DeclarationParameter{"table", "string", "name of the table"},
 			scm.DeclarationParameter{"filename", "string", "filename of the CSV file (global path or relative to working directory of memcp)"},
 			scm.DeclarationParameter{"delimiter", "string", "(optional) delimiter defaults to \";\""},
+			scm.DeclarationParameter{"options", "list", "(optional) further options like header=false (columns in table order), columns=list (column of each field instead of a header; @name skips a field), createcolumns=true (create unknown columns with an inferred type), null=marker (unquoted value read as NULL, defaults to \\N), quote=\"\\\"\" (\"\" = no quoting), escape=\"\\\\\" (escape character like in MySQL's format) or ignore=n (skip n records at the beginning)"},
 		}, "string",
 		func (a ...scm.Scmer) scm.Scmer {
-			// schema, table, filename, delimiter
+			// schema, table, filename, delimiter, options
 			start := time.Now()
 
-			delimiter := ";"
-			if len(a) > 3 {
-				delimiter = scm.String(a[3])
+			options := DefaultCSVOptions()
+			if len(a) > 3 && a[3] != nil {
+				options.Delimiter = scm.String(a[3])
 			}
-			LoadCSV(scm.String(a[0]), scm.String(a[1]), scm.String(a[2]), delimiter)
+			if len(a) > 4 {
+				ParseCSVOptions(a[4].([]scm.Scmer), &options)
+			}
+			count, errors := LoadCSV(scm.String(a[0]), scm.String(a[1]), scm.String(a[2]), options)
+			PrintImportErrors(scm.String(a[2]), count, "rows", errors)
 
 			return fmt.Sprint(time.Since(start))
 		},
 	})
 	scm.Declare(&en, &scm.Declaration{
-		"loadJSON", "loads a .jsonl file from disk into a database and returns the amount of time it took.\nJSONL is a linebreak separated file of JSON objects. Each JSON object is one dataset in the database. Before you add rows, you must declare the table in a line '#table <tablename>'. All other lines starting with # are comments. Columns are created dynamically as soon as they occur in a json object.",
-		2, 2,
+		"loaddata", "imports a CSV file into a table like LOAD DATA INFILE and returns the number of imported rows.\nThe defaults are MySQL's: fields are separated by tab, not quoted, \\ is the escape character and there is no header line.",
+		4, 4,
+		[]scm.DeclarationParameter{
+			scm.DeclarationParameter{"schema", "string", "name of the database"},
+			scm.DeclarationParameter{"table", "string", "name of the table"},
+			scm.DeclarationParameter{"filename", "string", "filename of the CSV file (global path or relative to working directory of memcp)"},
+			scm.DeclarationParameter{"options", "list", "options like in loadCSV: delimiter, quote, escape, null, ignore, columns, lineterminator"},
+		}, "number",
+		func (a ...scm.Scmer) scm.Scmer {
+			options := CSVOptions{"\t", false, false, "\\N", 0, '\\', 0, nil}
+			list := append([]scm.Scmer{}, a[3].([]scm.Scmer)...)
+			for i := 1; i < len(list); i += 2 {
+				if s, ok := list[i].(string); ok {
+					list[i] = unescapeSQLString(s) // the SQL parser keeps escapes like \t
+				}
+			}
+			ParseCSVOptions(list, &options)
+			count, errors := LoadCSV(scm.String(a[0]), scm.String(a[1]), scm.String(a[2]), options)
+			PrintImportErrors(scm.String(a[2]), count, "rows", errors)
+			return float64(count)
+		},
+	})
+	scm.Declare(&en, &scm.Declaration{
+		"loadJSON", "loads a .jsonl file from disk into a database and returns the amount of time it took.\nJSONL is a linebreak separated file of JSON objects. Each JSON object is one dataset in the database. Before you add rows, you must declare the table in a line '#table <tablename>'. A line '#delete <recordid>' deletes and a line '#update <recordid> json' updates the row whose primary key is recordid (a JSON value or an array for composite keys). All other lines starting with # are comments. Columns are created dynamically as soon as they occur in a json object. Lines that can't be imported are skipped and reported with their line number.",
+		2, 3,
 		[]scm.DeclarationParameter{
 			scm.DeclarationParameter{"schema", "string", "name of the database where you want to put the tables in"},
 			scm.DeclarationParameter{"filename", "string", "filename of the .jsonl file (global path or relative to working directory of memcp)"},
+			scm.DeclarationParameter{"options", "list", "(optional) further options like flatten=true (nested objects become columns like address.city instead of JSON text) or table=name (table of the rows before the first #table line)"},
+		}, "string",
+		func (a ...scm.Scmer) scm.Scmer {
+			// schema, filename, options
+			start := time.Now()
+
+			var options JSONOptions
+			if len(a) > 2 {
+				ParseJSONOptions(a[2].([]scm.Scmer), &options)
+			}
+			count, errors := LoadJSON(scm.String(a[0]), scm.String(a[1]), options)
+			PrintImportErrors(scm.String(a[1]), count, "rows", errors)
+
+			return fmt.Sprint(time.Since(start))
+		},
+	})
+	scm.Declare(&en, &scm.Declaration{
+		"loadSQL", "executes a SQL file like a mysqldump and returns the amount of time it took.\nThe file is streamed statement by statement; quotes, comments, versioned comments /*!40101 ... */ and DELIMITER lines are handled like the mysql client does. INSERT statements with literal values are inserted directly as one batch, all other statements are executed with parse_sql. Statements that fail are skipped and reported with their line number.",
+		2, 2,
+		[]scm.DeclarationParameter{
+			scm.DeclarationParameter{"schema", "string", "name of the database the statements run in (until a USE statement)"},
+			scm.DeclarationParameter{"filename", "string", "filename of the .sql file (global path or relative to working directory of memcp)"},
+		}, "string",
+		func (a ...scm.Scmer) scm.Scmer {
+			// schema, filename
+			start := time.Now()
+
+			count, errors := LoadSQL(scm.String(a[0]), scm.String(a[1]))
+			PrintImportErrors(scm.String(a[1]), count, "statements", errors)
+
+			return fmt.Sprint(time.Since(start))
+		},
+	})
+	scm.Declare(&en, &scm.Declaration{
+		"loadSQLite", "imports all tables of a SQLite 3 database file and returns the amount of time it took.\nThe file is read directly (no SQLite library needed). Missing tables and columns are created from the CREATE TABLE statements with the types mapped by SQLite's type affinity; indexes, views and triggers are not imported.",
+		2, 2,
+		[]scm.DeclarationParameter{
+			scm.DeclarationParameter{"schema", "string", "name of the database where you want to put the tables in"},
+			scm.DeclarationParameter{"filename", "string", "filename of the SQLite file (global path or relative to working directory of memcp)"},
 		}, "string",
 		func (a ...scm.Scmer) scm.Scmer {
 			// schema, filename
 			start := time.Now()
 
-			LoadJSON(scm.String(a[0]), scm.String(a[1]))
+			count, errors := LoadSQLite(scm.String(a[0]), scm.String(a[1]))
+			PrintImportErrors(scm.String(a[1]), count, "rows", errors)
 
 			return fmt.Sprint(time.Since(start))
 		},
 	})
+	scm.Declare(&en, &scm.Declaration{
+		"loadStream", "imports a CSV or JSONL stream like the body of an HTTP upload into a table and returns the assoc list (\"inserted\" n \"failed\" n \"errors\" list).\nThe stream is read and inserted in batches without holding it in memory. At most 100 error messages are returned.",
+		4, 5,
+		[]scm.DeclarationParameter{
+			scm.DeclarationParameter{"schema", "string", "name of the database"},
+			scm.DeclarationParameter{"table", "string", "name of the table; JSONL creates it if it does not exist and rejects #table lines"},
+			scm.DeclarationParameter{"stream", "any", "stream to read from, e.g. ((req \"bodystream\")) in an HTTP handler"},
+			scm.DeclarationParameter{"format", "string", "\"csv\" or \"jsonl\""},
+			scm.DeclarationParameter{"options", "list", "(optional) options like in loadCSV (including delimiter) or loadJSON"},
+		}, "list",
+		func (a ...scm.Scmer) scm.Scmer {
+			// schema, table, stream, format, options
+			var options []scm.Scmer
+			if len(a) > 4 {
+				options = a[4].([]scm.Scmer)
+			}
+			var count int
+			var errors []ImportError
+			stream := &uploadReader{r: a[2].(io.Reader)}
+			switch scm.String(a[3]) {
+				case "csv":
+					csvOptions := DefaultCSVOptions()
+					ParseCSVOptions(options, &csvOptions)
+					count, errors = ReadCSV(scm.String(a[0]), scm.String(a[1]), stream, csvOptions)
+				case "jsonl":
+					var jsonOptions JSONOptions
+					ParseJSONOptions(options, &jsonOptions)
+					jsonOptions.Table = scm.String(a[1]) // after the options, so the upload can't redirect itself to another table
+					jsonOptions.FixedTable = true
+					count, errors = ReadJSON(scm.String(a[0]), stream, jsonOptions)
+				default:
+					panic("unknown import format: " + scm.String(a[3]))
+			}
+			messages := make([]scm.Scmer, 0, len(errors))
+			for i, e := range errors {
+				if i == 100 {
+					break
+				}
+				messages = append(messages, e.String())
+			}
+			if stream.err != nil {
+				messages = append(messages, "upload aborted: " + stream.err.Error())
+			}
+			return []scm.Scmer{"inserted", float64(count), "failed", float64(len(errors)), "errors", messages}
+		},
+	})
+	scm.Declare(&en, &scm.Declaration{
+		"exportCSV", "writes the rows of a table as CSV with a header line (readable by loadCSV) and returns the number of rows. Computed columns are not exported.",
+		3, 4,
+		[]scm.DeclarationParameter{
+			scm.DeclarationParameter{"schema", "string", "name of the database"},
+			scm.DeclarationParameter{"table", "string", "name of the table"},
+			scm.DeclarationParameter{"destination", "any", "filename (global path or relative to working directory of memcp) or the res object of an HTTP handler"},
+			scm.DeclarationParameter{"options", "list", "(optional) further options like delimiter=\";\", null=marker for NULL (default \\N), header=false, filtercols=list of columns and filter=lambda over filtercols to export only some rows"},
+		}, "number",
+		func (a ...scm.Scmer) scm.Scmer {
+			// schema, table, destination, options
+			options := DefaultExportOptions()
+			if len(a) > 3 {
+				options = ParseExportOptions(a[3].([]scm.Scmer))
+			}
+			w, done := OpenExport(a[2], "text/csv")
+			defer done()
+			return float64(ExportCSV(scm.String(a[0]), scm.String(a[1]), w, options))
+		},
+	})
+	scm.Declare(&en, &scm.Declaration{
+		"exportJSON", "writes the rows of a table as .jsonl with a #table line (readable by loadJSON) and returns the number of rows. Computed columns are not exported.",
+		3, 4,
+		[]scm.DeclarationParameter{
+			scm.DeclarationParameter{"schema", "string", "name of the database"},
+			scm.DeclarationParameter{"table", "string", "name of the table"},
+			scm.DeclarationParameter{"destination", "any", "filename (global path or relative to working directory of memcp) or the res object of an HTTP handler"},
+			scm.DeclarationParameter{"options", "list", "(optional) further options like filtercols=list of columns and filter=lambda over filtercols to export only some rows"},
+		}, "number",
+		func (a ...scm.Scmer) scm.Scmer {
+			// schema, table, destination, options
+			options := DefaultExportOptions()
+			if len(a) > 3 {
+				options = ParseExportOptions(a[3].([]scm.Scmer))
+			}
+			w, done := OpenExport(a[2], "application/x-ndjson")
+			defer done()
+			return float64(ExportJSON(scm.String(a[0]), scm.String(a[1]), w, options))
+		},
+	})
+	scm.Declare(&en, &scm.Declaration{
+		"exportSQL", "writes a table as SQL dump of CREATE TABLE and INSERT statements and returns the number of rows. Computed columns are not exported.",
+		3, 4,
+		[]scm.DeclarationParameter{
+			scm.DeclarationParameter{"schema", "string", "name of the database"},
+			scm.DeclarationParameter{"table", "string", "name of the table"},
+			scm.DeclarationParameter{"destination", "any", "filename (global path or relative to working directory of memcp) or the res object of an HTTP handler"},
+			scm.DeclarationParameter{"options", "list", "(optional) further options like create=false (no CREATE TABLE), filtercols=list of columns and filter=lambda over filtercols to export only some rows"},
+		}, "number",
+		func (a ...scm.Scmer) scm.Scmer {
+			// schema, table, destination, options
+			options := DefaultExportOptions()
+			if len(a) > 3 {
+				options = ParseExportOptions(a[3].([]scm.Scmer))
+			}
+			w, done := OpenExport(a[2], "application/sql")
+			defer done()
+			return float64(ExportSQL(scm.String(a[0]), scm.String(a[1]), w, options))
+		},
+	})
 	scm.Declare(&en, &scm.Declaration{
 		"settings", "reads or writes a global settings value. This modifies your data/settings.json.",
 		1, 2,
@@ -815,6 +1190,8 @@ func PrintMemUsage() string {
 		b.WriteString("\n\n" + db.Name + "\n======\n")
 		b.WriteString(db.PrintMemUsage())
 	}
+	b.WriteString("\n\nNUMA nodes\n======\n")
+	b.WriteString(PrintNodeUsage())
 	return b.String()
 }
 
@@ -828,6 +1205,9 @@ func (db *database) PrintMemUsage() string {
 		for _, s := range t.Shards {
 			size += s.Size()
 		}
+		for _, d := range t.Dictionaries {
+			size += d.Size()
+		}
 		b.WriteString(fmt.Sprintf("%-25s\t%d\t%d\t%d\t%s\n", t.Name, len(t.Columns), len(t.Shards) + len(t.PShards), len(t.PDimensions), units.BytesSize(float64(size))));
 		dsize += size
 	}
@@ -855,6 +1235,11 @@ func (t *table) PrintMemUsage() string {
 		b.WriteString(fmt.Sprintf("= total %s\n\n", units.BytesSize(float64(ssz))));
 		dsize += ssz
 	}
+	for _, d := range t.Dictionaries {
+		sz := d.Size()
+		b.WriteString(fmt.Sprintf("Dictionary %s: %d entries, size = %s\n", d.Column, d.Count(), units.BytesSize(float64(sz))));
+		dsize += sz
+	}
 	b.WriteString(fmt.Sprintf("= total %s\n\n", units.BytesSize(float64(dsize))));
 	return b.String()
 }
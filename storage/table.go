@@ -18,6 +18,7 @@ package storage
 
 import "fmt"
 import "sync"
+import "sync/atomic"
 import "errors"
 import "strings"
 import "encoding/json"
@@ -28,10 +29,16 @@ type column struct {
 	Name string
 	Typ string
 	Typdimensions []int // type dimensions for DECIMAL(10,3) and VARCHAR(5)
-	Extrainfo string // TODO: further diversify into NOT NULL, AUTOINCREMENT etc.
-	Computor scm.Scmer `json:"-"` // TODO: marshaljson -> serialize
+	Extrainfo string // column options that are not modelled below (e.g. COMMENT, ON UPDATE)
+	NotNull bool
+	Default scm.Scmer // constant default value (nil = NULL)
+	DefaultExpr string // default expression in scheme code that is evaluated on insert, e.g. (now) for CURRENT_TIMESTAMP
+	AutoIncrement bool
+	Computor scm.Scmer `json:"-"` // compiled from ComputorSource
+	ComputorCols []string // columns that are passed into the params of Computor
+	ComputorSource string // scm source of Computor, so computed columns survive a restart
+	Generated string // STORED or VIRTUAL for GENERATED ALWAYS AS columns that follow inserts and updates; empty for computed caches
 	PartitioningScore int // count this up to increase the chance of partitioning for this column
-	// TODO: LRU statistics for computed columns
 }
 type PersistencyMode uint8
 const (
@@ -44,6 +51,10 @@ type uniqueKey struct {
 	Id string
 	Cols []string
 }
+type tableIndex struct {
+	Id string
+	Cols []string // the order of the columns is the sort order of the index
+}
 type foreignKey struct {
 	Id string
 	Tbl1 string
@@ -70,16 +81,26 @@ type table struct {
 	Columns []column
 	Unique []uniqueKey // unique keys
 	Foreign []foreignKey // foreign keys
+	Checks []*checkConstraint // CHECK constraints
+	Indexes []tableIndex // declared indexes (CREATE INDEX)
 	PersistencyMode PersistencyMode /* 0 = safe (default), 1 = sloppy, 2 = memory */
 	mu sync.Mutex // schema/sharding lock
 	uniquelock sync.Mutex // unique insert lock
-	Auto_increment uint64 // this dosen't scale over multiple cores, so assign auto_increment ranges to each shard
+	Auto_increment uint64 // highest id handed out or inserted + 1 (see columnoptions.go)
+	autoinc_reserved uint64 // next id that is not reserved by a range
+	autoinc_floor uint64 // highest explicitly inserted id + 1
+	autoinc autoIncrementRange // range of partitioned tables
+	autoincOnce sync.Once // Auto_increment is continued behind the highest stored id once after load
+	computedReads sync.Map // computed columns that were read since the last rebuild (LRU statistics)
 
 	// storage: if both arrays Shards and PShards are present, Shards is the single point of truth
 	Shards []*storageShard // unordered shards; as long as this value is not nil, use shards instead of pshards
 	PShards []*storageShard // partitioned shards according to PDimensions
 	PDimensions []shardDimension
+	partitioning atomic.Pointer[partitionSchema] // PDimensions and PShards as one value for readers without t.mu
 	// TODO: move rows from Shards to PShards according to PDimensions
+
+	Dictionaries []*globalDictionary // shared string dictionaries over all shards
 }
 
 func (t *table) Count() (result uint) {
@@ -205,7 +226,9 @@ func (t *table) CreateColumn(name string, typ string, typdimensions[] int, extra
 		}
 	}
 	
-	t.Columns = append(t.Columns, column{name, typ, typdimensions, extrainfo, nil, 0})
+	c := column{Name: name, Typ: typ, Typdimensions: typdimensions}
+	c.parseOptions(extrainfo)
+	t.Columns = append(t.Columns, c)
 	for _, s := range t.Shards {
 		s.columns[name] = new (StorageSparse)
 	}
@@ -218,6 +241,10 @@ func (t *table) CreateColumn(name string, typ string, typdimensions[] int, extra
 
 func (t *table) DropColumn(name string) bool {
 	t.schema.schemalock.Lock()
+	if dep := t.generatedDependency(name); dep != "" {
+		t.schema.schemalock.Unlock()
+		panic("Column '" + name + "' has a generated column dependency: " + dep)
+	}
 	for i, c := range t.Columns {
 		if c.Name == name {
 			// found the column
@@ -228,6 +255,8 @@ func (t *table) DropColumn(name string) bool {
 			for _, s := range t.PShards {
 				delete(s.columns, name)
 			}
+			t.dropDictionary(name)
+			t.dropIndexColumn(name)
 
 			t.schema.save()
 			t.schema.schemalock.Unlock()
@@ -239,7 +268,12 @@ func (t *table) DropColumn(name string) bool {
 }
 
 func (t *table) Insert(columns []string, values [][]scm.Scmer, onCollisionCols []string, onCollision scm.Scmer, mergeNull bool) int {
-	result := 0
+	result, _ := t.InsertReturningId(columns, values, onCollisionCols, onCollision, mergeNull)
+	return result
+}
+
+// like Insert, but also returns the first AUTO_INCREMENT value that was generated for an inserted row (0 if none) for LAST_INSERT_ID()
+func (t *table) InsertReturningId(columns []string, values [][]scm.Scmer, onCollisionCols []string, onCollision scm.Scmer, mergeNull bool) (result int, firstId uint64) {
 	// TODO: check foreign keys (new value of column must be present in referenced table)
 
 	if t.Shards != nil { // unpartitioned sharding
@@ -250,19 +284,29 @@ func (t *table) Insert(columns []string, values [][]scm.Scmer, onCollisionCols [
 			// reload shard after lock to avoid race conditions
 			shard = t.Shards[len(t.Shards)-1]
 			if shard.Count() >= Settings.ShardSize {
-				go func(i int) {
+				go func(s *storageShard) {
 					// rebuild full shards in background
-					s := t.Shards[i]
-					t.Shards[i] = s.rebuild(false)
+					s2 := s.rebuild(false)
+					t.mu.Lock()
+					for i, s3 := range t.Shards { // the shard list may have been rebalanced in the meantime
+						if s3 == s {
+							t.Shards[i] = s2
+						}
+					}
+					t.mu.Unlock()
 					// write new uuids to disk
 					t.schema.save()
-				}(len(t.Shards)-1)
+				}(shard)
 				shard = NewShard(t)
 				fmt.Println("started new shard for table", t.Name)
 				t.Shards = append(t.Shards, shard)
 			}
 			t.mu.Unlock()
 		}
+		var generated generatedIds
+		columns, values, generated = t.completeRows(columns, values, shard) // DEFAULT, AUTO_INCREMENT and NOT NULL
+		columns, values = t.computeGenerated(columns, values)
+		t.checkConstraints(columns, values)
 
 		// check unique constraints in a thread safe manner
 		if len(t.Unique) > 0 {
@@ -270,6 +314,9 @@ func (t *table) Insert(columns []string, values [][]scm.Scmer, onCollisionCols [
 				// physically insert
 				shard.Insert(columns, values, false)
 				result += len(values)
+				if firstId == 0 {
+					firstId = generated.first(values)
+				}
 			}, onCollisionCols, func (errmsg string, data []scm.Scmer) {
 				if onCollision != nil {
 					scm.Apply(onCollision, data...)
@@ -281,11 +328,23 @@ func (t *table) Insert(columns []string, values [][]scm.Scmer, onCollisionCols [
 			// physically insert (parallel)
 			shard.Insert(columns, values, false)
 			result += len(values)
+			firstId = generated.first(values)
 		}
 	} else {
 		// partitions
 		// TODO: check which shards are involved; a sharding dimension column must be present in ALL unique keys, otherwise we cannot prune
-		dims := t.PDimensions
+		var generated generatedIds
+		columns, values, generated = t.completeRows(columns, values, nil) // DEFAULT, AUTO_INCREMENT and NOT NULL; ids come from the table since the shard is not known yet
+		columns, values = t.computeGenerated(columns, values)
+		t.checkConstraints(columns, values)
+		dims, pshards := t.currentPartitioning()
+		if len(dims) > 0 && dims[0].Interval > 0 {
+			// time partitioning: create partitions for new intervals first
+			if times, ok := t.needsTimePartition(dims, columns, values); ok {
+				t.extendTimePartitions(times)
+				dims, pshards = t.currentPartitioning()
+			}
+		}
 		shardcols := make([]scm.Scmer, len(dims))
 		translatable := make([]int, len(dims))
 		for i, cd := range dims {
@@ -304,6 +363,9 @@ func (t *table) Insert(columns []string, values [][]scm.Scmer, onCollisionCols [
 					// physically insert
 					s.Insert(columns, values, false)
 					result += len(values)
+					if firstId == 0 {
+						firstId = generated.first(values)
+					}
 				}, onCollisionCols, func (errmsg string, data []scm.Scmer) {
 					if onCollision != nil {
 						scm.Apply(onCollision, data...)
@@ -315,6 +377,9 @@ func (t *table) Insert(columns []string, values [][]scm.Scmer, onCollisionCols [
 				// physically insert (parallel)
 				s.Insert(columns, values, false)
 				result += len(values)
+				if firstId == 0 {
+					firstId = generated.first(values)
+				}
 			}
 		}
 
@@ -328,7 +393,7 @@ func (t *table) Insert(columns []string, values [][]scm.Scmer, onCollisionCols [
 					shardcols[j] = nil
 				}
 			}
-			shard := t.PShards[computeShardIndex(dims, shardcols)]
+			shard := pshards[computeShardIndex(dims, shardcols)]
 			if i > 0 && shard != last_shard {
 				checkUniqueForShard(last_shard, values[last_i:i]) // shard has changed: bulk insert all items that belong to this shard
 				last_i = i
@@ -341,10 +406,17 @@ func (t *table) Insert(columns []string, values [][]scm.Scmer, onCollisionCols [
 	}
 
 	// TODO: Trigger after insert
-	return result
+	return result, firstId
 }
 
 func (t *table) ProcessUniqueCollision(columns []string, values [][]scm.Scmer, mergeNull bool, success func([][]scm.Scmer), onCollisionCols []string, failure func(string, []scm.Scmer), idx int) {
+	lock := t.uniqueLock(columns, values) // shard-local if the partitioning schema allows it
+	lock.Lock()
+	t.processUniqueCollision(lock, columns, values, mergeNull, success, onCollisionCols, failure, idx)
+	lock.Unlock()
+}
+
+func (t *table) processUniqueCollision(lock sync.Locker, columns []string, values [][]scm.Scmer, mergeNull bool, success func([][]scm.Scmer), onCollisionCols []string, failure func(string, []scm.Scmer), idx int) {
 	// check for duplicates
 	if idx >= len(t.Unique) {
 		success(values) // we finally made it, these values have passed all unique checks
@@ -352,161 +424,103 @@ func (t *table) ProcessUniqueCollision(columns []string, values [][]scm.Scmer, m
 	}
 	uniq := t.Unique[idx]
 	t.AddPartitioningScore(uniq.Cols) // increases partitioning score, so partitioning is improved
-	if len(uniq.Cols) <= 3 {
-		// use hashmap
-		key := make([]scm.Scmer, len(uniq.Cols))
-		keyIdx := make([]int, len(uniq.Cols))
-		for i, col := range uniq.Cols {
-			for j, col2 := range columns {
-				if col == col2 {
-					keyIdx[i] = j
-				}
+	key := make([]scm.Scmer, len(uniq.Cols))
+	keyIdx := make([]int, len(uniq.Cols))
+	for i, col := range uniq.Cols {
+		keyIdx[i] = -1
+		for j, col2 := range columns {
+			if col == col2 {
+				keyIdx[i] = j
 			}
 		}
+	}
 
-		shardlist := t.Shards
-		allowPruning := false // if we can prune the shardlist
-		pruningMap := make([]int, len(uniq.Cols))
-		pruningVals := make([]scm.Scmer, len(uniq.Cols))
-		if shardlist == nil {
-			// partitioning
-			allowPruning = true
-			shardlist = t.PShards
+	shardlist := t.Shards
+	dims, pshards := t.currentPartitioning()
+	var pruningMap []int // for each partitioning dimension the key column that determines it; nil if we can't prune
+	pruningVals := make([]scm.Scmer, len(dims))
+	if shardlist == nil {
+		// partitioning
+		shardlist = pshards
+		pruningMap = make([]int, len(dims))
+		for j, dim := range dims {
+			pruningMap[j] = -1
 			for i, col := range uniq.Cols {
-				hasPruningCol := false
-				for j, dim := range t.PDimensions {
-					if dim.Column == col {
-						hasPruningCol = true // we found the uniq column in our partitioning schema
-						pruningMap[j] = i
-					}
-				}
-				if !hasPruningCol {
-					allowPruning = false // all unique columns must be present in the partitioning schema, otherwise a unique collision might hide in pruned shards
+				if dim.Column == col {
+					pruningMap[j] = i // we found the dimension in our unique key
 				}
 			}
+			if pruningMap[j] < 0 {
+				pruningMap = nil // all dimensions must be part of the key, otherwise a unique collision might hide in pruned shards
+				break
+			}
 		}
-		// TODO: only shard-local lock if allowPruning
-
-		var lock *sync.Mutex
-		lock = &t.uniquelock
-		if (!allowPruning || len(t.Unique) > 1) && idx == 0 {
-			lock.Lock()
-		}
+	}
 
-		last_j := 0
-		for j, row := range values {
-			for i, colidx := range keyIdx {
+	last_j := 0
+	batch := make(map[string]bool) // keys of values[last_j:j] that are not yet inserted
+	for j, row := range values {
+		hasNull := false
+		for i, colidx := range keyIdx {
+			key[i] = nil
+			if colidx >= 0 && colidx < len(row) {
 				key[i] = row[colidx]
 			}
-			shardlist2 := shardlist
-			if allowPruning {
-				for j, xidx := range pruningMap {
-					pruningVals[j] = row[keyIdx[xidx]]
-				}
-				// only one shard to visit for unique check
-				shardlist2 = []*storageShard{shardlist[computeShardIndex(t.PDimensions, pruningVals)]}
-				if len(t.Unique) == 1 {
-					lock = &shardlist2[0].uniquelock
-					lock.Lock()
-				}
-			}
-			for _, s := range shardlist2 {
-				uid, present := s.GetRecordidForUnique(uniq.Cols, key)
-				if present && !s.deletions.Get(uid) {
-					// found a unique collision
-					if j != last_j {
-						t.ProcessUniqueCollision(columns, values[last_j:j], mergeNull, success, onCollisionCols, failure, idx + 1) // flush
-					}
-					last_j = j+1
-					lock.Unlock()
-					params := make([]scm.Scmer, len(onCollisionCols))
-					for i, p := range onCollisionCols {
-						if p == "$update" {
-							params[i] = s.UpdateFunction(uid, true)
-						} else if len(p) >= 4 && p[:4] == "NEW." {
-							for j, c := range columns {
-								if p[4:] == c {
-									params[i] = row[j]
-								}
-							}
-						} else {
-							params[i] = s.ColumnReader(p)(uid)
-						}
-					}
-					failure(uniq.Id, params) // notify about failure
-					lock.Lock()
-					goto nextrow
-				}
-			}
-			nextrow:
-			if allowPruning {
-				if len(t.Unique) == 1 {
-					lock.Unlock()
-				}
+			if key[i] == nil {
+				hasNull = true
 			}
 		}
-		if len(values) != last_j {
-			t.ProcessUniqueCollision(columns, values[last_j:], mergeNull, success, onCollisionCols, failure, idx + 1) // flush the rest
-		}
-		if (!allowPruning || len(t.Unique) > 1) && idx == 0 {
-			lock.Unlock() // TODO: instead of uniquelock, in case of sharding, use a shard local lock
+		if hasNull && !mergeNull {
+			continue // NULL can be there multiple times
 		}
-	} else {
-		if idx == 0 {
-			t.uniquelock.Unlock() // TODO: instead of uniquelock, in case of sharding, use a shard local lock
+		hashkey := uniqueHashKey(key)
+		if batch[hashkey] {
+			// duplicate inside this batch: insert the rows before, so the row below collides with them
+			t.processUniqueCollision(lock, columns, values[last_j:j], mergeNull, success, onCollisionCols, failure, idx + 1) // flush
+			last_j = j
+			batch = make(map[string]bool)
 		}
-		// build scan for unique check
-		cols := make([]scm.Scmer, len(uniq.Cols))
-		colidx := make([]int, len(uniq.Cols))
-		for i, c := range uniq.Cols {
-			cols[i] = scm.Symbol(c)
-			for j, col := range columns { // find uniq columns
-				if c == col {
-					colidx[i] = j
-				}
+		shardlist2 := shardlist
+		if pruningMap != nil {
+			for d, i := range pruningMap {
+				pruningVals[d] = key[i]
 			}
+			// only one shard to visit for unique check
+			shardlist2 = []*storageShard{shardlist[computeShardIndex(dims, pruningVals)]}
 		}
-		conditionBody := make([]scm.Scmer, len(uniq.Cols) + 1)
-		conditionBody[0] = scm.Symbol("and")
-		last_j := 0
-		for j, row := range values {
-			for i, colidx := range colidx {
-				value := row[colidx]
-				if !mergeNull && value == nil {
-					conditionBody[i + 1] = false // NULL can be there multiple times
-				} else {
-					conditionBody[i + 1] = []scm.Scmer{scm.Symbol("equal??"), scm.NthLocalVar(i), value}
+		for _, s := range shardlist2 {
+			uid, present := s.GetRecordidForUnique(uniq.Cols, key)
+			if present && !s.deletions.Get(uid) {
+				// found a unique collision
+				if j != last_j {
+					t.processUniqueCollision(lock, columns, values[last_j:j], mergeNull, success, onCollisionCols, failure, idx + 1) // flush
 				}
-			}
-			condition := scm.Proc {cols, conditionBody, &scm.Globalenv, len(uniq.Cols)}
-			updatefn := t.scan(uniq.Cols, condition, onCollisionCols, func (args ...scm.Scmer) scm.Scmer {
-				t.uniquelock.Unlock()
+				last_j = j+1
+				batch = make(map[string]bool)
+				lock.Unlock() // the collision handler may update the dataset which does its own unique check
+				params := make([]scm.Scmer, len(onCollisionCols))
 				for i, p := range onCollisionCols {
-					if len(p) >= 4 && p[:4] == "NEW." {
+					if p == "$update" {
+						params[i] = s.UpdateFunction(uid, true)
+					} else if len(p) >= 4 && p[:4] == "NEW." {
 						for j, c := range columns {
 							if p[4:] == c {
-								args[i] = row[j]
+								params[i] = row[j]
 							}
 						}
+					} else {
+						params[i] = s.ColumnReader(p)(uid)
 					}
 				}
-				failure(uniq.Id, args) // call collision function
-				t.uniquelock.Lock()
-				return true // feedback that there was a collision
-			}, func(a ...scm.Scmer) scm.Scmer {return a[1]}, nil, nil, false)
-			if updatefn != nil {
-				// found a unique collision: flush the successing items and skip this one
-				if j != last_j {
-					t.ProcessUniqueCollision(columns, values[last_j:j], mergeNull, success, onCollisionCols, failure, idx + 1) // flush
-				}
-				last_j = j+1
+				failure(uniq.Id, params) // notify about failure
+				lock.Lock()
+				goto nextrow
 			}
 		}
-		if len(values) != last_j {
-			t.ProcessUniqueCollision(columns, values[last_j:], mergeNull, success, onCollisionCols, failure, idx + 1) // flush the rest
-		}
-		if idx == 0 {
-			t.uniquelock.Unlock()
-		}
+		batch[hashkey] = true
+		nextrow:
+	}
+	if len(values) != last_j {
+		t.processUniqueCollision(lock, columns, values[last_j:], mergeNull, success, onCollisionCols, failure, idx + 1) // flush the rest
 	}
 }
@@ -0,0 +1,237 @@
+/*
+Copyright (C) 2024  Carl-Philip Hänsch
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package storage
+
+import "fmt"
+import "math"
+import "sort"
+import "time"
+import "github.com/launix-de/memcp/scm"
+
+/*
+
+time partitioning:
+ - a time dimension is always PDimensions[0], so partitions for new intervals can be appended
+   at the end of PShards without moving existing shards
+ - Pivots[0] is the undatedPivot; partition 0 only takes rows whose time is NULL or unparsable and never expires
+ - the other pivots are unix timestamps at multiples of Interval, but only for intervals that contain rows;
+   a run of empty intervals between two of them shares one partition (late rows expire with it), partition 1 takes everything older
+ - when a row arrives that is newer than the last pivot + Interval, a partition for its interval is created
+ - rebuild (and thus the cron) drops whole partitions older than Retention
+
+*/
+
+const maxNewTimePartitions = 1000 // upper bound of partitions created at once; older intervals share partition 1
+var undatedPivot scm.Scmer = -math.MaxFloat64 // every timestamp is >= this pivot, only NULL is less
+
+// converts a cell into a unix timestamp (numbers are taken as is, strings are parsed as dates)
+func timeValue(v scm.Scmer) (float64, bool) {
+	switch x := v.(type) {
+		case float64:
+			return x, true
+		case int64:
+			return float64(x), true
+		case int:
+			return float64(x), true
+		case string:
+			return scm.ParseDate(x)
+		case scm.LazyString:
+			return scm.ParseDate(x.GetValue())
+	}
+	return 0, false
+}
+
+// maps a value onto the axis of the dimension
+func (sd *shardDimension) key(v scm.Scmer) scm.Scmer {
+	if sd.Interval <= 0 || v == nil {
+		return v
+	}
+	if f, ok := timeValue(v); ok {
+		return f
+	}
+	return nil // unparsable dates go into the undated partition
+}
+
+// pivots for the intervals of all rows that are not older than limit; after is the last pivot so far (or -Inf)
+func timeIntervals(interval float64, limit float64, after float64, times []float64) (result []scm.Scmer) {
+	sort.Float64s(times)
+	var intervals []float64
+	for _, f := range times {
+		p := math.Floor(f / interval) * interval
+		if f >= limit && (len(intervals) == 0 || intervals[len(intervals)-1] != p) {
+			intervals = append(intervals, p)
+		}
+	}
+	if len(intervals) > maxNewTimePartitions {
+		intervals = intervals[len(intervals)-maxNewTimePartitions:] // the oldest rows fall back into the partition before
+	}
+	for _, p := range intervals {
+		if !math.IsInf(after, -1) && after + interval < p {
+			result = append(result, after + interval) // close the previous interval, so it expires on time; the gap takes late rows
+		}
+		result = append(result, p)
+		after = p
+	}
+	return
+}
+
+// partitions the table by a time column; interval and retention are given in seconds
+func (t *table) PartitionByTime(col string, interval float64, retention float64) {
+	if interval <= 0 {
+		panic("partition interval must be positive")
+	}
+	found := false
+	for _, c := range t.Columns {
+		if c.Name == col {
+			found = true
+		}
+	}
+	if !found {
+		panic("column " + t.Name + "." + col + " does not exist")
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// find out the time range of existing data
+	shardlist := t.Shards
+	if shardlist == nil {
+		shardlist = t.PShards
+	}
+	var times []float64
+	for _, s := range shardlist {
+		reader := s.ColumnReader(col)
+		for idx := uint(0); idx < s.main_count + uint(len(s.inserts)); idx++ {
+			if s.deletions.Get(idx) {
+				continue
+			}
+			if f, ok := timeValue(reader(idx)); ok {
+				times = append(times, f)
+			}
+		}
+	}
+	sd := shardDimension{col, 1, []scm.Scmer{undatedPivot}, interval, retention}
+	sd.Pivots = append(sd.Pivots, timeIntervals(interval, math.Inf(-1), math.Inf(-1), times)...)
+	sd.NumPartitions = len(sd.Pivots) + 1
+	t.repartition([]shardDimension{sd})
+}
+
+// creates partitions for the intervals of the given timestamps unless they are already covered; this happens outside of t.mu
+func (t *table) extendTimePartitions(times []float64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.Shards != nil || len(t.PDimensions) == 0 || t.PDimensions[0].Interval <= 0 {
+		return // partitioning has changed in the meantime
+	}
+	sd := t.PDimensions[0]
+	after := math.Inf(-1)
+	if len(sd.Pivots) > 1 {
+		after = sd.Pivots[len(sd.Pivots)-1].(float64)
+	}
+	pivots := append(append([]scm.Scmer{}, sd.Pivots...), timeIntervals(sd.Interval, timePartitionLimit(sd), after, times)...)
+	added := len(pivots) - len(sd.Pivots)
+	if added == 0 {
+		return // another insert was faster
+	}
+	blockdim := len(t.PShards) / sd.NumPartitions // shards per time partition
+	shards := append([]*storageShard{}, t.PShards...)
+	for i := 0; i < added * blockdim; i++ {
+		shards = append(shards, NewShard(t))
+	}
+	sd.Pivots = pivots
+	sd.NumPartitions = len(pivots) + 1
+	dims := append([]shardDimension{sd}, t.PDimensions[1:]...)
+	t.PShards = shards
+	t.PDimensions = dims
+	t.publishPartitioning()
+	fmt.Println("added", added, "time partitions to", t.Name)
+
+	t.schema.schemalock.Lock()
+	t.schema.save()
+	t.schema.schemalock.Unlock()
+}
+
+// timestamps from this value on need a new partition
+func timePartitionLimit(sd shardDimension) float64 {
+	if len(sd.Pivots) <= 1 {
+		return math.Inf(-1) // the first dated row creates the first partition
+	}
+	return sd.Pivots[len(sd.Pivots)-1].(float64) + sd.Interval
+}
+
+// returns the timestamps of a list of rows if some of them exceed the current time partitions
+func (t *table) needsTimePartition(dims []shardDimension, columns []string, values [][]scm.Scmer) (times []float64, found bool) {
+	sd := dims[0]
+	colidx := -1
+	for i, col := range columns {
+		if col == sd.Column {
+			colidx = i
+		}
+	}
+	if colidx < 0 {
+		return
+	}
+	limit := timePartitionLimit(sd)
+	for _, row := range values {
+		if colidx < len(row) {
+			if f, ok := timeValue(row[colidx]); ok {
+				times = append(times, f)
+				if f >= limit {
+					found = true
+				}
+			}
+		}
+	}
+	return
+}
+
+// drops whole partitions whose time range is older than the retention; this happens inside t.mu.Lock()
+func (t *table) dropExpiredPartitions() {
+	if t.Shards != nil || len(t.PDimensions) == 0 || t.PDimensions[0].Interval <= 0 || t.PDimensions[0].Retention <= 0 {
+		return
+	}
+	sd := t.PDimensions[0]
+	cutoff := float64(time.Now().Unix()) - sd.Retention
+	expired := 0 // partition i ends at Pivots[i]; the undated partition 0 and the last partition never expire
+	for expired + 1 < len(sd.Pivots) && sd.Pivots[expired + 1].(float64) <= cutoff {
+		expired++
+	}
+	if expired == 0 {
+		return
+	}
+	blockdim := len(t.PShards) / sd.NumPartitions
+	dropped := t.PShards[blockdim:(expired + 1) * blockdim]
+	sd.Pivots = append([]scm.Scmer{undatedPivot}, sd.Pivots[expired + 1:]...)
+	sd.NumPartitions = len(sd.Pivots) + 1
+	t.PDimensions = append([]shardDimension{sd}, t.PDimensions[1:]...)
+	t.PShards = append(append([]*storageShard{}, t.PShards[:blockdim]...), t.PShards[(expired + 1) * blockdim:]...)
+	t.publishPartitioning()
+	for _, s := range dropped {
+		// inserts that were routed before the switch are routed again by the new schema
+		s.mu.Lock()
+		s.redirect = newShardRedirect(t.PShards, t.PDimensions, 0)
+		s.mu.Unlock()
+	}
+	fmt.Println("dropped", expired, "expired time partitions of", t.Name)
+
+	t.schema.schemalock.Lock()
+	t.schema.save()
+	t.schema.schemalock.Unlock()
+
+	for _, s := range dropped {
+		s.RemoveFromDisk()
+	}
+}
@@ -0,0 +1,278 @@
+/*
+Copyright (C) 2024  Carl-Philip Hänsch
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package storage
+
+import "fmt"
+import "math"
+import "strconv"
+import "strings"
+import "time"
+import "unicode/utf8"
+import "github.com/launix-de/memcp/scm"
+
+/*
+
+column types:
+ - incoming values are converted to the representation of the column type:
+   numbers for integer/decimal/float columns, strings for text columns,
+   canonical 'YYYY-MM-DD' / 'YYYY-MM-DD hh:mm:ss' strings (UTC) for dates, so they compare and print like before
+ - integers beyond 2^53 can't be stored exactly as float64 and are always rejected
+ - with Settings.StrictTypes, values that don't fit (non-numeric strings, too long strings,
+   out of range numbers) are rejected with an error naming the column;
+   otherwise they are truncated or clamped like MySQL does without STRICT_TRANS_TABLES
+   (unparsable dates become NULL with a warning in the log; impossible dates like 2024-02-30 are always rejected)
+ - unknown types (e.g. ANY) accept everything
+
+*/
+
+// value range of the integer types (signed)
+var integerTypeBits = map[string]uint{
+	"TINYINT": 8,
+	"SMALLINT": 16,
+	"MEDIUMINT": 24,
+	"INT": 32,
+	"INTEGER": 32,
+	"BIGINT": 64,
+}
+
+// maximum length of the text types in bytes
+var textTypeLength = map[string]int{
+	"TINYTEXT": 255,
+	"TINYBLOB": 255,
+	"TEXT": 65535,
+	"BLOB": 65535,
+	"MEDIUMTEXT": 16777215,
+	"MEDIUMBLOB": 16777215,
+	"LONGTEXT": 0, // 0 = unlimited
+	"LONGBLOB": 0,
+	"JSON": 0,
+}
+
+// returns a function that converts a value into the column's type or nil if the type takes any value
+func (t *table) converter(c *column) func(scm.Scmer) scm.Scmer {
+	typ := strings.ToUpper(c.Typ)
+	strict := Settings.StrictTypes
+	fail := func(msg string, v scm.Scmer) {
+		panic(fmt.Sprintf("%s: '%s' for column '%s' of table %s", msg, toText(v), c.Name, t.Name))
+	}
+	unsigned := strings.Contains(strings.ToUpper(c.Extrainfo), "UNSIGNED")
+	if bits, ok := integerTypeBits[typ]; ok {
+		lo, hi := -math.Pow(2, float64(bits-1)), math.Pow(2, float64(bits-1))-1
+		if unsigned {
+			lo, hi = 0, math.Pow(2, float64(bits))-1
+		}
+		return func(v scm.Scmer) scm.Scmer {
+			f, ok := toNumber(v)
+			if !ok {
+				if strict {
+					fail("Incorrect integer value", v)
+				}
+				f = leadingNumber(v)
+			}
+			if math.Abs(f) >= 1 << 53 && !exactInteger(v) {
+				fail("Out of range value (integer cannot be stored exactly)", v)
+			}
+			f = math.Round(f)
+			if f < lo || f > hi {
+				if strict {
+					fail("Out of range value", v)
+				}
+				f = math.Max(lo, math.Min(hi, f))
+			}
+			return f
+		}
+	}
+	switch typ {
+		case "DECIMAL", "NUMERIC", "FLOAT", "DOUBLE", "REAL":
+			digits, decimals := -1, -1
+			if len(c.Typdimensions) > 0 {
+				digits = c.Typdimensions[0]
+			}
+			if typ == "DECIMAL" || typ == "NUMERIC" {
+				decimals = 0 // DECIMAL(M) = DECIMAL(M,0)
+				if digits < 0 {
+					digits = 10 // DECIMAL = DECIMAL(10,0)
+				}
+			}
+			if len(c.Typdimensions) > 1 {
+				decimals = c.Typdimensions[1]
+			}
+			return func(v scm.Scmer) scm.Scmer {
+				f, ok := toNumber(v)
+				if !ok {
+					if strict {
+						fail("Incorrect decimal value", v)
+					}
+					f = leadingNumber(v)
+				}
+				if decimals >= 0 {
+					scale := math.Pow(10, float64(decimals))
+					f = math.Round(f * scale) / scale
+				}
+				if digits >= 0 && decimals >= 0 {
+					max := math.Pow(10, float64(digits - decimals)) - math.Pow(10, -float64(decimals))
+					if math.Abs(f) > max {
+						if strict {
+							fail("Out of range value", v)
+						}
+						f = math.Copysign(max, f)
+					}
+				}
+				if unsigned && f < 0 {
+					if strict {
+						fail("Out of range value", v)
+					}
+					f = 0
+				}
+				return f
+			}
+		case "BOOL", "BOOLEAN", "BIT":
+			return func(v scm.Scmer) scm.Scmer {
+				switch x := v.(type) {
+					case bool:
+						if x {
+							return float64(1)
+						}
+						return float64(0)
+				}
+				f, ok := toNumber(v)
+				if !ok {
+					if strict {
+						fail("Incorrect boolean value", v)
+					}
+					f = leadingNumber(v)
+				}
+				return f
+			}
+		case "CHAR", "VARCHAR", "BINARY", "VARBINARY":
+			length := -1
+			if len(c.Typdimensions) > 0 {
+				length = c.Typdimensions[0]
+			} else if typ == "CHAR" || typ == "BINARY" {
+				length = 1 // CHAR = CHAR(1)
+			}
+			return func(v scm.Scmer) scm.Scmer {
+				s := toText(v)
+				if length >= 0 && utf8.RuneCountInString(s) > length {
+					if strict {
+						fail("Data too long", v)
+					}
+					s = string([]rune(s)[:length])
+				}
+				return s
+			}
+		case "DATE", "DATETIME", "TIMESTAMP":
+			return func(v scm.Scmer) scm.Scmer {
+				f, ok := timeValue(v)
+				if !ok {
+					if strict || scm.DateOutOfRange(strings.TrimSpace(toText(v))) {
+						fail("Incorrect " + strings.ToLower(typ) + " value", v)
+					}
+					fmt.Println("warning: stored NULL for incorrect " + strings.ToLower(typ) + " value '" + toText(v) + "' in column " + t.Name + "." + c.Name)
+					return nil
+				}
+				if typ == "DATE" {
+					return time.Unix(int64(math.Floor(f)), 0).UTC().Format("2006-01-02") // cut off the time of day
+				}
+				return time.Unix(int64(math.Floor(f)), 0).UTC().Format("2006-01-02 15:04:05")
+			}
+	}
+	if length, ok := textTypeLength[typ]; ok {
+		return func(v scm.Scmer) scm.Scmer {
+			s := toText(v)
+			if length > 0 && len(s) > length {
+				if strict {
+					fail("Data too long", v)
+				}
+				s = s[:length]
+				for !utf8.ValidString(s) {
+					s = s[:len(s)-1] // don't cut inside a character
+				}
+			}
+			return s
+		}
+	}
+	return nil // ANY and unknown types take everything
+}
+
+// converts numbers and numeric strings into float64
+func toNumber(v scm.Scmer) (float64, bool) {
+	switch x := v.(type) {
+		case float64:
+			return x, true
+		case int64:
+			return float64(x), true
+		case int:
+			return float64(x), true
+		case bool:
+			if x {
+				return 1, true
+			}
+			return 0, true
+		case string:
+			f, err := strconv.ParseFloat(strings.TrimSpace(x), 64)
+			return f, err == nil
+		case scm.LazyString:
+			f, err := strconv.ParseFloat(strings.TrimSpace(x.GetValue()), 64)
+			return f, err == nil
+	}
+	return 0, false
+}
+
+// reports whether an integer value survives the conversion to float64 (only relevant beyond 2^53)
+func exactInteger(v scm.Scmer) bool {
+	switch x := v.(type) {
+		case float64:
+			return true // already a float; nothing more to lose
+		case int64:
+			return int64(float64(x)) == x
+		case int:
+			return int(float64(x)) == x
+	}
+	s := strings.TrimSpace(toText(v))
+	if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return int64(float64(i)) == i
+	}
+	if u, err := strconv.ParseUint(s, 10, 64); err == nil {
+		return uint64(float64(u)) == u
+	}
+	return true // float notation or beyond 64 bit; the range check handles those
+}
+
+// parses the numeric prefix of a string like MySQL does in lenient mode ('12abc' -> 12)
+func leadingNumber(v scm.Scmer) float64 {
+	s := strings.TrimSpace(toText(v))
+	for len(s) > 0 {
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			return f
+		}
+		s = s[:len(s)-1]
+	}
+	return 0
+}
+
+func toText(v scm.Scmer) string {
+	switch x := v.(type) {
+		case string:
+			return x
+		case scm.LazyString:
+			return x.GetValue()
+		case float64:
+			return strconv.FormatFloat(x, 'f', -1, 64)
+	}
+	return scm.String(v)
+}
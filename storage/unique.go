@@ -0,0 +1,185 @@
+/*
+Copyright (C) 2024  Carl-Philip Hänsch
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package storage
+
+import "math"
+import "sort"
+import "sync"
+import "strings"
+import "encoding/binary"
+import "github.com/launix-de/memcp/scm"
+
+/*
+
+unique keys:
+ - every shard keeps a hashmap per unique key (built on first use) from the encoded key values to the recid
+ - keys of any arity are encoded into one string, so the hashmap works for composite keys of any length
+ - checking and inserting must not interleave with other inserts: if every unique key contains all
+   partitioning dimensions, a duplicate can only live in the shard the row goes to, so only that
+   shard's uniquelock is taken; otherwise the table-wide uniquelock serializes the check
+
+*/
+
+type uniqueHashmap struct {
+	cols []string
+	values map[string]uint // encoded key -> recid
+}
+
+// encodes the values of a key so that equal values give equal strings
+func uniqueHashKey(values []scm.Scmer) string {
+	var b strings.Builder
+	var buf [8]byte
+	writeString := func(tag byte, s string) {
+		b.WriteByte(tag)
+		binary.LittleEndian.PutUint64(buf[:], uint64(len(s)))
+		b.Write(buf[:])
+		b.WriteString(s)
+	}
+	for _, v := range values {
+		switch x := v.(type) {
+			case nil:
+				b.WriteByte('n')
+			case bool:
+				if x {
+					b.WriteByte('t')
+				} else {
+					b.WriteByte('F')
+				}
+			case float64:
+				b.WriteByte('f')
+				binary.LittleEndian.PutUint64(buf[:], math.Float64bits(x))
+				b.Write(buf[:])
+			case int64:
+				b.WriteByte('f')
+				binary.LittleEndian.PutUint64(buf[:], math.Float64bits(float64(x)))
+				b.Write(buf[:])
+			case int:
+				b.WriteByte('f')
+				binary.LittleEndian.PutUint64(buf[:], math.Float64bits(float64(x)))
+				b.Write(buf[:])
+			case string:
+				writeString('s', x)
+			case scm.LazyString:
+				writeString('s', x.GetValue())
+			default:
+				writeString('x', scm.String(v))
+		}
+	}
+	return b.String()
+}
+
+// adds a new delta row to the hashmap; this happens inside s.mu.Lock()
+func (hm *uniqueHashmap) insert(s *storageShard, recid uint, row []scm.Scmer) {
+	key := make([]scm.Scmer, len(hm.cols))
+	for i, col := range hm.cols {
+		if colidx, ok := s.deltaColumns[col]; ok && colidx < len(row) {
+			key[i] = row[colidx]
+		}
+	}
+	hm.values[uniqueHashKey(key)] = recid
+}
+
+// builds the hashmap of a unique key from main and delta storage; this happens inside s.mu.Lock()
+func (s *storageShard) buildUniqueHashmap(columns []string) {
+	hm := &uniqueHashmap{append([]string{}, columns...), make(map[string]uint)}
+	cols := make([]ColumnStorage, len(columns))
+	for i, col := range columns {
+		cols[i] = s.columns[col]
+	}
+	key := make([]scm.Scmer, len(columns))
+	for i := uint(0); i < s.main_count; i++ {
+		for j, col := range cols {
+			key[j] = nil
+			if col != nil {
+				key[j] = col.GetValue(i)
+			}
+		}
+		hm.values[uniqueHashKey(key)] = i
+	}
+	for i := range s.inserts {
+		for j, col := range columns {
+			key[j] = s.getDelta(i, col)
+		}
+		hm.values[uniqueHashKey(key)] = uint(i) + s.main_count
+	}
+	s.hashmaps[strings.Join(columns, "\x00")] = hm
+}
+
+// a set of unique locks that are taken and released together (in a fixed order, so they can't deadlock)
+type uniqueLocks []*sync.Mutex
+
+func (l uniqueLocks) Lock() {
+	for _, m := range l {
+		m.Lock()
+	}
+}
+
+func (l uniqueLocks) Unlock() {
+	for i := len(l) - 1; i >= 0; i-- {
+		l[i].Unlock()
+	}
+}
+
+// returns the lock that guards the unique check of these rows
+func (t *table) uniqueLock(columns []string, values [][]scm.Scmer) sync.Locker {
+	if t.Shards != nil || len(t.PDimensions) == 0 {
+		return &t.uniquelock
+	}
+	// every unique key must contain all partitioning dimensions
+	dimidx := make([]int, len(t.PDimensions))
+	for i, dim := range t.PDimensions {
+		for _, uniq := range t.Unique {
+			found := false
+			for _, col := range uniq.Cols {
+				if col == dim.Column {
+					found = true
+				}
+			}
+			if !found {
+				return &t.uniquelock
+			}
+		}
+		dimidx[i] = -1
+		for j, col := range columns {
+			if col == dim.Column {
+				dimidx[i] = j
+			}
+		}
+	}
+	// lock the shards the rows go to
+	shardidx := make(map[int]bool)
+	dimvals := make([]scm.Scmer, len(dimidx))
+	for _, row := range values {
+		for i, j := range dimidx {
+			dimvals[i] = nil
+			if j >= 0 && j < len(row) {
+				dimvals[i] = row[j]
+			}
+		}
+		shardidx[computeShardIndex(t.PDimensions, dimvals)] = true
+	}
+	indexes := make([]int, 0, len(shardidx))
+	for i := range shardidx {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+	locks := make(uniqueLocks, len(indexes))
+	for i, idx := range indexes {
+		locks[i] = &t.PShards[idx].uniquelock
+	}
+	return locks
+}